@@ -2,15 +2,18 @@ package main
 
 import (
 	"amethyst/internal/adaptive"
+	"amethyst/internal/cache"
 	"amethyst/internal/common"
 	"amethyst/internal/compaction"
+	"amethyst/internal/engine"
+	"amethyst/internal/iterator"
 	"amethyst/internal/metadata"
 	"amethyst/internal/memtable"
 	"amethyst/internal/segmentfile"
-	"amethyst/internal/sparseindex"
 	"amethyst/internal/sstable/reader"
 	"amethyst/internal/sstable/writer"
 	"amethyst/internal/wal"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -25,6 +28,10 @@ var (
 	numKeysFlag   = flag.Int("keys", 10000000, "Number of keys")
 	valueSizeFlag = flag.Int("value-size", 256, "Value size in bytes")
 	engineFlag    = flag.String("engine", "adaptive", "Engine name for output")
+	walSyncFlag   = flag.String("wal-sync", "always", "WAL sync policy: always, periodic or never")
+	walSyncMsFlag = flag.Int("wal-sync-ms", 10, "WAL sync interval in ms for --wal-sync=periodic")
+	cacheMBFlag   = flag.Int("cache-mb", 8, "Block cache size in MB")
+	freshFlag     = flag.Bool("fresh", true, "Remove the wal and segments directories and sstable.data before running instead of recovering them")
 )
 
 // Results structure for JSON output
@@ -73,6 +80,37 @@ func zipfian(n int, s float64) int {
 	return n - 1
 }
 
+// sequence numbers for the benchmark's hand-wired write path
+var lastSeq uint64
+
+func nextSeq() uint64 {
+	lastSeq++
+	return lastSeq
+}
+
+// compaction bytes already added to physicalBytes
+var compactionBytesCounted int64
+
+// settleCompactions lets the segments written during the phase out of the
+// controller's rewrite cooldown, wakes the scheduler now that the phase's
+// reads and writes are in the segment stats and waits for the compactions
+// it runs
+func settleCompactions(scheduler *compaction.Scheduler, physicalBytes *int64, compactionCount *int) {
+	time.Sleep(time.Duration(adaptive.MinRewriteInterval+1) * time.Second)
+	scheduler.Notify()
+	scheduler.WaitIdle()
+	countCompactions(scheduler, physicalBytes, compactionCount)
+	fmt.Printf("  Compactions so far: %d\n", *compactionCount)
+}
+
+// adds what background compactions wrote since the last call to the totals
+func countCompactions(scheduler *compaction.Scheduler, physicalBytes *int64, compactionCount *int) {
+	st := scheduler.Stats()
+	*physicalBytes += st.BytesWritten - compactionBytesCounted
+	compactionBytesCounted = st.BytesWritten
+	*compactionCount = int(st.Completed)
+}
+
 // Binary search helper for segment lookup
 func binarySearchSegment(segs []*common.SegmentMeta, key string, totalSegmentScans *int64) *common.SegmentMeta {
 	left, right := 0, len(segs)-1
@@ -107,9 +145,12 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Clean slate
-	os.Remove("wal.log")
-	os.Remove("sstable.data")
+	// Clean slate unless asked to pick up where the last run stopped
+	if *freshFlag {
+		os.RemoveAll("wal")
+		os.RemoveAll("segments")
+		os.Remove("sstable.data")
+	}
 
 	fmt.Printf("╔════════════════════════════════════════╗\n")
 	fmt.Printf("║  AMETHYST BENCHMARK                    ║\n")
@@ -118,29 +159,70 @@ func main() {
 	fmt.Printf("Workload: %s\n", *workloadFlag)
 	fmt.Printf("Keys:     %d\n", *numKeysFlag)
 	fmt.Printf("Value:    %d bytes\n", *valueSizeFlag)
+	fmt.Printf("WAL sync: %s\n", *walSyncFlag)
 	fmt.Println()
 
+	walOpts := wal.DefaultOptions()
+	switch *walSyncFlag {
+	case "always":
+		walOpts.Sync = wal.SyncAlways
+	case "periodic":
+		walOpts.Sync = wal.SyncPeriodic
+		walOpts.SyncInterval = time.Duration(*walSyncMsFlag) * time.Millisecond
+	case "never":
+		walOpts.Sync = wal.SyncNever
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown --wal-sync policy %q\n", *walSyncFlag)
+		os.Exit(1)
+	}
+
 	// Initialize components
-	w, err := wal.NewDiskWAL("wal.log")
+	w, err := wal.NewDiskWALWithOptions("wal", walOpts)
 	if err != nil {
 		panic(err)
 	}
 
-	mem := memtable.NewMemtable(4 * 1024)
+	mem := memtable.NewSkiplist(1 << 20)
 	meta := metadata.NewTracker()
 
-	fileMgr, err := segmentfile.NewSegmentFileManager("sstable.data")
+	store, err := segmentfile.NewSegmentStore("segments")
 	if err != nil {
 		panic(err)
 	}
+	// segments of runs from before the segment store
+	var fileMgr segmentfile.SegmentFileManager
+	if _, err := os.Stat("sstable.data"); err == nil {
+		if fileMgr, err = segmentfile.NewSegmentFileManager("sstable.data"); err != nil {
+			panic(err)
+		}
+	}
+
+	sstWriter := writer.NewStoreWriter(store, writer.DefaultBlockOptions())
+	blockCache := cache.New(int64(*cacheMBFlag)*1024*1024, cache.DefaultShards)
+	sstReader := reader.NewReaderWithStore(store, fileMgr, blockCache, true)
 
-	indexBuilder := sparseindex.NewBuilder(16)
-	sstWriter := writer.NewWriter(fileMgr, indexBuilder)
-	sstReader := reader.NewReader(fileMgr)
+	if !*freshFlag {
+		recovered, err := engine.Recover(w, mem, fileMgr, store, sstReader, meta, true)
+		if err != nil {
+			panic(err)
+		}
+		lastSeq = recovered
+	}
 
 	fsm := adaptive.NewFSMController()
 	director := compaction.NewDirector(meta, fsm)
 	executor := compaction.NewExecutor(meta, sstReader, sstWriter)
+	// compactions run in the background for the whole run
+	scheduler := compaction.NewScheduler(director, executor)
+	ctx, stopCompactions := context.WithCancel(context.Background())
+	scheduler.Start(ctx)
+	// segments a compaction made obsolete are deleted once nothing reads them
+	meta.SetReleaseHook(func(seg *common.SegmentMeta) {
+		blockCache.DropSegment(seg.ID)
+		if !seg.Shared {
+			store.Remove(seg.ID)
+		}
+	})
 
 	// Metrics tracking
 	var logicalBytes int64 = 0
@@ -155,12 +237,12 @@ func main() {
 	// Run workload
 	switch *workloadFlag {
 	case "shift":
-		phases = runShift(w, mem, meta, sstWriter, sstReader, fsm, director, executor,
+		phases = runShift(w, mem, meta, sstWriter, sstReader, fsm, scheduler,
 			*numKeysFlag, *valueSizeFlag, &logicalBytes, &physicalBytes,
 			&totalReads, &totalSegmentScans, &compactionCount)
 
 	case "pure-write":
-		runPureWrite(w, mem, meta, sstWriter, fsm, director, executor,
+		runPureWrite(w, mem, meta, sstWriter, fsm, scheduler,
 			*numKeysFlag, *valueSizeFlag, &logicalBytes, &physicalBytes, &compactionCount)
 
 	case "pure-read":
@@ -169,22 +251,22 @@ func main() {
 			&totalReads, &totalSegmentScans)
 
 	case "mixed":
-		runMixed(w, mem, meta, sstWriter, sstReader, fsm, director, executor,
+		runMixed(w, mem, meta, sstWriter, sstReader, fsm, scheduler,
 			*numKeysFlag, *valueSizeFlag, &logicalBytes, &physicalBytes,
 			&totalReads, &totalSegmentScans, &compactionCount)
 
 	case "read-heavy":
-		runReadHeavy(w, mem, meta, sstWriter, sstReader, fsm, director, executor,
+		runReadHeavy(w, mem, meta, sstWriter, sstReader, fsm, scheduler,
 			*numKeysFlag, *valueSizeFlag, &logicalBytes, &physicalBytes,
 			&totalReads, &totalSegmentScans, &compactionCount)
 
 	case "write-heavy":
-		runWriteHeavy(w, mem, meta, sstWriter, sstReader, fsm, director, executor,
+		runWriteHeavy(w, mem, meta, sstWriter, sstReader, fsm, scheduler,
 			*numKeysFlag, *valueSizeFlag, &logicalBytes, &physicalBytes,
 			&totalReads, &totalSegmentScans, &compactionCount)
 
 	case "zipfian":
-		runZipfian(w, mem, meta, sstWriter, sstReader, fsm, director, executor,
+		runZipfian(w, mem, meta, sstWriter, sstReader, fsm, scheduler,
 			*numKeysFlag, *valueSizeFlag, &logicalBytes, &physicalBytes,
 			&totalReads, &totalSegmentScans, &compactionCount)
 
@@ -193,6 +275,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	stopCompactions()
+	scheduler.Stop()
+	countCompactions(scheduler, &physicalBytes, &compactionCount)
+
 	totalDuration := time.Since(startTime)
 
 	// Calculate final metrics
@@ -205,12 +291,18 @@ func main() {
 		ra = float64(totalSegmentScans) / float64(totalReads)
 	}
 
-	// Space amplification (approximate)
-	allSegs := meta.GetAllSegments()
-	liveDataBytes := int64(*numKeysFlag * (*valueSizeFlag + 20)) // rough estimate
-	totalDiskBytes := int64(0)
-	for _, seg := range allSegs {
-		totalDiskBytes += seg.Length
+	// Space amplification: what the segments take on disk over the newest
+	// version of every live key
+	liveDataBytes, err := liveDataSize(mem, meta, sstReader)
+	if err != nil {
+		panic(err)
+	}
+	totalDiskBytes, err := store.DiskUsage()
+	if err != nil {
+		panic(err)
+	}
+	if info, err := os.Stat("sstable.data"); err == nil {
+		totalDiskBytes += info.Size()
 	}
 
 	sa := 0.0
@@ -258,6 +350,9 @@ func main() {
 	fmt.Printf("Read Amplification:   %.2f\n", ra)
 	fmt.Printf("Space Amplification:  %.2f\n", sa)
 	fmt.Printf("Compaction Count:     %d\n", compactionCount)
+	cacheStats := blockCache.Stats()
+	fmt.Printf("Block Cache:          %d hits, %d misses, %d evictions\n",
+		cacheStats.Hits, cacheStats.Misses, cacheStats.Evictions)
 	fmt.Printf("Total Duration:       %.2fs\n", totalDuration.Seconds())
 	fmt.Printf("Throughput:           %.0f ops/sec\n",
 		float64(*numKeysFlag)/totalDuration.Seconds())
@@ -278,13 +373,31 @@ func main() {
 	fmt.Printf("Results saved to: %s\n", filename)
 }
 
+// key and value bytes of the newest version of every live key
+func liveDataSize(mem memtable.Memtable, meta metadata.Tracker, r reader.SSTableReader) (int64, error) {
+	children := []iterator.EntryIterator{mem.NewIterator("", "")}
+	v := meta.CurrentVersion()
+	defer v.Unref()
+	for _, seg := range v.Segments() {
+		children = append(children, r.NewIterator(seg))
+	}
+	it := iterator.NewBoundedIterator(iterator.NewMergingIterator(children), "", "")
+	defer it.Close()
+
+	var n int64
+	for ok := it.SeekToFirst(); ok; ok = it.Next() {
+		n += int64(len(it.Key()) + len(it.Value()))
+	}
+	return n, it.Err()
+}
+
 // ========================================
 // WORKLOAD IMPLEMENTATIONS
 // ========================================
 
 func runShift(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	sstWriter writer.SSTableWriter, sstReader reader.SSTableReader,
-	fsm adaptive.Controller, director compaction.Director, executor compaction.Executor,
+	fsm adaptive.Controller, scheduler *compaction.Scheduler,
 	numKeys, valueSize int, logicalBytes, physicalBytes, totalReads, totalSegmentScans *int64,
 	compactionCount *int) []PhaseResult {
 
@@ -299,8 +412,9 @@ func runShift(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 		val := make([]byte, valueSize)
 		rand.Read(val)
 
-		w.LogPut(key, val)
-		mem.Put(key, val)
+		seq := nextSeq()
+		w.LogPut(seq, key, val)
+		mem.Put(key, val, seq)
 		*logicalBytes += int64(len(key) + valueSize)
 
 		if mem.ShouldFlush() {
@@ -375,15 +489,7 @@ func runShift(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	fmt.Printf("  Current RA: %.2f\n", phase2RA)
 	fmt.Printf("  Duration: %v\n", phase2Duration)
 
-	// Try compaction
-	time.Sleep(2 * time.Second)
-	if plan := director.MaybePlan(); plan != nil {
-		fmt.Printf("  Compaction triggered: %s\n", plan.Reason)
-		newSeg, _ := executor.Execute(plan)
-		*physicalBytes += newSeg.Length
-		*compactionCount++
-		fmt.Printf("  New strategy: %v\n", newSeg.Strategy)
-	}
+	settleCompactions(scheduler, physicalBytes, compactionCount)
 
 	// PHASE 3: Write again
 	fmt.Println("\n=== PHASE 3: Write (50%) ===")
@@ -394,8 +500,9 @@ func runShift(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 		val := make([]byte, valueSize)
 		rand.Read(val)
 
-		w.LogPut(key, val)
-		mem.Put(key, val)
+		seq := nextSeq()
+		w.LogPut(seq, key, val)
+		mem.Put(key, val, seq)
 		*logicalBytes += int64(len(key) + valueSize)
 
 		if mem.ShouldFlush() {
@@ -431,22 +538,14 @@ func runShift(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 
 	fmt.Printf("  Duration: %v\n", phase3Duration)
 
-	// Try compaction again
-	time.Sleep(2 * time.Second)
-	if plan := director.MaybePlan(); plan != nil {
-		fmt.Printf("  Compaction triggered: %s\n", plan.Reason)
-		newSeg, _ := executor.Execute(plan)
-		*physicalBytes += newSeg.Length
-		*compactionCount++
-		fmt.Printf("  New strategy: %v\n", newSeg.Strategy)
-	}
+	settleCompactions(scheduler, physicalBytes, compactionCount)
 
 	return phases
 }
 
 func runPureWrite(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	sstWriter writer.SSTableWriter, fsm adaptive.Controller,
-	director compaction.Director, executor compaction.Executor,
+	scheduler *compaction.Scheduler,
 	numKeys, valueSize int, logicalBytes, physicalBytes *int64, compactionCount *int) {
 
 	fmt.Println("=== PURE WRITE WORKLOAD ===")
@@ -456,8 +555,9 @@ func runPureWrite(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 		val := make([]byte, valueSize)
 		rand.Read(val)
 
-		w.LogPut(key, val)
-		mem.Put(key, val)
+		seq := nextSeq()
+		w.LogPut(seq, key, val)
+		mem.Put(key, val, seq)
 		*logicalBytes += int64(len(key) + valueSize)
 
 		if mem.ShouldFlush() {
@@ -482,13 +582,7 @@ func runPureWrite(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 		meta.RegisterSegment(seg)
 	}
 
-	// Try compaction
-	time.Sleep(2 * time.Second)
-	if plan := director.MaybePlan(); plan != nil {
-		newSeg, _ := executor.Execute(plan)
-		*physicalBytes += newSeg.Length
-		*compactionCount++
-	}
+	settleCompactions(scheduler, physicalBytes, compactionCount)
 }
 
 func runPureRead(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
@@ -504,8 +598,9 @@ func runPureRead(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 		val := make([]byte, valueSize)
 		rand.Read(val)
 
-		w.LogPut(key, val)
-		mem.Put(key, val)
+		seq := nextSeq()
+		w.LogPut(seq, key, val)
+		mem.Put(key, val, seq)
 
 		if mem.ShouldFlush() {
 			data := mem.Flush()
@@ -551,7 +646,7 @@ func runPureRead(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 
 func runMixed(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	sstWriter writer.SSTableWriter, sstReader reader.SSTableReader,
-	fsm adaptive.Controller, director compaction.Director, executor compaction.Executor,
+	fsm adaptive.Controller, scheduler *compaction.Scheduler,
 	numKeys, valueSize int, logicalBytes, physicalBytes, totalReads, totalSegmentScans *int64,
 	compactionCount *int) {
 
@@ -564,8 +659,9 @@ func runMixed(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 		val := make([]byte, valueSize)
 		rand.Read(val)
 
-		w.LogPut(key, val)
-		mem.Put(key, val)
+		seq := nextSeq()
+		w.LogPut(seq, key, val)
+		mem.Put(key, val, seq)
 		*logicalBytes += int64(len(key) + valueSize)
 
 		if mem.ShouldFlush() {
@@ -601,8 +697,9 @@ func runMixed(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 			val := make([]byte, valueSize)
 			rand.Read(val)
 
-			w.LogPut(key, val)
-			mem.Put(key, val)
+			seq := nextSeq()
+			w.LogPut(seq, key, val)
+			mem.Put(key, val, seq)
 			*logicalBytes += int64(len(key) + valueSize)
 
 			if mem.ShouldFlush() {
@@ -631,18 +728,12 @@ func runMixed(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	}
 	fmt.Println()
 
-	// Compaction
-	time.Sleep(2 * time.Second)
-	if plan := director.MaybePlan(); plan != nil {
-		newSeg, _ := executor.Execute(plan)
-		*physicalBytes += newSeg.Length
-		*compactionCount++
-	}
+	settleCompactions(scheduler, physicalBytes, compactionCount)
 }
 
 func runReadHeavy(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	sstWriter writer.SSTableWriter, sstReader reader.SSTableReader,
-	fsm adaptive.Controller, director compaction.Director, executor compaction.Executor,
+	fsm adaptive.Controller, scheduler *compaction.Scheduler,
 	numKeys, valueSize int, logicalBytes, physicalBytes, totalReads, totalSegmentScans *int64,
 	compactionCount *int) {
 
@@ -655,8 +746,9 @@ func runReadHeavy(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 		val := make([]byte, valueSize)
 		rand.Read(val)
 
-		w.LogPut(key, val)
-		mem.Put(key, val)
+		seq := nextSeq()
+		w.LogPut(seq, key, val)
+		mem.Put(key, val, seq)
 		*logicalBytes += int64(len(key) + valueSize)
 
 		if mem.ShouldFlush() {
@@ -703,8 +795,9 @@ func runReadHeavy(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 			val := make([]byte, valueSize)
 			rand.Read(val)
 
-			w.LogPut(key, val)
-			mem.Put(key, val)
+			seq := nextSeq()
+			w.LogPut(seq, key, val)
+			mem.Put(key, val, seq)
 			*logicalBytes += int64(len(key) + valueSize)
 
 			if mem.ShouldFlush() {
@@ -722,18 +815,12 @@ func runReadHeavy(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	}
 	fmt.Println()
 
-	// Compaction
-	time.Sleep(2 * time.Second)
-	if plan := director.MaybePlan(); plan != nil {
-		newSeg, _ := executor.Execute(plan)
-		*physicalBytes += newSeg.Length
-		*compactionCount++
-	}
+	settleCompactions(scheduler, physicalBytes, compactionCount)
 }
 
 func runWriteHeavy(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	sstWriter writer.SSTableWriter, sstReader reader.SSTableReader,
-	fsm adaptive.Controller, director compaction.Director, executor compaction.Executor,
+	fsm adaptive.Controller, scheduler *compaction.Scheduler,
 	numKeys, valueSize int, logicalBytes, physicalBytes, totalReads, totalSegmentScans *int64,
 	compactionCount *int) {
 
@@ -746,8 +833,9 @@ func runWriteHeavy(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 		val := make([]byte, valueSize)
 		rand.Read(val)
 
-		w.LogPut(key, val)
-		mem.Put(key, val)
+		seq := nextSeq()
+		w.LogPut(seq, key, val)
+		mem.Put(key, val, seq)
 		*logicalBytes += int64(len(key) + valueSize)
 
 		if mem.ShouldFlush() {
@@ -783,8 +871,9 @@ func runWriteHeavy(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 			val := make([]byte, valueSize)
 			rand.Read(val)
 
-			w.LogPut(key, val)
-			mem.Put(key, val)
+			seq := nextSeq()
+			w.LogPut(seq, key, val)
+			mem.Put(key, val, seq)
 			*logicalBytes += int64(len(key) + valueSize)
 
 			if mem.ShouldFlush() {
@@ -809,18 +898,12 @@ func runWriteHeavy(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	}
 	fmt.Println()
 
-	// Compaction
-	time.Sleep(2 * time.Second)
-	if plan := director.MaybePlan(); plan != nil {
-		newSeg, _ := executor.Execute(plan)
-		*physicalBytes += newSeg.Length
-		*compactionCount++
-	}
+	settleCompactions(scheduler, physicalBytes, compactionCount)
 }
 
 func runZipfian(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 	sstWriter writer.SSTableWriter, sstReader reader.SSTableReader,
-	fsm adaptive.Controller, director compaction.Director, executor compaction.Executor,
+	fsm adaptive.Controller, scheduler *compaction.Scheduler,
 	numKeys, valueSize int, logicalBytes, physicalBytes, totalReads, totalSegmentScans *int64,
 	compactionCount *int) {
 
@@ -833,8 +916,9 @@ func runZipfian(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 		val := make([]byte, valueSize)
 		rand.Read(val)
 
-		w.LogPut(key, val)
-		mem.Put(key, val)
+		seq := nextSeq()
+		w.LogPut(seq, key, val)
+		mem.Put(key, val, seq)
 		*logicalBytes += int64(len(key) + valueSize)
 
 		if mem.ShouldFlush() {
@@ -896,12 +980,5 @@ func runZipfian(w wal.WAL, mem memtable.Memtable, meta metadata.Tracker,
 			topHotKeyAccesses*100/numReads)
 	}
 
-	// Compaction
-	time.Sleep(2 * time.Second)
-	if plan := director.MaybePlan(); plan != nil {
-		fmt.Printf("  Compaction triggered: %s\n", plan.Reason)
-		newSeg, _ := executor.Execute(plan)
-		*physicalBytes += newSeg.Length
-		*compactionCount++
-	}
+	settleCompactions(scheduler, physicalBytes, compactionCount)
 }
\ No newline at end of file
@@ -11,6 +11,7 @@ const MinRewriteInterval = int64(1)           // 1 second
 const ReadWriteRatioThreshold = 4.0
 const OverlapThreshold = 2
 const WriteCountThreshold = int64(100)
+const ExpiredFractionThreshold = 0.5          // share of TTL data past its expiry
 
 type Controller interface {
 	ShouldRewrite(meta *common.SegmentMeta) (bool, common.CompactionType, string)
@@ -34,6 +35,15 @@ func (c *FSMController) ShouldRewrite(meta *common.SegmentMeta) (bool, common.Co
 	if meta.Size() < MinSegmentSize {
 		return false, meta.Strategy, ""
 	}
+
+	// Mostly expired: a rewrite drops the dead entries whatever the
+	// workload, so it keeps the strategy
+	if expired := meta.ExpiredFraction(time.Now().UnixNano()); expired >= ExpiredFractionThreshold {
+		return true, meta.Strategy, fmt.Sprintf(
+			"expired=%.0f%% (TTL data past its expiry), rewrite",
+			expired*100,
+		)
+	}
 	
 	switch meta.Strategy {
 	case common.TIERED:
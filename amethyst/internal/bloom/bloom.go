@@ -0,0 +1,98 @@
+package bloom
+
+import (
+	"errors"
+	"hash/fnv"
+)
+
+// 10 bits per key gives roughly a 1% false positive rate
+const DefaultBitsPerKey = 10
+
+var ErrBadFilter = errors.New("bloom: malformed filter")
+
+// Filter answers "is key possibly in the set". A false answer is certain,
+// a true answer is wrong at a rate set by the bits spent per key.
+type Filter struct {
+	bits []byte
+	k    uint8 // probes per key
+}
+
+// Build makes a filter over keys given as their Hash, with bitsPerKey bits
+// for each of them.
+func Build(hashes []uint64, bitsPerKey int) *Filter {
+	if bitsPerKey < 1 {
+		bitsPerKey = 1
+	}
+	// k = bitsPerKey * ln(2) minimizes the false positive rate
+	k := uint8(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64 // tiny filters have a very high false positive rate
+	}
+	f := &Filter{bits: make([]byte, (nbits+7)/8), k: k}
+	for _, h := range hashes {
+		f.add(h)
+	}
+	return f
+}
+
+// Hash is the key hash filters are built from and probed with.
+func Hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// double hashing: probe i is h1 + i*h2, see Kirsch & Mitzenmacher
+func (f *Filter) add(h uint64) {
+	nbits := uint64(len(f.bits)) * 8
+	h1, h2 := h&0xffffffff, h>>32
+	for i := uint64(0); i < uint64(f.k); i++ {
+		pos := (h1 + i*h2) % nbits
+		f.bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+func (f *Filter) MayContain(key string) bool {
+	nbits := uint64(len(f.bits)) * 8
+	if nbits == 0 {
+		return true
+	}
+	h := Hash(key)
+	h1, h2 := h&0xffffffff, h>>32
+	for i := uint64(0); i < uint64(f.k); i++ {
+		pos := (h1 + i*h2) % nbits
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode lays the filter out as Bits| K(1)
+func (f *Filter) Encode() []byte {
+	buf := make([]byte, 0, len(f.bits)+1)
+	buf = append(buf, f.bits...)
+	return append(buf, f.k)
+}
+
+// Decode parses what Encode produced. The bits are copied out of data.
+func Decode(data []byte) (*Filter, error) {
+	if len(data) < 2 {
+		return nil, ErrBadFilter
+	}
+	k := data[len(data)-1]
+	if k < 1 || k > 30 {
+		return nil, ErrBadFilter
+	}
+	bits := make([]byte, len(data)-1)
+	copy(bits, data)
+	return &Filter{bits: bits, k: k}, nil
+}
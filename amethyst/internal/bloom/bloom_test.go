@@ -0,0 +1,96 @@
+package bloom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func buildKeys(keys []string, bitsPerKey int) *Filter {
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i] = Hash(key)
+	}
+	return Build(hashes, bitsPerKey)
+}
+
+func keyRange(prefix string, n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s%08d", prefix, i)
+	}
+	return keys
+}
+
+func TestFilter_NoFalseNegatives(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 20000} {
+		keys := keyRange("key-", n)
+		for _, bitsPerKey := range []int{1, 4, DefaultBitsPerKey} {
+			f := buildKeys(keys, bitsPerKey)
+			for _, key := range keys {
+				if !f.MayContain(key) {
+					t.Fatalf("%d keys, %d bits per key: %s missing", n, bitsPerKey, key)
+				}
+			}
+		}
+	}
+}
+
+func TestFilter_FalsePositiveRate(t *testing.T) {
+	const n = 20000
+	keys := keyRange("key-", n)
+	absent := keyRange("absent-", n)
+	for _, bitsPerKey := range []int{4, DefaultBitsPerKey, 16} {
+		f := buildKeys(keys, bitsPerKey)
+		var hits int
+		for _, key := range absent {
+			if f.MayContain(key) {
+				hits++
+			}
+		}
+		rate := float64(hits) / n
+
+		// (1 - e^(-k/bitsPerKey))^k for the k Build picks
+		k := float64(f.k)
+		want := math.Pow(1-math.Exp(-k/float64(bitsPerKey)), k)
+		if rate > 2*want+0.001 {
+			t.Errorf("%d bits per key: false positive rate %.4f, expected about %.4f", bitsPerKey, rate, want)
+		}
+	}
+}
+
+func TestFilter_EncodeDecode(t *testing.T) {
+	keys := keyRange("key-", 1000)
+	f := buildKeys(keys, DefaultBitsPerKey)
+	buf := f.Encode()
+
+	g, err := Decode(buf)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if g.k != f.k || !bytes.Equal(g.bits, f.bits) {
+		t.Fatalf("round trip changed the filter")
+	}
+	// the decoded filter must not alias the buffer it was read from
+	for i := range buf {
+		buf[i] = 0
+	}
+	for _, key := range keys {
+		if !g.MayContain(key) {
+			t.Fatalf("%s missing after the round trip", key)
+		}
+	}
+	for _, absent := range keyRange("absent-", 1000) {
+		if f.MayContain(absent) != g.MayContain(absent) {
+			t.Fatalf("%s answered differently after the round trip", absent)
+		}
+	}
+
+	for _, bad := range [][]byte{nil, {6}, {0xff, 0}, {0xff, 31}} {
+		if _, err := Decode(bad); !errors.Is(err, ErrBadFilter) {
+			t.Errorf("decode of %v: got %v", bad, err)
+		}
+	}
+}
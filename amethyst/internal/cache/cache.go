@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultCapacity = int64(8 * 1024 * 1024) // 8MB
+	DefaultShards   = 16
+)
+
+// Key names a block by the segment it belongs to and its offset in it.
+type Key struct {
+	SegmentID string
+	Offset    int64
+}
+
+// Stats are cumulative except Size and Pinned, which are current usage.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int64 // bytes charged by all entries, pinned ones included
+	Pinned    int64 // bytes charged by pinned entries
+}
+
+// Cache is a sharded, capacity-bounded LRU of decoded blocks. Each shard
+// gets an equal part of the capacity and its own lock. Pinned entries are
+// never evicted by pressure, only by DropSegment, but count towards the
+// capacity so they crowd out unpinned ones. A Cache is safe to share
+// between readers, and even engines.
+type Cache struct {
+	shards []*shard
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type shard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	pinned   int64
+	items    map[Key]*list.Element
+	lru      *list.List // front is most recently used, pinned entries stay out
+}
+
+type entry struct {
+	key    Key
+	value  any
+	charge int64
+	pinned bool
+}
+
+// New makes a cache holding about capacity bytes over the given number of
+// shards.
+func New(capacity int64, shards int) *Cache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &Cache{shards: make([]*shard, shards)}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			capacity: capacity / int64(shards),
+			items:    make(map[Key]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+func (c *Cache) shard(k Key) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(k.SegmentID))
+	return c.shards[(uint64(h.Sum32())^uint64(k.Offset))%uint64(len(c.shards))]
+}
+
+// Get returns the cached value and marks it recently used. Values are
+// shared between callers and must not be modified.
+func (c *Cache) Get(k Key) (any, bool) {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[k]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	e := el.Value.(*entry)
+	if !e.pinned {
+		s.lru.MoveToFront(el)
+	}
+	return e.value, true
+}
+
+// Put inserts value with the given charge in bytes, replacing what was
+// cached under k, and evicts least recently used entries to make room.
+func (c *Cache) Put(k Key, value any, charge int64, pinned bool) {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[k]; ok {
+		s.remove(el)
+	}
+	e := &entry{key: k, value: value, charge: charge, pinned: pinned}
+	var el *list.Element
+	if pinned {
+		el = &list.Element{Value: e} // tracked by the map only
+		s.pinned += charge
+	} else {
+		el = s.lru.PushFront(e)
+	}
+	s.items[k] = el
+	s.size += charge
+
+	for s.size > s.capacity && s.lru.Len() > 0 {
+		last := s.lru.Back()
+		if last == el {
+			break // never evict what was just inserted
+		}
+		s.remove(last)
+		c.evictions.Add(1)
+	}
+}
+
+// DropSegment removes every block of a segment, pinned ones included. Called
+// once a segment is obsolete.
+func (c *Cache) DropSegment(id string) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, el := range s.items {
+			if k.SegmentID == id {
+				s.remove(el)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// caller holds s.mu
+func (s *shard) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	delete(s.items, e.key)
+	s.size -= e.charge
+	if e.pinned {
+		s.pinned -= e.charge
+	} else {
+		s.lru.Remove(el)
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	st := Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		st.Size += s.size
+		st.Pinned += s.pinned
+		s.mu.Unlock()
+	}
+	return st
+}
@@ -0,0 +1,39 @@
+package cache
+
+import "testing"
+
+func TestCache_EvictsLeastRecentlyUsedButNotPinned(t *testing.T) {
+	c := New(300, 1)
+
+	c.Put(Key{"seg", 0}, "index", 100, true)
+	c.Put(Key{"seg", 1}, "a", 100, false)
+	c.Put(Key{"seg", 2}, "b", 100, false)
+
+	// touch a so b is the least recently used
+	if v, ok := c.Get(Key{"seg", 1}); !ok || v != "a" {
+		t.Fatalf("expected a cached, got %v %v", v, ok)
+	}
+	c.Put(Key{"seg", 3}, "c", 100, false)
+
+	if _, ok := c.Get(Key{"seg", 2}); ok {
+		t.Errorf("b should have been evicted")
+	}
+	for _, off := range []int64{0, 1, 3} {
+		if _, ok := c.Get(Key{"seg", off}); !ok {
+			t.Errorf("block %d should still be cached", off)
+		}
+	}
+
+	st := c.Stats()
+	if st.Evictions != 1 || st.Size != 300 || st.Pinned != 100 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	if st.Hits != 4 || st.Misses != 1 {
+		t.Errorf("expected 4 hits and 1 miss, got %+v", st)
+	}
+
+	c.DropSegment("seg")
+	if st := c.Stats(); st.Size != 0 || st.Pinned != 0 {
+		t.Errorf("expected an empty cache after dropping the segment, got %+v", st)
+	}
+}
@@ -1,5 +1,7 @@
 package common
 
+import "sort"
+
 type CompactionType int
 
 const (
@@ -7,6 +9,23 @@ const (
 	LEVELED
 )
 
+// high bit of the strategy byte in a segment header, set when a Bloom filter
+// follows the footer
+const SegmentFlagFilter byte = 0x80
+
+// next bit of the strategy byte, set when the records carry a Seq and the
+// header ends in the segment's MaxSeq. The first flat segments have neither,
+// see SegmentMeta.Unsequenced
+const SegmentFlagSeq byte = 0x40
+
+// flags byte of a segment record; an expiring record's value starts with
+// ExpiresAt(8)
+const (
+	RecordFlagTombstone byte = 0x01
+	RecordFlagExpiring  byte = 0x02
+	RecordFlagMerge     byte = 0x04
+)
+
 type SegmentMeta struct {
 	ID     string
 	Offset int64
@@ -24,8 +43,27 @@ type SegmentMeta struct {
 	CreatedAt     int64
 	LastRewriteAt int64
 
-	Obsolete          bool
-	SparseIndex       interface{}
+	// highest sequence number of any entry in the segment
+	MaxSeq uint64
+
+	// expiry times of the segment's entries, see ExpiryHistogram; nil if
+	// none expires
+	Expiries []int64
+
+	Obsolete bool
+	// Shared segments sit in the legacy single data file at Offset, all
+	// others have a file of their own in the segment store
+	Shared bool
+	// Unsequenced flat segments were written before sequence numbers, every
+	// record in them takes MaxSeq, which recovery derives from their place
+	// in the legacy data file
+	Unsequenced bool
+	// RangeDeletes is set when the segment holds range tombstones, only
+	// block segments can; lookups skip the others when gathering them
+	RangeDeletes bool
+
+	SparseIndex       interface{} // *sparseindex.SparseIndex for flat segments, *block.Footer for block ones
+	Filter            interface{} // *bloom.Filter of a flat segment, block segments keep theirs in a block
 	DataStartOffset   int64
 	SparseIndexOffset int64
 }
@@ -45,15 +83,37 @@ func (s *SegmentMeta) ReadWriteRatio() float64 {
 	return float64(s.ReadCount) / float64(s.WriteCount)
 }
 
+// ExpiredFraction estimates the share of the segment's entries whose time to
+// live is up at now, in unix nanoseconds.
+func (s *SegmentMeta) ExpiredFraction(now int64) float64 {
+	expired := 0
+	for _, at := range s.Expiries {
+		if at <= now {
+			expired++
+		}
+	}
+	return float64(expired) / ExpiryBuckets
+}
+
 // CooldownExpired returns true if enough time has passed since last rewrite.
 func (s *SegmentMeta) CooldownExpired(now int64, minInterval int64) bool {
 	return now-s.LastRewriteAt >= minInterval
 }
 
+// Seq is assigned by the engine at write time and only ever grows, so of two
+// versions of a key the one with the higher Seq is the newer one no matter
+// which memtable or segment it was found in.
 type WALEntry struct {
 	Key       string
 	Value     []byte
 	Tombstone bool
+	Seq       uint64
+	ExpiresAt int64 // see KVEntry
+	Merge     bool  // see KVEntry
+
+	// a range delete of Key up to End, see RangeTombstone
+	RangeDelete bool
+	End         string
 }
 
 // memtable sorted key entry
@@ -61,4 +121,73 @@ type KVEntry struct {
 	Key       string
 	Value     []byte
 	Tombstone bool
+	Seq       uint64
+	ExpiresAt int64 // unix nanoseconds after which the entry reads as deleted, 0 never
+	Merge     bool  // Value is a merge operand for the versions below, not the value
+}
+
+// Expired reports whether the entry's time to live is up at now, in unix
+// nanoseconds.
+func (e KVEntry) Expired(now int64) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now
+}
+
+// RangeTombstone deletes every key with Start <= key < End that was written
+// before it, with a lower Seq. An empty End means no upper bound.
+type RangeTombstone struct {
+	Start string
+	End   string
+	Seq   uint64
+}
+
+func (rt RangeTombstone) Contains(key string) bool {
+	return key >= rt.Start && (rt.End == "" || key < rt.End)
+}
+
+// Deletes reports whether rt hides entry.
+func (rt RangeTombstone) Deletes(entry KVEntry) bool {
+	return entry.Seq < rt.Seq && rt.Contains(entry.Key)
+}
+
+// Overlaps reports whether rt covers a key of [start, end], both inclusive.
+func (rt RangeTombstone) Overlaps(start, end string) bool {
+	return rt.Start <= end && (rt.End == "" || rt.End > start)
+}
+
+// CoveringSeq returns the highest Seq <= seq of the range tombstones
+// containing key, 0 if none does. An entry of key with a lower Seq is
+// deleted as of seq.
+func CoveringSeq(rts []RangeTombstone, key string, seq uint64) uint64 {
+	var covering uint64
+	for _, rt := range rts {
+		if rt.Seq <= seq && rt.Seq > covering && rt.Contains(key) {
+			covering = rt.Seq
+		}
+	}
+	return covering
+}
+
+// resolution of SegmentMeta.Expiries
+const ExpiryBuckets = 16
+
+// ExpiryHistogram sums up the expiry times of count entries, expiries
+// holding those of the ones that expire: entry i of the result is the
+// expiry time at rank (i+1)/ExpiryBuckets of all entries sorted by expiry,
+// the ones that never expire last. Ranks falling on those are left out, so
+// the fraction of the result that is past tells how much of the segment
+// has expired. expiries is sorted in place.
+func ExpiryHistogram(expiries []int64, count int) []int64 {
+	if len(expiries) == 0 {
+		return nil
+	}
+	sort.Slice(expiries, func(i, j int) bool { return expiries[i] < expiries[j] })
+	var hist []int64
+	for i := 1; i <= ExpiryBuckets; i++ {
+		rank := (i*count+ExpiryBuckets-1)/ExpiryBuckets - 1
+		if rank >= len(expiries) {
+			break
+		}
+		hist = append(hist, expiries[rank])
+	}
+	return hist
 }
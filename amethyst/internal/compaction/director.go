@@ -10,10 +10,44 @@ type Plan struct {
 	Inputs         []*common.SegmentMeta
 	OutputStrategy common.CompactionType
 	Reason         string
+	// Seqs of the live snapshots, ascending. Older versions of a key one of
+	// them reads survive the merge, the rest are dropped.
+	Snapshots []uint64
+
+	// filled in by Executor.Execute
+	Stats Stats
+}
+
+// Stats describes what a compaction did.
+type Stats struct {
+	// tombstones dropped because no segment outside the inputs held an
+	// older version of their key
+	TombstonesDropped int64
+	// key and value bytes of those tombstones and of the versions they
+	// shadowed in the inputs, and of the versions range deleted
+	BytesReclaimed int64
+	// versions dropped because a range tombstone of the inputs deletes them
+	RangeDeleted int64
+	// range tombstones dropped along the same lines as TombstonesDropped
+	RangeTombstonesDropped int64
+	// versions past their time to live, turned into tombstones; their
+	// values count in BytesReclaimed
+	Expired int64
+	// merge operands folded onto the value under them
+	OperandsMerged int64
+	// what the CompactionFilter did with the values it saw; dropped ones
+	// count in BytesReclaimed
+	FilterKept     int64
+	FilterDropped  int64
+	FilterReplaced int64
 }
 
 type Director interface {
 	MaybePlan() *Plan
+	// MaybePlanExcluding is MaybePlan leaving out every plan that would
+	// take one of the busy segments (by ID) as input, e.g. the inputs of
+	// compactions still running
+	MaybePlanExcluding(busy map[string]bool) *Plan
 }
 
 type director struct {
@@ -29,10 +63,15 @@ func NewDirector(meta metadata.Tracker, fsm adaptive.Controller) *director {
 }
 
 func (d *director) MaybePlan() *Plan {
-	segments := d.meta.GetAllSegments()
+	return d.MaybePlanExcluding(nil)
+}
+
+func (d *director) MaybePlanExcluding(busy map[string]bool) *Plan {
+	// copies: flushes, reads and other compactions carry on meanwhile
+	segments := d.meta.CopyLiveSegments()
 
 	for _, seg := range segments {
-		if seg.Obsolete {
+		if seg.Obsolete || busy[seg.ID] {
 			continue
 		}
 
@@ -45,10 +84,13 @@ func (d *director) MaybePlan() *Plan {
 		// to ensure the resulting segment has 0 overlaps.
 		var inputs []*common.SegmentMeta
 		if newStrategy == common.LEVELED {
-			inputs = d.collectAllOverlaps(seg)
+			inputs = collectAllOverlaps(seg, segments)
 		} else {
 			inputs = []*common.SegmentMeta{seg}
 		}
+		if anyBusy(inputs, busy) {
+			continue
+		}
 
 		return &Plan{
 			Inputs:         inputs,
@@ -59,9 +101,9 @@ func (d *director) MaybePlan() *Plan {
 	return nil
 }
 
-// collectAllOverlaps pulls in every segment that touches the range.
+// collectAllOverlaps pulls in every segment of live that touches the range.
 // This is what makes the Read Amp drop from 8 to 1.
-func (d *director) collectAllOverlaps(target *common.SegmentMeta) []*common.SegmentMeta {
+func collectAllOverlaps(target *common.SegmentMeta, live []*common.SegmentMeta) []*common.SegmentMeta {
 	inputs := []*common.SegmentMeta{target}
 	seen := make(map[string]bool)
 	seen[target.ID] = true
@@ -71,15 +113,25 @@ func (d *director) collectAllOverlaps(target *common.SegmentMeta) []*common.Segm
 		changed = false
 		for i := 0; i < len(inputs); i++ {
 			input := inputs[i]
-			overlaps := d.meta.GetOverlappingSegments(input)
-			for _, overlap := range overlaps {
-				if !seen[overlap.ID] && !overlap.Obsolete {
-					inputs = append(inputs, overlap)
-					seen[overlap.ID] = true
-					changed = true
+			for _, other := range live {
+				// Logic: If ranges touch, they overlap
+				if seen[other.ID] || input.MaxKey < other.MinKey || input.MinKey > other.MaxKey {
+					continue
 				}
+				inputs = append(inputs, other)
+				seen[other.ID] = true
+				changed = true
 			}
 		}
 	}
 	return inputs
 }
+
+func anyBusy(inputs []*common.SegmentMeta, busy map[string]bool) bool {
+	for _, seg := range inputs {
+		if busy[seg.ID] {
+			return true
+		}
+	}
+	return false
+}
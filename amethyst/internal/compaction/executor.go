@@ -2,82 +2,250 @@ package compaction
 
 import (
 	"amethyst/internal/common"
+	"amethyst/internal/iterator"
+	"amethyst/internal/merge"
 	"amethyst/internal/metadata"
 	"amethyst/internal/sstable/reader"
 	"amethyst/internal/sstable/writer"
 	"log"
-	"sort"
 )
 
+// encoded size after which compaction output rolls over to a new segment
+const DefaultTargetSegmentSize = int64(1024 * 1024)
+
 type Executor interface {
-	Execute(plan *Plan) (*common.SegmentMeta, error)
+	// Execute merges the plan's inputs into a run of non-overlapping
+	// segments in key order, and returns them
+	Execute(plan *Plan) ([]*common.SegmentMeta, error)
+}
+
+// ExecutorOptions tunes an executor made by NewExecutorWithOptions.
+type ExecutorOptions struct {
+	TargetSize    int64               //see NewExecutorWithTargetSize
+	MergeOperator merge.MergeOperator //folds merge operands onto the value under them, nil keeps them
+	Filter        CompactionFilter    //sees every value written, nil keeps them all
 }
 
 type executor struct {
-	meta   metadata.Tracker
-	reader reader.SSTableReader
-	writer writer.SSTableWriter
+	meta       metadata.Tracker
+	reader     reader.SSTableReader
+	writer     writer.SSTableWriter
+	targetSize int64
+	mergeOp    merge.MergeOperator
+	filter     CompactionFilter
 }
 
 func NewExecutor(
 	meta metadata.Tracker,
 	reader reader.SSTableReader,
 	writer writer.SSTableWriter,
+) *executor {
+	return NewExecutorWithTargetSize(meta, reader, writer, DefaultTargetSegmentSize)
+}
+
+// NewExecutorWithTargetSize is NewExecutor with an explicit output segment
+// size; zero or less means one output segment per compaction.
+func NewExecutorWithTargetSize(
+	meta metadata.Tracker,
+	reader reader.SSTableReader,
+	writer writer.SSTableWriter,
+	targetSize int64,
+) *executor {
+	return NewExecutorWithOptions(meta, reader, writer, ExecutorOptions{TargetSize: targetSize})
+}
+
+func NewExecutorWithOptions(
+	meta metadata.Tracker,
+	reader reader.SSTableReader,
+	writer writer.SSTableWriter,
+	opts ExecutorOptions,
 ) *executor {
 	return &executor{
-		meta:   meta,
-		reader: reader,
-		writer: writer,
+		meta:       meta,
+		reader:     reader,
+		writer:     writer,
+		targetSize: opts.TargetSize,
+		mergeOp:    opts.MergeOperator,
+		filter:     opts.Filter,
 	}
 }
 
-func (e *executor) Execute(plan *Plan) (*common.SegmentMeta, error) {
-	merged := make(map[string][]byte)
-
-	// Scan all input segments. Higher index (newer) will overwrite older values.
+func (e *executor) Execute(plan *Plan) ([]*common.SegmentMeta, error) {
+	// Stream a k-way merge of the inputs straight into the new segments. The
+	// highest Seq wins, whatever order the inputs come in, older versions
+	// only survive for a snapshot, and memory stays at one block per input
+	// plus the output being built.
+	var ranges []common.RangeTombstone
 	for _, seg := range plan.Inputs {
-		data, err := e.reader.Scan(seg)
+		rts, err := e.reader.RangeTombstones(seg)
 		if err != nil {
 			return nil, err
 		}
-		for k, v := range data {
-			merged[k] = v
-		}
+		ranges = append(ranges, rts...)
 	}
+	carried := e.carriedRanges(plan, ranges)
 
-	keys := make([]string, 0, len(merged))
-	for k := range merged {
-		keys = append(keys, k)
+	inputs := make([]iterator.EntryIterator, 0, len(plan.Inputs))
+	for _, seg := range plan.Inputs {
+		inputs = append(inputs, e.reader.NewIterator(seg))
 	}
-	sort.Strings(keys)
+	m := newMerger(inputs, plan.Snapshots, e.bottomOf(plan), ranges, e.mergeOp, e.filter)
+	defer m.Close()
 
-	finalEntries := make([]common.KVEntry, 0, len(keys))
-	for _, k := range keys {
-		val := merged[k]
-		finalEntries = append(finalEntries, common.KVEntry{
-			Key:       k,
-			Value:     val,
-			Tombstone: val == nil, // nil from Scan correctly becomes a Tombstone here
-		})
+	var outputs []*common.SegmentMeta
+	var lastKey string
+	var lower string // where the current output's share of the range tombstones starts
+	out := e.writer.NewSegment(plan.OutputStrategy)
+	for {
+		entry, ok := m.next()
+		if !ok {
+			break
+		}
+		// rolling over only between two keys, never between two versions
+		// of one, keeps the outputs' key ranges disjoint
+		if e.targetSize > 0 && out.Size() >= e.targetSize && entry.Key != lastKey {
+			if err := addRanges(out, carried, lower, entry.Key); err != nil {
+				return nil, err
+			}
+			lower = entry.Key
+			seg, err := out.Finish()
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, seg)
+			out = e.writer.NewSegment(plan.OutputStrategy)
+		}
+		if err := out.Add(entry); err != nil {
+			return nil, err
+		}
+		lastKey = entry.Key
+	}
+	if err := m.Err(); err != nil {
+		return nil, err
+	}
+	if err := addRanges(out, carried, lower, ""); err != nil {
+		return nil, err
 	}
 
-	newSeg, err := e.writer.WriteSegment(finalEntries, plan.OutputStrategy)
+	seg, err := out.Finish()
 	if err != nil {
 		return nil, err
 	}
+	if seg != nil {
+		outputs = append(outputs, seg)
+	}
 
-	if newSeg != nil {
-		e.meta.RegisterSegment(newSeg)
+	// Swap ALL inputs for the run. This is what drops your segment count.
+	if err := e.meta.ReplaceSegments(plan.Inputs, outputs); err != nil {
+		return nil, err
 	}
+	plan.Stats = Stats{
+		TombstonesDropped:      m.tombstonesDropped,
+		BytesReclaimed:         m.bytesReclaimed,
+		RangeDeleted:           m.rangeDeleted,
+		RangeTombstonesDropped: int64(len(ranges) - len(carried)),
+		Expired:                m.expired,
+		OperandsMerged:         m.operandsMerged,
+		FilterKept:             m.filterKept,
+		FilterDropped:          m.filterDropped,
+		FilterReplaced:         m.filterReplaced,
+	}
+
+	// Improved logging for Suchi to see the merge happening
+	log.Printf("ADAPTIVE MERGE: %d segments -> %d (Strategy: %v, Reason: %s, tombstones dropped: %d, range deleted: %d, expired: %d, operands merged: %d, filter dropped: %d, filter replaced: %d, reclaimed: %d bytes)",
+		len(plan.Inputs), len(outputs), plan.OutputStrategy, plan.Reason,
+		plan.Stats.TombstonesDropped+plan.Stats.RangeTombstonesDropped, plan.Stats.RangeDeleted,
+		plan.Stats.Expired, plan.Stats.OperandsMerged, plan.Stats.FilterDropped, plan.Stats.FilterReplaced,
+		plan.Stats.BytesReclaimed)
+
+	return outputs, nil
+}
+
+// bottomOf returns whether a key of the plan's range is at the bottom: no
+// live segment outside the inputs covers it, so the inputs hold every older
+// version of it. Memtables only ever hold newer data. Segments flushed while
+// the compaction runs are newer too, and those of a compaction running next
+// to this one are still live here, as its inputs.
+func (e *executor) bottomOf(plan *Plan) func(key string) bool {
+	inputs := make(map[string]bool, len(plan.Inputs))
+	minKey, maxKey := "", ""
+	for i, seg := range plan.Inputs {
+		inputs[seg.ID] = true
+		if i == 0 || seg.MinKey < minKey {
+			minKey = seg.MinKey
+		}
+		if i == 0 || seg.MaxKey > maxKey {
+			maxKey = seg.MaxKey
+		}
+	}
+	var others []*common.SegmentMeta
+	for _, seg := range e.meta.CopyLiveSegments() {
+		if !inputs[seg.ID] && seg.MinKey <= maxKey && seg.MaxKey >= minKey {
+			others = append(others, seg)
+		}
+	}
+	return func(key string) bool {
+		for _, seg := range others {
+			if key >= seg.MinKey && key <= seg.MaxKey {
+				return false
+			}
+		}
+		return true
+	}
+}
 
-	// Mark ALL inputs obsolete. This is what drops your segment count to 1.
+// carriedRanges returns the range tombstones of the inputs the outputs have
+// to keep. The merge drops every version of the inputs one deletes, so it
+// can only go if no live segment outside the inputs overlaps it, and no
+// snapshot older than it holds on to a version it deletes.
+func (e *executor) carriedRanges(plan *Plan, ranges []common.RangeTombstone) []common.RangeTombstone {
+	if len(ranges) == 0 {
+		return nil
+	}
+	inputs := make(map[string]bool, len(plan.Inputs))
 	for _, seg := range plan.Inputs {
-		e.meta.MarkObsolete(seg.ID)
+		inputs[seg.ID] = true
+	}
+	var others []*common.SegmentMeta
+	for _, seg := range e.meta.CopyLiveSegments() {
+		if !inputs[seg.ID] {
+			others = append(others, seg)
+		}
 	}
 
-	// Improved logging for Suchi to see the merge happening
-	log.Printf("ADAPTIVE MERGE: %d segments -> 1 (Strategy: %v, Reason: %s)",
-		len(plan.Inputs), plan.OutputStrategy, plan.Reason)
+	var carried []common.RangeTombstone
+	for _, rt := range ranges {
+		keep := len(plan.Snapshots) > 0 && plan.Snapshots[0] < rt.Seq
+		for _, seg := range others {
+			if keep {
+				break
+			}
+			keep = rt.Overlaps(seg.MinKey, seg.MaxKey)
+		}
+		if keep {
+			carried = append(carried, rt)
+		}
+	}
+	return carried
+}
 
-	return newSeg, nil
+// addRanges gives out the part of every range tombstone within
+// [lower, upper), an empty upper meaning no bound, so that each output only
+// deletes keys of its own share of the key space.
+func addRanges(out writer.SegmentBuilder, ranges []common.RangeTombstone, lower, upper string) error {
+	for _, rt := range ranges {
+		if rt.Start < lower {
+			rt.Start = lower
+		}
+		if upper != "" && (rt.End == "" || rt.End > upper) {
+			rt.End = upper
+		}
+		if rt.End != "" && rt.Start >= rt.End {
+			continue
+		}
+		if err := out.AddRangeTombstone(rt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
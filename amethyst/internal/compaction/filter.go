@@ -0,0 +1,29 @@
+package compaction
+
+// FilterDecision is what a CompactionFilter wants done with a value.
+type FilterDecision int
+
+const (
+	FilterKeep FilterDecision = iota
+	FilterDrop
+	FilterReplace
+)
+
+// CompactionFilter is shown every value a compaction is about to write and
+// decides whether it stays as is, goes, or is written with the value it
+// returns instead. A dropped key reads as deleted afterwards, older versions
+// don't show through. Versions a snapshot still reads, deleted ones and
+// unfolded merge operands are written without asking.
+//
+// It is called from compaction goroutines, several at a time, and must not
+// touch the engine.
+type CompactionFilter interface {
+	Filter(key string, value []byte) (FilterDecision, []byte)
+}
+
+// CompactionFilterFunc adapts a function to CompactionFilter.
+type CompactionFilterFunc func(key string, value []byte) (FilterDecision, []byte)
+
+func (f CompactionFilterFunc) Filter(key string, value []byte) (FilterDecision, []byte) {
+	return f(key, value)
+}
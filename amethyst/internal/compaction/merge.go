@@ -0,0 +1,353 @@
+package compaction
+
+import (
+	"amethyst/internal/common"
+	"amethyst/internal/iterator"
+	"amethyst/internal/merge"
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// mergeHeap orders the input iterators by their current key, and for equal
+// keys by Seq descending, so the top of the heap is always the newest
+// version of the smallest key still to be written.
+type mergeHeap []iterator.EntryIterator
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h[i].Entry(), h[j].Entry()
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.Seq > b.Seq
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(iterator.EntryIterator)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+// merger streams the union of several segments in key order: the newest
+// version of each key, followed by the older ones a snapshot still reads.
+// Only the current block of each input and the versions of one key are in
+// memory.
+type merger struct {
+	inputs    []iterator.EntryIterator
+	heap      mergeHeap
+	snapshots []uint64
+	err       error
+
+	// bottom reports whether no segment outside the inputs can hold an older
+	// version of key, so tombstones with nothing older under them can go;
+	// nil keeps every tombstone
+	bottom func(key string) bool
+	// range tombstones of the inputs, they delete versions of the inputs
+	// just like a newer version would
+	ranges []common.RangeTombstone
+	now    int64 // unix nanoseconds versions expire against
+	// folds merge operands onto the version under them, nil keeps them
+	operator merge.MergeOperator
+	// decides over the values written, nil keeps them all
+	filter CompactionFilter
+
+	pending []version // the versions of one key to hand out, newest first
+	pos     int
+
+	tombstonesDropped int64
+	bytesReclaimed    int64
+	rangeDeleted      int64
+	expired           int64
+	operandsMerged    int64
+	filterKept        int64
+	filterDropped     int64
+	filterReplaced    int64
+}
+
+// version is a version to write, with the size of the older versions of
+// its key the merge dropped because of it
+type version struct {
+	entry    common.KVEntry
+	shadowed int64
+}
+
+func newMerger(inputs []iterator.EntryIterator, snapshots []uint64, bottom func(key string) bool,
+	ranges []common.RangeTombstone, operator merge.MergeOperator, filter CompactionFilter) *merger {
+	m := &merger{
+		inputs:    inputs,
+		snapshots: snapshots,
+		bottom:    bottom,
+		ranges:    ranges,
+		now:       time.Now().UnixNano(),
+		operator:  operator,
+		filter:    filter,
+	}
+	for _, it := range inputs {
+		if it.SeekToFirst() {
+			m.heap = append(m.heap, it)
+		} else if err := it.Err(); err != nil {
+			m.err = err
+		}
+	}
+	heap.Init(&m.heap)
+	return m
+}
+
+// next returns the next version to write, tombstones included, or false
+// once all inputs are drained or one of them failed
+func (m *merger) next() (common.KVEntry, bool) {
+	for m.pos >= len(m.pending) {
+		if !m.nextKey() {
+			return common.KVEntry{}, false
+		}
+	}
+	m.pos++
+	return m.pending[m.pos-1].entry, true
+}
+
+// nextKey takes every version of the smallest key left off the heap and
+// keeps those worth writing in pending
+func (m *merger) nextKey() bool {
+	m.pending, m.pos = m.pending[:0], 0
+	if m.err != nil || len(m.heap) == 0 {
+		return false
+	}
+	key := m.heap[0].Entry().Key
+	for len(m.heap) > 0 && m.heap[0].Entry().Key == key {
+		it := m.heap[0]
+		entry := it.Entry()
+		if it.Next() {
+			heap.Fix(&m.heap, 0)
+		} else if err := it.Err(); err != nil {
+			m.err = err
+			return false
+		} else {
+			heap.Pop(&m.heap)
+		}
+
+		if n := len(m.pending); n > 0 && entry.Seq >= m.pending[n-1].entry.Seq {
+			continue // the same version in two inputs
+		}
+		if entry.Expired(m.now) {
+			// it reads as deleted from now on, which a tombstone keeps up
+			// while letting go of the value and of what it shadows
+			m.expired++
+			m.bytesReclaimed += int64(len(entry.Value))
+			entry = common.KVEntry{Key: entry.Key, Tombstone: true, Seq: entry.Seq}
+		}
+
+		if len(m.pending) == 0 {
+			m.pending = append(m.pending, version{entry: entry})
+			continue
+		}
+		// an operand is nothing without the versions under it
+		last := &m.pending[len(m.pending)-1]
+		if last.entry.Merge || KeepVersion(entry.Seq, last.entry.Seq, m.snapshots) {
+			m.pending = append(m.pending, version{entry: entry})
+		} else {
+			last.shadowed += entrySize(entry)
+		}
+	}
+
+	if len(m.ranges) > 0 {
+		m.dropRangeDeleted(key)
+	}
+	if m.operator != nil {
+		m.foldOperands(key)
+	}
+	if m.filter != nil && len(m.pending) > 0 {
+		m.applyFilter()
+	}
+
+	// a tombstone with nothing older under it anywhere hides nothing, reads
+	// at any snapshot find the key missing either way
+	if m.bottom != nil && m.bottom(key) {
+		for n := len(m.pending); n > 0 && m.pending[n-1].entry.Tombstone; n-- {
+			dropped := m.pending[n-1]
+			m.tombstonesDropped++
+			m.bytesReclaimed += entrySize(dropped.entry) + dropped.shadowed
+			m.pending = m.pending[:n-1]
+		}
+	}
+	return true
+}
+
+// dropRangeDeleted takes the versions of key a range tombstone deletes out
+// of pending. A version is read by the snapshots between its Seq and the
+// next newer version or covering range tombstone, it stays only if there
+// is one.
+func (m *merger) dropRangeDeleted(key string) {
+	kept := m.pending[:0]
+	var newer uint64 // Seq of the next newer version, 0 for the newest
+	for _, v := range m.pending {
+		seq := v.entry.Seq
+		if deleter := m.deleter(key, seq); deleter != 0 && (newer == 0 || deleter < newer) &&
+			!KeepVersion(seq, deleter, m.snapshots) {
+			m.rangeDeleted++
+			m.bytesReclaimed += entrySize(v.entry) + v.shadowed
+		} else {
+			kept = append(kept, v)
+		}
+		newer = seq
+	}
+	m.pending = kept
+}
+
+// foldOperands turns every run of merge operands in pending, together with
+// the version under it, into a plain value. A run with nothing under it is
+// left as it is, its value is in an older segment, unless nothing older
+// exists anywhere.
+func (m *merger) foldOperands(key string) {
+	var folded []version
+	for i := 0; i < len(m.pending); {
+		if !m.pending[i].entry.Merge {
+			folded = append(folded, m.pending[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(m.pending) && m.pending[j].entry.Merge {
+			j++
+		}
+		values, consumed, ok := m.fold(key, m.pending[i:j], m.pending[j:])
+		if !ok {
+			folded = append(folded, m.pending[i:j]...)
+		} else {
+			folded = append(folded, values...)
+			if consumed {
+				j++
+			}
+		}
+		i = j
+	}
+	m.pending = folded
+}
+
+// fold applies ops, newest first, to the first version of below. It
+// returns a value for the newest operand and one for every other operand a
+// snapshot reads, and whether the version under them can go. A run the
+// operator fails on isn't folded, reads report the failure.
+func (m *merger) fold(key string, ops, below []version) ([]version, bool, bool) {
+	lowest := ops[len(ops)-1].entry
+	var value []byte
+	consumed := false
+	switch {
+	case len(below) > 0 && below[0].entry.ExpiresAt != 0:
+		// the operands outlive the value, reads fold them onto nothing once
+		// it expires; compaction gets there when it turns into a tombstone
+		return nil, false, false
+	case len(below) > 0:
+		base := below[0].entry
+		readTo := lowest.Seq // snapshots up to here read the base
+		if deleter := m.deleter(key, base.Seq); deleter != 0 && deleter < readTo {
+			readTo = deleter // the operands apply to no value
+		} else if !base.Tombstone {
+			value = base.Value
+			if value == nil {
+				value = []byte{}
+			}
+		}
+		consumed = !KeepVersion(base.Seq, readTo, m.snapshots)
+	case m.bottom != nil && m.bottom(key):
+		// nothing older anywhere, the operands apply to no value
+	default:
+		return nil, false, false
+	}
+
+	var values []version // oldest first
+	for k := len(ops) - 1; k >= 0; k-- {
+		op := ops[k].entry
+		if k < len(ops)-1 {
+			if deleter := m.deleter(key, ops[k+1].entry.Seq); deleter != 0 && deleter < op.Seq {
+				value = nil // range deleted between the two operands
+			}
+		}
+		next, err := m.operator.FullMerge(key, value, [][]byte{op.Value})
+		if err != nil {
+			return nil, false, false
+		}
+		if next == nil {
+			next = []byte{}
+		}
+		value = next
+		if k == 0 || KeepVersion(op.Seq, ops[k-1].entry.Seq, m.snapshots) {
+			values = append(values, version{entry: common.KVEntry{Key: key, Value: value, Seq: op.Seq}})
+		}
+	}
+	for a, b := 0, len(values)-1; a < b; a, b = a+1, b-1 {
+		values[a], values[b] = values[b], values[a]
+	}
+
+	m.operandsMerged += int64(len(ops))
+	if consumed {
+		m.bytesReclaimed += entrySize(below[0].entry) + below[0].shadowed
+	}
+	return values, consumed, true
+}
+
+// applyFilter hands the newest version of the key to the filter, unless a
+// snapshot reads it: the older versions still here are there for snapshots
+// only. A dropped value becomes a tombstone, like an expired one, so none of
+// the older versions shows through.
+func (m *merger) applyFilter() {
+	v := &m.pending[0]
+	if v.entry.Tombstone || v.entry.Merge {
+		return
+	}
+	if n := len(m.snapshots); n > 0 && m.snapshots[n-1] >= v.entry.Seq {
+		return
+	}
+	switch decision, value := m.filter.Filter(v.entry.Key, v.entry.Value); decision {
+	case FilterDrop:
+		m.filterDropped++
+		m.bytesReclaimed += int64(len(v.entry.Value))
+		v.entry = common.KVEntry{Key: v.entry.Key, Tombstone: true, Seq: v.entry.Seq}
+	case FilterReplace:
+		m.filterReplaced++
+		v.entry.Value = value
+	default:
+		m.filterKept++
+	}
+}
+
+// the lowest Seq above seq of the range tombstones containing key, 0 if
+// none does
+func (m *merger) deleter(key string, seq uint64) uint64 {
+	var deleter uint64
+	for _, rt := range m.ranges {
+		if rt.Seq > seq && (deleter == 0 || rt.Seq < deleter) && rt.Contains(key) {
+			deleter = rt.Seq
+		}
+	}
+	return deleter
+}
+
+func entrySize(entry common.KVEntry) int64 {
+	return int64(len(entry.Key) + len(entry.Value))
+}
+
+// KeepVersion reports whether the version of a key written at seq has to
+// survive next to the newer version written at newer: it does if a
+// snapshot was taken in between, which is then the one reading it.
+// snapshots is sorted ascending.
+func KeepVersion(seq, newer uint64, snapshots []uint64) bool {
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i] >= seq })
+	return i < len(snapshots) && snapshots[i] < newer
+}
+
+func (m *merger) Err() error {
+	return m.err
+}
+
+func (m *merger) Close() error {
+	var firstErr error
+	for _, it := range m.inputs {
+		if err := it.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
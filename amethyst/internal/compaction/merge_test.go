@@ -0,0 +1,298 @@
+package compaction
+
+import (
+	"amethyst/internal/common"
+	"amethyst/internal/iterator"
+	"amethyst/internal/merge"
+	"amethyst/internal/metadata"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func put(key string, seq uint64) common.KVEntry {
+	return common.KVEntry{Key: key, Value: []byte(fmt.Sprintf("%s%d", key, seq)), Seq: seq}
+}
+
+func del(key string, seq uint64) common.KVEntry {
+	return common.KVEntry{Key: key, Tombstone: true, Seq: seq}
+}
+
+func operand(key string, seq uint64, delta int64) common.KVEntry {
+	return common.KVEntry{Key: key, Value: merge.EncodeInt64(delta), Seq: seq, Merge: true}
+}
+
+func inputs(segs ...[]common.KVEntry) []iterator.EntryIterator {
+	its := make([]iterator.EntryIterator, len(segs))
+	for i, seg := range segs {
+		its[i] = iterator.NewSliceIterator(seg)
+	}
+	return its
+}
+
+func show(entry common.KVEntry) string {
+	switch {
+	case entry.Tombstone:
+		return fmt.Sprintf("%s@%d deleted", entry.Key, entry.Seq)
+	case entry.Merge:
+		n, _ := merge.DecodeInt64(entry.Value)
+		return fmt.Sprintf("%s@%d+%d", entry.Key, entry.Seq, n)
+	}
+	return fmt.Sprintf("%s@%d=%s", entry.Key, entry.Seq, entry.Value)
+}
+
+// everything the merger writes, in order
+func drain(t *testing.T, m *merger) string {
+	t.Helper()
+	var out []string
+	for entry, ok := m.next(); ok; entry, ok = m.next() {
+		out = append(out, show(entry))
+	}
+	if err := m.Err(); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	return strings.Join(out, ", ")
+}
+
+func TestMerger_NewestVersionFirst(t *testing.T) {
+	segs := func() []iterator.EntryIterator {
+		return inputs(
+			[]common.KVEntry{put("a", 3), put("b", 1), put("c", 5)},
+			[]common.KVEntry{put("a", 2), put("b", 4), put("d", 1)},
+			[]common.KVEntry{put("a", 3)}, // the same version twice
+		)
+	}
+	for _, tc := range []struct {
+		name      string
+		snapshots []uint64
+		want      string
+	}{
+		{"no snapshots", nil, "a@3=a3, b@4=b4, c@5=c5, d@1=d1"},
+		// a snapshot at 2 reads a@2 and b@1
+		{"snapshot", []uint64{2}, "a@3=a3, a@2=a2, b@4=b4, b@1=b1, c@5=c5, d@1=d1"},
+		{"snapshot after everything", []uint64{9}, "a@3=a3, b@4=b4, c@5=c5, d@1=d1"},
+	} {
+		m := newMerger(segs(), tc.snapshots, nil, nil, nil, nil)
+		if got := drain(t, m); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestKeepVersion(t *testing.T) {
+	for _, tc := range []struct {
+		seq, newer uint64
+		snapshots  []uint64
+		want       bool
+	}{
+		{1, 5, nil, false},
+		{1, 5, []uint64{1}, true},
+		{1, 5, []uint64{4}, true},
+		{1, 5, []uint64{5}, false}, // reads the newer version
+		{3, 5, []uint64{2}, false}, // doesn't see either
+		{3, 5, []uint64{2, 9}, false},
+		{3, 5, []uint64{2, 4, 9}, true},
+	} {
+		if got := KeepVersion(tc.seq, tc.newer, tc.snapshots); got != tc.want {
+			t.Errorf("KeepVersion(%d, %d, %v) = %v", tc.seq, tc.newer, tc.snapshots, got)
+		}
+	}
+}
+
+func TestMerger_ExpiredValuesBecomeTombstones(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UnixNano()
+	future := time.Now().Add(time.Hour).UnixNano()
+	expired := put("a", 5)
+	expired.ExpiresAt = past
+	living := put("b", 4)
+	living.ExpiresAt = future
+
+	m := newMerger(inputs(
+		[]common.KVEntry{expired, living},
+		[]common.KVEntry{put("a", 2), put("b", 1)},
+	), nil, nil, nil, nil, nil)
+	// the tombstone keeps a@2 from showing through
+	if got := drain(t, m); got != "a@5 deleted, b@4=b4" {
+		t.Errorf("got %s", got)
+	}
+	if m.expired != 1 || m.bytesReclaimed != int64(len(expired.Value)) {
+		t.Errorf("expected one expired value of %d bytes, got %d, %d reclaimed", len(expired.Value), m.expired, m.bytesReclaimed)
+	}
+}
+
+func TestMerger_FoldOperands(t *testing.T) {
+	base := common.KVEntry{Key: "k", Value: merge.EncodeInt64(10), Seq: 2}
+	for _, tc := range []struct {
+		name      string
+		segs      [][]common.KVEntry
+		snapshots []uint64
+		bottom    bool
+		want      string
+	}{
+		{"onto the value", [][]common.KVEntry{
+			{operand("k", 5, 2), operand("k", 4, 3)}, {base},
+		}, nil, false, "k@5=15"},
+		// the snapshot at 4 reads 13, the one at 2 the value itself
+		{"snapshots between", [][]common.KVEntry{
+			{operand("k", 5, 2), operand("k", 4, 3)}, {base},
+		}, []uint64{2, 4}, false, "k@5=15, k@4=13, k@2=10"},
+		{"onto a tombstone", [][]common.KVEntry{
+			{operand("k", 5, 2)}, {del("k", 3), base},
+		}, nil, false, "k@5=2"},
+		// the value is in a segment outside the inputs
+		{"nothing under them", [][]common.KVEntry{
+			{operand("k", 5, 2), operand("k", 4, 3)},
+		}, nil, false, "k@5+2, k@4+3"},
+		{"nothing under them anywhere", [][]common.KVEntry{
+			{operand("k", 5, 2), operand("k", 4, 3)},
+		}, nil, true, "k@5=5"},
+	} {
+		var bottom func(string) bool
+		if tc.bottom {
+			bottom = func(string) bool { return true }
+		}
+		m := newMerger(inputs(tc.segs...), tc.snapshots, bottom, nil, merge.Int64Add(), nil)
+		var out []string
+		for entry, ok := m.next(); ok; entry, ok = m.next() {
+			if entry.Merge {
+				out = append(out, show(entry))
+				continue
+			}
+			n, _ := merge.DecodeInt64(entry.Value)
+			out = append(out, fmt.Sprintf("%s@%d=%d", entry.Key, entry.Seq, n))
+		}
+		if got := strings.Join(out, ", "); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	// an operand the operator can't apply stays as it is
+	bad := common.KVEntry{Key: "k", Value: []byte("x"), Seq: 5, Merge: true}
+	m := newMerger(inputs([]common.KVEntry{bad}, []common.KVEntry{base}), nil, nil, nil, merge.Int64Add(), nil)
+	first, _ := m.next()
+	second, _ := m.next()
+	if !first.Merge || string(first.Value) != "x" || second.Seq != 2 || m.operandsMerged != 0 {
+		t.Errorf("malformed operand: got %+v then %+v, %d merged", first, second, m.operandsMerged)
+	}
+	m.Close()
+}
+
+func TestMerger_ApplyFilter(t *testing.T) {
+	filter := CompactionFilterFunc(func(key string, value []byte) (FilterDecision, []byte) {
+		switch {
+		case strings.HasPrefix(key, "drop"):
+			return FilterDrop, nil
+		case strings.HasPrefix(key, "swap"):
+			return FilterReplace, []byte("new")
+		}
+		return FilterKeep, nil
+	})
+	segs := [][]common.KVEntry{
+		{put("drop1", 5), put("drop2", 2), put("keep", 6), put("swap", 7)},
+		{put("drop1", 1), del("drop3", 8), put("drop3", 3)},
+	}
+
+	m := newMerger(inputs(segs...), nil, nil, nil, nil, filter)
+	// a dropped value turns into a tombstone so drop1@1 stays hidden, and
+	// tombstones aren't shown to the filter
+	want := "drop1@5 deleted, drop2@2 deleted, drop3@8 deleted, keep@6=keep6, swap@7=new"
+	if got := drain(t, m); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if m.filterDropped != 2 || m.filterReplaced != 1 || m.filterKept != 1 {
+		t.Errorf("filter counts: %d dropped, %d replaced, %d kept", m.filterDropped, m.filterReplaced, m.filterKept)
+	}
+
+	// versions a snapshot reads are written as they are
+	m = newMerger(inputs(segs...), []uint64{5}, nil, nil, nil, filter)
+	want = "drop1@5=drop15, drop2@2=drop22, drop3@8 deleted, drop3@3=drop33, keep@6=keep6, swap@7=new"
+	if got := drain(t, m); got != want {
+		t.Errorf("with a snapshot at 5\ngot  %s\nwant %s", got, want)
+	}
+}
+
+func TestMerger_DropsTombstonesAtTheBottom(t *testing.T) {
+	segs := func() []iterator.EntryIterator {
+		return inputs(
+			[]common.KVEntry{del("a", 5), del("b", 3), del("keep", 4)},
+			[]common.KVEntry{put("a", 2), put("c", 1)},
+		)
+	}
+	// keep has older versions in a segment outside the inputs
+	bottom := func(key string) bool { return key != "keep" }
+
+	m := newMerger(segs(), nil, nil, nil, nil, nil)
+	if got := drain(t, m); got != "a@5 deleted, b@3 deleted, c@1=c1, keep@4 deleted" {
+		t.Errorf("without a bottom: %s", got)
+	}
+
+	m = newMerger(segs(), nil, bottom, nil, nil, nil)
+	if got := drain(t, m); got != "c@1=c1, keep@4 deleted" {
+		t.Errorf("at the bottom: %s", got)
+	}
+	// a's tombstone goes with the version it shadowed
+	if m.tombstonesDropped != 2 || m.bytesReclaimed != int64(len("a")+len("a2a")+len("b")) {
+		t.Errorf("%d tombstones dropped, %d bytes reclaimed", m.tombstonesDropped, m.bytesReclaimed)
+	}
+
+	// a snapshot reading a@2 needs the tombstone above it
+	m = newMerger(segs(), []uint64{2}, bottom, nil, nil, nil)
+	if got := drain(t, m); got != "a@5 deleted, a@2=a2, c@1=c1, keep@4 deleted" {
+		t.Errorf("with a snapshot at 2: %s", got)
+	}
+}
+
+func TestMerger_DropRangeDeleted(t *testing.T) {
+	ranges := []common.RangeTombstone{{Start: "b", End: "d", Seq: 6}}
+	segs := func() []iterator.EntryIterator {
+		return inputs(
+			[]common.KVEntry{put("a", 2), put("b", 7), put("c", 3), put("d", 1)},
+			[]common.KVEntry{put("b", 5)},
+		)
+	}
+	for _, tc := range []struct {
+		name      string
+		snapshots []uint64
+		want      string
+		deleted   int64
+	}{
+		{"no snapshots", nil, "a@2=a2, b@7=b7, d@1=d1", 1},
+		// the snapshot at 5 was taken before the range delete
+		{"snapshot under the range", []uint64{5}, "a@2=a2, b@7=b7, b@5=b5, c@3=c3, d@1=d1", 0},
+		// the one at 6 sees b and c deleted
+		{"snapshot at the range", []uint64{6}, "a@2=a2, b@7=b7, d@1=d1", 2},
+	} {
+		m := newMerger(segs(), tc.snapshots, nil, ranges, nil, nil)
+		if got := drain(t, m); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+		if m.rangeDeleted != tc.deleted {
+			t.Errorf("%s: %d range deleted, want %d", tc.name, m.rangeDeleted, tc.deleted)
+		}
+	}
+}
+
+func TestExecutor_BottomOf(t *testing.T) {
+	meta := metadata.NewTracker()
+	seg := func(id, minKey, maxKey string) *common.SegmentMeta {
+		s := &common.SegmentMeta{ID: id, MinKey: minKey, MaxKey: maxKey}
+		if err := meta.RegisterSegment(s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	in1, in2 := seg("in1", "a", "f"), seg("in2", "c", "h")
+	seg("under", "g", "k")
+	seg("elsewhere", "x", "z")
+
+	bottom := NewExecutor(meta, nil, nil).bottomOf(&Plan{Inputs: []*common.SegmentMeta{in1, in2}})
+	for key, want := range map[string]bool{"a": true, "f": true, "g": false, "h": false} {
+		if got := bottom(key); got != want {
+			t.Errorf("bottom(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
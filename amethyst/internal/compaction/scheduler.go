@@ -0,0 +1,313 @@
+package compaction
+
+import (
+	"amethyst/internal/common"
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scheduler defaults, see SchedulerOptions
+const (
+	DefaultCompactionWorkers  = 2
+	DefaultCompactionInterval = time.Second
+)
+
+// ErrInputsBusy is returned by Scheduler.Run for a plan sharing an input
+// with a compaction already running.
+var ErrInputsBusy = errors.New("compaction: inputs already being compacted")
+
+type SchedulerOptions struct {
+	Workers  int           //compactions running at once
+	Interval time.Duration //how often the director is asked without a Notify
+}
+
+func DefaultSchedulerOptions() SchedulerOptions {
+	return SchedulerOptions{
+		Workers:  DefaultCompactionWorkers,
+		Interval: DefaultCompactionInterval,
+	}
+}
+
+// Progress describes a compaction that is running.
+type Progress struct {
+	Inputs   []string // segment IDs
+	Strategy common.CompactionType
+	Reason   string
+	Started  time.Time
+}
+
+// SchedulerStats counts the compactions a scheduler ran.
+type SchedulerStats struct {
+	Completed    uint64
+	Failed       uint64
+	BytesWritten int64 // output segments of the completed ones
+
+	// tombstone garbage collection, range deletes, expiry, merge operands
+	// and the compaction filter, summed over the completed ones' Stats
+	TombstonesDropped      int64
+	BytesReclaimed         int64
+	RangeDeleted           int64
+	RangeTombstonesDropped int64
+	Expired                int64
+	OperandsMerged         int64
+	FilterKept             int64
+	FilterDropped          int64
+	FilterReplaced         int64
+}
+
+// Scheduler runs compactions in the background: every Notify, and every
+// Interval without one, it asks the director for plans and hands them to
+// at most Workers goroutines. Plans never share an input, the director is
+// told which segments running compactions hold.
+type Scheduler struct {
+	director Director
+	executor Executor
+	opts     SchedulerOptions
+
+	wake chan struct{}
+	wg   sync.WaitGroup // the loop and the running compactions
+
+	mu       sync.Mutex
+	idle     *sync.Cond // signalled whenever a compaction or a round ends
+	running  map[*Plan]time.Time
+	busy     map[string]bool // inputs of the running plans
+	paused   bool
+	stopped  bool
+	notified uint64 // Notify calls so far
+	handled  uint64 // Notify calls a finished round answered
+	stats    SchedulerStats
+	cancel   context.CancelFunc
+}
+
+func NewScheduler(director Director, executor Executor) *Scheduler {
+	return NewSchedulerWithOptions(director, executor, DefaultSchedulerOptions())
+}
+
+// NewSchedulerWithOptions is NewScheduler with explicit tuning; zero
+// fields take their default.
+func NewSchedulerWithOptions(director Director, executor Executor, opts SchedulerOptions) *Scheduler {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultCompactionWorkers
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultCompactionInterval
+	}
+	s := &Scheduler{
+		director: director,
+		executor: executor,
+		opts:     opts,
+		wake:     make(chan struct{}, 1),
+		running:  make(map[*Plan]time.Time),
+		busy:     make(map[string]bool),
+	}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+// Start runs the scheduler until ctx is done or Stop is called.
+func (s *Scheduler) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.loop(ctx)
+}
+
+// Stop stops scheduling and waits for the running compactions to finish;
+// they are never cut short, a half written output would be wasted work.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	s.wg.Wait()
+}
+
+// Notify asks for a scheduling round, e.g. after a flush added a segment.
+// It never blocks.
+func (s *Scheduler) Notify() {
+	s.mu.Lock()
+	s.notified++
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default: // a round is already pending
+	}
+}
+
+// Pause stops new compactions from starting and waits for the running ones
+// to finish. Run still works while paused.
+func (s *Scheduler) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = true
+	for len(s.running) > 0 {
+		s.idle.Wait()
+	}
+}
+
+// WaitIdle waits for the round asked for by the last Notify, and for every
+// compaction running then or started by it, to finish. It returns right
+// away once the scheduler is stopped.
+func (s *Scheduler) WaitIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target := s.notified
+	for !s.stopped && (s.handled < target || len(s.running) > 0) {
+		s.idle.Wait()
+	}
+}
+
+// Resume undoes Pause and runs a scheduling round.
+func (s *Scheduler) Resume() {
+	s.mu.Lock()
+	s.paused = false
+	s.mu.Unlock()
+	s.Notify()
+}
+
+// InProgress lists the compactions running right now, oldest first.
+func (s *Scheduler) InProgress() []Progress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Progress, 0, len(s.running))
+	for plan, started := range s.running {
+		ids := make([]string, len(plan.Inputs))
+		for i, seg := range plan.Inputs {
+			ids[i] = seg.ID
+		}
+		result = append(result, Progress{
+			Inputs:   ids,
+			Strategy: plan.OutputStrategy,
+			Reason:   plan.Reason,
+			Started:  started,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.Before(result[j].Started) })
+	return result
+}
+
+func (s *Scheduler) Stats() SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Run executes plan right away in the caller's goroutine, outside the
+// worker limit, unless a running compaction holds one of its inputs.
+func (s *Scheduler) Run(plan *Plan) ([]*common.SegmentMeta, error) {
+	if !s.claim(plan) {
+		return nil, ErrInputsBusy
+	}
+	return s.execute(plan)
+}
+
+func (s *Scheduler) loop(ctx context.Context) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.stopped = true
+			s.idle.Broadcast()
+			s.mu.Unlock()
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		round := s.notified
+		s.mu.Unlock()
+		s.schedule(ctx)
+		s.mu.Lock()
+		s.handled = round
+		s.idle.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// schedule starts plans until the workers are all busy or the director has
+// nothing more to offer
+func (s *Scheduler) schedule(ctx context.Context) {
+	for ctx.Err() == nil {
+		s.mu.Lock()
+		if s.paused || len(s.running) >= s.opts.Workers {
+			s.mu.Unlock()
+			return
+		}
+		busy := make(map[string]bool, len(s.busy))
+		for id := range s.busy {
+			busy[id] = true
+		}
+		s.mu.Unlock()
+
+		plan := s.director.MaybePlanExcluding(busy)
+		if plan == nil || !s.claim(plan) {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if _, err := s.execute(plan); err != nil {
+				log.Printf("compaction failure (%s): %v", plan.Reason, err)
+			}
+		}()
+	}
+}
+
+// marks the plan's inputs busy, false if one already is
+func (s *Scheduler) claim(plan *Plan) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range plan.Inputs {
+		if s.busy[seg.ID] {
+			return false
+		}
+	}
+	for _, seg := range plan.Inputs {
+		s.busy[seg.ID] = true
+	}
+	s.running[plan] = time.Now()
+	return true
+}
+
+func (s *Scheduler) execute(plan *Plan) ([]*common.SegmentMeta, error) {
+	outputs, err := s.executor.Execute(plan)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range plan.Inputs {
+		delete(s.busy, seg.ID)
+	}
+	delete(s.running, plan)
+	if err != nil {
+		s.stats.Failed++
+	} else {
+		s.stats.Completed++
+		for _, seg := range outputs {
+			s.stats.BytesWritten += seg.Length
+		}
+		s.stats.TombstonesDropped += plan.Stats.TombstonesDropped
+		s.stats.BytesReclaimed += plan.Stats.BytesReclaimed
+		s.stats.RangeDeleted += plan.Stats.RangeDeleted
+		s.stats.RangeTombstonesDropped += plan.Stats.RangeTombstonesDropped
+		s.stats.Expired += plan.Stats.Expired
+		s.stats.OperandsMerged += plan.Stats.OperandsMerged
+		s.stats.FilterKept += plan.Stats.FilterKept
+		s.stats.FilterDropped += plan.Stats.FilterDropped
+		s.stats.FilterReplaced += plan.Stats.FilterReplaced
+	}
+	s.idle.Broadcast()
+	return outputs, err
+}
@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"amethyst/internal/common"
+	"amethyst/internal/memtable"
+	"amethyst/internal/merge"
+	"errors"
+)
+
+var ErrEmptyBatch = errors.New("engine: empty write batch")
+
+type batchOpKind int
+
+const (
+	opPut batchOpKind = iota
+	opDelete
+	opDeleteRange
+	opMerge
+)
+
+type batchOp struct {
+	kind  batchOpKind
+	key   string // start key for opDeleteRange
+	end   string // exclusive end key for opDeleteRange
+	value []byte
+}
+
+// WriteBatch collects puts and deletes that Engine.Write applies atomically:
+// they share one WAL record and become visible in the memtable together.
+// Later operations on the same key win over earlier ones.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.ops = append(b.ops, batchOp{kind: opPut, key: key, value: value})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{kind: opDelete, key: key})
+}
+
+// Merge adds operand to the value of key, see Engine.Merge.
+func (b *WriteBatch) Merge(key string, operand []byte) {
+	b.ops = append(b.ops, batchOp{kind: opMerge, key: key, value: operand})
+}
+
+// DeleteRange removes every key with start <= key < end, an empty end
+// meaning no upper bound, as one range tombstone; see Engine.DeleteRange.
+func (b *WriteBatch) DeleteRange(start, end string) {
+	b.ops = append(b.ops, batchOp{kind: opDeleteRange, key: start, end: end})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies the batch all-or-nothing: one WAL record, one memtable insert.
+func (e *Engine) Write(b *WriteBatch) error {
+	if b == nil || len(b.ops) == 0 {
+		return ErrEmptyBatch
+	}
+	if e.mergeOp == nil {
+		for _, op := range b.ops {
+			if op.kind == opMerge {
+				return merge.ErrNoMergeOperator
+			}
+		}
+	}
+
+	count := 0
+	for _, op := range b.ops {
+		if !op.emptyRange() {
+			count++
+		}
+	}
+	if count == 0 {
+		// only range deletes over empty ranges
+		return nil
+	}
+
+	// operations get consecutive sequence numbers in batch order, so a later
+	// one wins over an earlier one, a range delete included
+	var entries []common.KVEntry
+	var ranges []common.RangeTombstone
+	return e.commitWrite(count, func(first uint64) error {
+		walEntries := make([]common.WALEntry, 0, count)
+		for _, op := range b.ops {
+			if op.emptyRange() {
+				continue
+			}
+			seq := first + uint64(len(walEntries))
+			switch op.kind {
+			case opPut:
+				entries = append(entries, common.KVEntry{Key: op.key, Value: op.value, Seq: seq})
+				walEntries = append(walEntries, common.WALEntry{Key: op.key, Value: op.value, Seq: seq})
+			case opDelete:
+				entries = append(entries, common.KVEntry{Key: op.key, Tombstone: true, Seq: seq})
+				walEntries = append(walEntries, common.WALEntry{Key: op.key, Tombstone: true, Seq: seq})
+			case opMerge:
+				entries = append(entries, common.KVEntry{Key: op.key, Value: op.value, Seq: seq, Merge: true})
+				walEntries = append(walEntries, common.WALEntry{Key: op.key, Value: op.value, Seq: seq, Merge: true})
+			case opDeleteRange:
+				ranges = append(ranges, common.RangeTombstone{Start: op.key, End: op.end, Seq: seq})
+				walEntries = append(walEntries, common.WALEntry{Key: op.key, RangeDelete: true, End: op.end, Seq: seq})
+			}
+		}
+		return e.wal.LogBatch(first, walEntries)
+	}, func(mem memtable.Memtable, first uint64) {
+		mem.ApplyWithRanges(entries, ranges)
+	})
+}
+
+// whether op is a range delete over an empty range, which is left out
+func (op batchOp) emptyRange() bool {
+	return op.kind == opDeleteRange && op.end != "" && op.key >= op.end
+}
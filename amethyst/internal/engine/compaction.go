@@ -0,0 +1,43 @@
+package engine
+
+import "amethyst/internal/compaction"
+
+// snapshotDirector hands out the director's plans with the live snapshots
+// filled in, so compaction keeps the versions they read.
+type snapshotDirector struct {
+	compaction.Director
+	snapshots *snapshotList
+}
+
+func (d *snapshotDirector) MaybePlan() *compaction.Plan {
+	return d.MaybePlanExcluding(nil)
+}
+
+func (d *snapshotDirector) MaybePlanExcluding(busy map[string]bool) *compaction.Plan {
+	plan := d.Director.MaybePlanExcluding(busy)
+	if plan != nil {
+		plan.Snapshots = d.snapshots.list()
+	}
+	return plan
+}
+
+// PauseCompactions stops background compactions from starting and waits for
+// the running ones to finish.
+func (e *Engine) PauseCompactions() {
+	e.scheduler.Pause()
+}
+
+// ResumeCompactions lets background compactions start again.
+func (e *Engine) ResumeCompactions() {
+	e.scheduler.Resume()
+}
+
+// CompactionsInProgress lists the compactions running right now.
+func (e *Engine) CompactionsInProgress() []compaction.Progress {
+	return e.scheduler.InProgress()
+}
+
+// CompactionStats counts the compactions run so far.
+func (e *Engine) CompactionStats() compaction.SchedulerStats {
+	return e.scheduler.Stats()
+}
@@ -1,68 +1,625 @@
 package engine
 
 import (
+	"amethyst/internal/adaptive"
+	"amethyst/internal/bloom"
+	"amethyst/internal/cache"
 	"amethyst/internal/common"
+	"amethyst/internal/compaction"
 	"amethyst/internal/memtable"
+	"amethyst/internal/merge"
+	"amethyst/internal/metadata"
+	"amethyst/internal/read"
 	"amethyst/internal/segmentfile"
+	"amethyst/internal/sstable/block"
+	"amethyst/internal/sstable/reader"
 	"amethyst/internal/sstable/writer"
 	"amethyst/internal/wal"
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// file names used inside an engine directory, the WAL files (wal-000001.log, ...)
+// sit next to them. Segments are written to files of their own in
+// SegmentDirName; DataFileName is the single file older versions appended
+// every segment to, read until none of its segments is live any more.
+const (
+	DataFileName     = "sstable.data"
+	ManifestFileName = "MANIFEST"
+	SegmentDirName   = "segments"
+)
+
+// bytes the memtable holds before a flush, keys, values and
+// memtable.EntryOverhead per version
+const DefaultMemtableSize = memtable.DefaultMaxBytes
+
+var (
+	ErrNotFound = errors.New("engine: key not found")
+	ErrClosed   = errors.New("engine: closed")
+	ErrBadTTL   = errors.New("engine: time to live must be positive")
+)
+
+// Options tunes an engine opened with OpenWithOptions.
+type Options struct {
+	MemtableSize      int64               //memtable byte budget, see DefaultMemtableSize
+	BlockSize         int                 //raw bytes per SSTable data block
+	Compression       block.Codec         //per data block, stored raw when it doesn't pay off
+	BloomBitsPerKey   int                 //Bloom filter size per segment key, 0 disables filters
+	BlockCacheSize    int64               //bytes of decoded blocks kept in memory
+	BlockCache        *cache.Cache        //shared cache to use instead of one of BlockCacheSize
+	PinIndexAndFilter bool                //keep index and filter blocks cached while their segment is live
+	TargetSegmentSize int64               //compaction output rolls over past this size
+	WAL               wal.Options         //sync policy and recovery mode
+	Controller        adaptive.Controller //decides when segments are rewritten
+	Compaction        compaction.SchedulerOptions
+	MergeOperator     merge.MergeOperator         //folds Merge operands into values, nil disables Merge
+	CompactionFilter  compaction.CompactionFilter //keeps, drops or rewrites values as compaction writes them
+
+	// full memtables waiting for the background flusher: writes are slowed
+	// down from SlowdownImmutableMemtables on and stop at MaxImmutableMemtables
+	MaxImmutableMemtables      int
+	SlowdownImmutableMemtables int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MemtableSize:      DefaultMemtableSize,
+		BlockSize:         block.DefaultBlockSize,
+		Compression:       block.NoCompression,
+		BloomBitsPerKey:   bloom.DefaultBitsPerKey,
+		BlockCacheSize:    cache.DefaultCapacity,
+		PinIndexAndFilter: true,
+		TargetSegmentSize: compaction.DefaultTargetSegmentSize,
+		WAL:               wal.DefaultOptions(),
+		Controller:        adaptive.NewFSMController(),
+		Compaction:        compaction.DefaultSchedulerOptions(),
+
+		MaxImmutableMemtables:      DefaultMaxImmutableMemtables,
+		SlowdownImmutableMemtables: DefaultSlowdownImmutableMemtables,
+	}
+}
+
+// Engine owns the whole pipeline: WAL -> memtable -> SSTable writer on the
+// write side, read.Handler over memtables and segments on the read side, and
+// the compaction scheduler working off the tracker. Full memtables are
+// flushed by a background goroutine, which wakes the scheduler.
 type Engine struct {
-	wal    wal.WAL
-	mem    memtable.Memtable
-	sfm    segmentfile.SegmentFileManager
-	writer writer.SSTableWriter
+	dir      string
+	wal      wal.WAL
+	mem      memtable.Memtable // takes the writes
+	imm      []*immutable      // full memtables waiting for a flush, oldest first
+	store    segmentfile.SegmentStore
+	sfm      segmentfile.SegmentFileManager // legacy data file, nil if there is none (left)
+	writer   writer.SSTableWriter
+	reader   reader.SSTableReader
+	meta     metadata.Tracker
+	manifest metadata.Manifest
+	handler  *read.Handler
+	cache    *cache.Cache
+	mergeOp  merge.MergeOperator
+
+	// runs the compactions the director plans, woken by the flusher
+	scheduler *compaction.Scheduler
+
+	// hands out sequence numbers and orders the memtable swap with the WAL
+	// rotation, so every sealed WAL file covers only queued memtables
+	mu      sync.Mutex
+	seq     uint64 // last sequence number handed out, guarded by mu
+	applied uint64 // last sequence number in the memtable, guarded by mu
+	closed  atomic.Bool
+
+	// writes past their Seq, oldest first; they log to the WAL concurrently
+	// and apply to the memtable in this order, see commitWrite. writeCond is
+	// tied to mu and signalled whenever one leaves the line or draining ends
+	writes    []*pendingWrite // guarded by mu
+	writeCond *sync.Cond
+	draining  int // callers waiting for the line to empty, guarded by mu
+
+	// mem and imm change under mu and memMu both, readers only take memMu
+	memMu       sync.RWMutex
+	newMemtable func() memtable.Memtable
+
+	// background flusher, see flushLoop. flushCond is tied to mu and
+	// signalled whenever the queue shrinks or the flusher goes idle
+	flushCond *sync.Cond
+	flushWake chan struct{}
+	stop      chan struct{}
+	bgDone    sync.WaitGroup
+	flushing  bool  // guarded by mu
+	bgErr     error // first background failure, guarded by mu
+
+	maxImm      int
+	slowdownImm int
+	slowdowns   atomic.Uint64
+	stops       atomic.Uint64
+	stallNanos  atomic.Int64
+
+	// guards sfm, which segment releases may remove from any goroutine
+	gcMu sync.Mutex
+
+	snapshots *snapshotList
+}
+
+// Open builds the pipeline inside dir and brings back whatever a previous
+// run left there: the manifest is replayed into the tracker, live segments
+// get their index back from their files and the WAL is replayed into the
+// memtable.
+func Open(dir string) (*Engine, error) {
+	return OpenWithOptions(dir, DefaultOptions())
+}
+
+// OpenWithOptions is Open with explicit tuning.
+func OpenWithOptions(dir string, opts Options) (*Engine, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if opts.Controller == nil {
+		opts.Controller = adaptive.NewFSMController()
+	}
+	if opts.MaxImmutableMemtables <= 0 {
+		opts.MaxImmutableMemtables = DefaultMaxImmutableMemtables
+	}
+	if opts.SlowdownImmutableMemtables <= 0 || opts.SlowdownImmutableMemtables > opts.MaxImmutableMemtables {
+		opts.SlowdownImmutableMemtables = opts.MaxImmutableMemtables
+	}
+
+	// a directory written before the manifest existed gets every segment adopted
+	manifestPath := filepath.Join(dir, ManifestFileName)
+	_, statErr := os.Stat(manifestPath)
+	adopt := os.IsNotExist(statErr)
+
+	manifest, err := metadata.NewManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := metadata.OpenTracker(manifest)
+	if err != nil {
+		manifest.Close()
+		return nil, fmt.Errorf("manifest replay failure: %w", err)
+	}
+
+	store, err := segmentfile.NewSegmentStore(filepath.Join(dir, SegmentDirName))
+	if err != nil {
+		manifest.Close()
+		return nil, err
+	}
+	var fileMgr segmentfile.SegmentFileManager
+	dataPath := filepath.Join(dir, DataFileName)
+	if _, err := os.Stat(dataPath); err == nil {
+		if fileMgr, err = segmentfile.NewSegmentFileManager(dataPath); err != nil {
+			manifest.Close()
+			return nil, err
+		}
+	}
+	closeFiles := func() {
+		manifest.Close()
+		store.Close()
+		if fileMgr != nil {
+			fileMgr.Close()
+		}
+	}
+	w, err := wal.NewDiskWALWithOptions(dir, opts.WAL)
+	if err != nil {
+		closeFiles()
+		return nil, err
+	}
+
+	blockCache := opts.BlockCache
+	if blockCache == nil {
+		blockCache = cache.New(opts.BlockCacheSize, cache.DefaultShards)
+	}
+
+	snapshots := &snapshotList{}
+	newMemtable := func() memtable.Memtable {
+		return memtable.NewSkiplistWithRetention(opts.MemtableSize, snapshots.keep)
+	}
+	mem := newMemtable()
+	sstReader := reader.NewReaderWithStore(store, fileMgr, blockCache, opts.PinIndexAndFilter)
+	sstWriter := writer.NewStoreWriter(store, writer.BlockOptions{
+		BlockSize:       opts.BlockSize,
+		Compression:     opts.Compression,
+		BloomBitsPerKey: opts.BloomBitsPerKey,
+	})
+
+	lastSeq, err := Recover(w, mem, fileMgr, store, sstReader, meta, adopt)
+	if err != nil {
+		w.Close()
+		closeFiles()
+		return nil, fmt.Errorf("recovery failure: %w", err)
+	}
+	lastSeq, legacyEntries, err := RecoverLegacyWAL(dir, mem, lastSeq)
+	if err != nil {
+		w.Close()
+		closeFiles()
+		return nil, fmt.Errorf("recovery failure: %w", err)
+	}
+
+	e := &Engine{
+		dir:      dir,
+		wal:      w,
+		mem:      mem,
+		store:    store,
+		sfm:      fileMgr,
+		writer:   sstWriter,
+		reader:   sstReader,
+		meta:     meta,
+		manifest: manifest,
+		cache:    blockCache,
+		mergeOp:  opts.MergeOperator,
+		seq:      lastSeq,
+		applied:  lastSeq,
+
+		newMemtable: newMemtable,
+		flushWake:   make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		maxImm:      opts.MaxImmutableMemtables,
+		slowdownImm: opts.SlowdownImmutableMemtables,
+
+		snapshots: snapshots,
+	}
+	e.handler = read.NewHandlerWithMergeOperator(e.memtables, meta, sstReader, opts.MergeOperator)
+	e.flushCond = sync.NewCond(&e.mu)
+	e.writeCond = sync.NewCond(&e.mu)
+	e.scheduler = compaction.NewSchedulerWithOptions(
+		&snapshotDirector{Director: compaction.NewDirector(meta, opts.Controller), snapshots: snapshots},
+		compaction.NewExecutorWithOptions(meta, sstReader, sstWriter, compaction.ExecutorOptions{
+			TargetSize:    opts.TargetSegmentSize,
+			MergeOperator: opts.MergeOperator,
+			Filter:        opts.CompactionFilter,
+		}),
+		opts.Compaction,
+	)
+	meta.SetReleaseHook(e.releaseSegment)
+	e.bgDone.Add(1)
+	go e.flushLoop()
+	e.scheduler.Start(context.Background())
+	// the legacy log's entries are only in the memtable, a segment has to
+	// hold them before the log can go
+	if legacyEntries > 0 {
+		if err := e.Flush(); err != nil {
+			e.Close()
+			return nil, fmt.Errorf("flushing legacy %s: %w", wal.LegacyFileName, err)
+		}
+	}
+	if err := wal.RemoveLegacy(dir); err != nil {
+		e.Close()
+		return nil, fmt.Errorf("removing legacy %s: %w", wal.LegacyFileName, err)
+	}
+	// the legacy file may hold nothing live any more
+	if err := e.maybeRemoveLegacyFile(); err != nil {
+		e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Get returns the newest value of key, or ErrNotFound if it was never
+// written or has been deleted.
+func (e *Engine) Get(key string) ([]byte, error) {
+	return e.get(key, math.MaxUint64)
+}
+
+// GetAt is Get as of snap; a nil snap reads the current state.
+func (e *Engine) GetAt(snap *Snapshot, key string) ([]byte, error) {
+	if snap == nil {
+		return e.Get(key)
+	}
+	if snap.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+	return e.get(key, snap.seq)
 }
 
-// initializes pipe
-func NewEngine(w wal.WAL, m memtable.Memtable, s segmentfile.SegmentFileManager, sw writer.SSTableWriter) *Engine {
-	return &Engine{
-		wal:    w,
-		mem:    m,
-		sfm:    s,
-		writer: sw,
+func (e *Engine) get(key string, seq uint64) ([]byte, error) {
+	if e.closed.Load() {
+		return nil, ErrClosed
 	}
+	val, ok, err := e.handler.GetAt(key, seq)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return val, nil
+}
+
+// FilterStats reports how often Bloom filters spared Get a segment read.
+func (e *Engine) FilterStats() read.FilterStats {
+	return e.handler.FilterStats()
+}
+
+// CacheStats reports block cache usage. A cache shared between engines
+// reports the same numbers for all of them.
+func (e *Engine) CacheStats() cache.Stats {
+	return e.cache.Stats()
 }
 
 // handles the WAL -> Memtable flow
 func (e *Engine) Put(key string, value []byte) error {
-	// Log to WAL for durability
-	if err := e.wal.LogPut(key, value); err != nil {
+	return e.write(common.KVEntry{Key: key, Value: value})
+}
+
+// PutWithTTL is Put for a value that reads as deleted once ttl has passed;
+// compaction drops it after that.
+func (e *Engine) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrBadTTL
+	}
+	return e.write(common.KVEntry{Key: key, Value: value, ExpiresAt: time.Now().Add(ttl).UnixNano()})
+}
+
+// Delete writes a tombstone for key.
+func (e *Engine) Delete(key string) error {
+	return e.write(common.KVEntry{Key: key, Tombstone: true})
+}
+
+// Merge adds operand to the value of key through Options.MergeOperator,
+// without reading it: the operand is stored as is and folded into the value
+// by reads, and for good by compaction. It fails with
+// merge.ErrNoMergeOperator if the engine has no operator.
+func (e *Engine) Merge(key string, operand []byte) error {
+	if e.mergeOp == nil {
+		return merge.ErrNoMergeOperator
+	}
+	return e.write(common.KVEntry{Key: key, Value: operand, Merge: true})
+}
+
+// DeleteRange deletes every key with start <= key < end, an empty end
+// meaning no upper bound. It costs one range tombstone however many keys
+// the range holds; keys written afterwards are not affected.
+func (e *Engine) DeleteRange(start, end string) error {
+	if end != "" && start >= end {
+		return nil
+	}
+	return e.commitWrite(1,
+		func(seq uint64) error { return e.wal.LogDeleteRange(seq, start, end) },
+		func(mem memtable.Memtable, seq uint64) { mem.DeleteRange(start, end, seq) })
+}
+
+func (e *Engine) write(entry common.KVEntry) error {
+	return e.commitWrite(1, func(seq uint64) error {
+		// Log to WAL for durability
+		switch {
+		case entry.Tombstone:
+			return e.wal.LogDelete(seq, entry.Key)
+		case entry.Merge:
+			return e.wal.LogMerge(seq, entry.Key, entry.Value)
+		case entry.ExpiresAt != 0:
+			return e.wal.LogPutExpiring(seq, entry.Key, entry.Value, entry.ExpiresAt)
+		default:
+			return e.wal.LogPut(seq, entry.Key, entry.Value)
+		}
+	}, func(mem memtable.Memtable, seq uint64) {
+		//Insert into Memtable
+		entry.Seq = seq
+		mem.Apply([]common.KVEntry{entry})
+	})
+}
+
+// pendingWrite is a write waiting in e.writes for its turn at the memtable
+type pendingWrite struct {
+	last uint64 // last Seq it took
+}
+
+// commitWrite takes count consecutive sequence numbers and a place in line
+// under e.mu, then logs them with logWAL without the lock, so concurrent
+// writers share the WAL's group commit. Once every earlier write is in the
+// memtable, apply inserts them, which keeps the memtable visible in Seq
+// order. Records of concurrent writes may reach the WAL out of Seq order,
+// which replay doesn't mind. A write whose WAL record failed leaves its Seqs
+// unused.
+func (e *Engine) commitWrite(count int, logWAL func(first uint64) error, apply func(mem memtable.Memtable, first uint64)) error {
+	e.slowDownWrite()
+	e.mu.Lock()
+	if err := e.makeRoomForWrite(); err != nil {
+		e.mu.Unlock()
+		return err
+	}
+	first := e.seq + 1
+	e.seq += uint64(count)
+	w := &pendingWrite{last: e.seq}
+	e.writes = append(e.writes, w)
+	e.mu.Unlock()
+
+	err := logWAL(first)
+
+	// the memtable can't be swapped while a write is in line, so it is the
+	// one the WAL record went with
+	e.mu.Lock()
+	for e.writes[0] != w {
+		e.writeCond.Wait()
+	}
+	mem := e.mem
+	e.mu.Unlock()
+	if err == nil {
+		apply(mem, first)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writes = e.writes[1:]
+	e.applied = w.last
+	e.writeCond.Broadcast()
+	if err != nil {
 		return fmt.Errorf("WAL log failure: %w", err)
 	}
 
-	//Insert into Memtable
-	e.mem.Put(key, value)
+	//Hand the Memtable to the flusher once it reached its limit
+	return e.maybeRotateMemtable()
+}
 
-	//Check if Memtable reached its limit
-	if e.mem.ShouldFlush() {
-		return e.ExecuteFlush()
+// executes plan now, in the caller's goroutine; its inputs are deleted once
+// the last version holding them is released
+func (e *Engine) compact(plan *compaction.Plan) error {
+	if _, err := e.scheduler.Run(plan); err != nil {
+		return fmt.Errorf("compaction failure: %w", err)
 	}
+	return nil
+}
+
+// releaseSegment is the tracker's release hook: seg is obsolete and no
+// version holds it any more, so no reader can reach it.
+func (e *Engine) releaseSegment(seg *common.SegmentMeta) {
+	// its blocks (pinned ones too) are dead weight
+	e.cache.DropSegment(seg.ID)
+	if seg.Shared {
+		if err := e.maybeRemoveLegacyFile(); err != nil {
+			log.Printf("gc: %v", err)
+		}
+		return
+	}
+	if err := e.store.Remove(seg.ID); err != nil {
+		log.Printf("gc: removing segment %s: %v", seg.ID, err)
+	}
+}
 
+// deletes the legacy data file once no version holds any of its segments
+func (e *Engine) maybeRemoveLegacyFile() error {
+	e.gcMu.Lock()
+	defer e.gcMu.Unlock()
+	if e.sfm == nil || e.closed.Load() {
+		return nil
+	}
+	for _, seg := range e.meta.Pinned() {
+		if seg.Shared {
+			return nil
+		}
+	}
+	if err := e.sfm.Remove(); err != nil {
+		return fmt.Errorf("removing legacy data file: %w", err)
+	}
+	e.sfm = nil
+	log.Printf("gc: legacy data file %s removed, no live segment left in it", DataFileName)
 	return nil
 }
 
-// handles the Memtable -> SSTable -> Truncate flow
-func (e *Engine) ExecuteFlush() error {
-	fmt.Println("Threshold reached: Starting Flush Plumbing...")
+// SpaceStats describes the disk space taken by segments.
+type SpaceStats struct {
+	DiskBytes     int64 // segment files and the legacy data file
+	LiveBytes     int64 // the live segments
+	ObsoleteBytes int64 // obsolete segments whose files wait for their last reader
+}
 
-	//Get sorted data from Memtable
-	data := e.mem.Flush()
+// SpaceStats reports segment disk usage. The legacy data file counts in
+// full, obsolete segments in it included, until it is removed.
+func (e *Engine) SpaceStats() (SpaceStats, error) {
+	if e.closed.Load() {
+		return SpaceStats{}, ErrClosed
+	}
+	v := e.meta.CurrentVersion()
+	defer v.Unref()
 
-	//Hand off to the SSTable Writer (The disk storage logic)
-	//TIERED default for new flushes?
-	_, err := e.writer.WriteSegment(data, common.TIERED)
+	var st SpaceStats
+	usage, err := e.store.DiskUsage()
 	if err != nil {
-		return fmt.Errorf("SSTable write failure: %w", err)
+		return st, err
+	}
+	st.DiskBytes = usage
+	e.gcMu.Lock()
+	legacy := e.sfm != nil
+	e.gcMu.Unlock()
+	if legacy {
+		info, err := os.Stat(filepath.Join(e.dir, DataFileName))
+		if err != nil && !os.IsNotExist(err) {
+			return st, err
+		}
+		if err == nil {
+			st.DiskBytes += info.Size()
+		}
 	}
+	live := make(map[string]bool, len(v.Segments()))
+	for _, seg := range v.Segments() {
+		live[seg.ID] = true
+		st.LiveBytes += seg.Length
+	}
+	for _, seg := range e.meta.Pinned() {
+		if !live[seg.ID] {
+			st.ObsoleteBytes += seg.Length
+		}
+	}
+	return st, nil
+}
 
-	// only truncate WAL after disk write is confirmed
-	if err := e.wal.Truncate(); err != nil {
-		return fmt.Errorf("WAL cleanup failure: %w", err)
+// SpaceAmplification is the disk taken by segments over the size of the data
+// they hold: the newest version of every live key, key and value bytes. It
+// scans everything, memtable included, so it is meant for reporting.
+func (e *Engine) SpaceAmplification() (float64, error) {
+	st, err := e.SpaceStats()
+	if err != nil {
+		return 0, err
 	}
+	it, err := e.NewIterator("", "")
+	if err != nil {
+		return 0, err
+	}
+	var live int64
+	for ok := it.SeekToFirst(); ok; ok = it.Next() {
+		live += int64(len(it.Key()) + len(it.Value()))
+	}
+	if err := it.Err(); err != nil {
+		it.Close()
+		return 0, err
+	}
+	if err := it.Close(); err != nil {
+		return 0, err
+	}
+	if live == 0 {
+		return 0, nil
+	}
+	return float64(st.DiskBytes) / float64(live), nil
+}
 
-	fmt.Println("Flush complete: Memtable cleared and WAL truncated.")
-	return nil
+// Close stops the background flusher and compactions, syncs and closes the
+// WAL, records segment stats in the manifest and releases the segment files.
+// Memtables are not flushed, the WAL still holds them. Obsolete segments an open
+// iterator still holds are deleted by the next Open.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	if e.closed.Swap(true) {
+		e.mu.Unlock()
+		return nil
+	}
+	// wake up writers and Flush callers waiting on the flusher, and let the
+	// writes already in line finish before the WAL closes under them
+	e.flushCond.Broadcast()
+	e.writeCond.Broadcast()
+	for len(e.writes) > 0 {
+		e.writeCond.Wait()
+	}
+	e.mu.Unlock()
+
+	// a flush in progress finishes its segment, the queue is left to the WAL,
+	// and running compactions finish theirs
+	close(e.stop)
+	e.bgDone.Wait()
+	e.scheduler.Stop()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.gcMu.Lock()
+	defer e.gcMu.Unlock()
+
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	keep(e.wal.Close())
+	keep(e.meta.SnapshotStats())
+	keep(e.manifest.Close())
+	keep(e.store.Close())
+	if e.sfm != nil {
+		keep(e.sfm.Close())
+	}
+	return firstErr
 }
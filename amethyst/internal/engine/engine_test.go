@@ -0,0 +1,1657 @@
+package engine
+
+import (
+	"amethyst/internal/adaptive"
+	"amethyst/internal/common"
+	"amethyst/internal/compaction"
+	"amethyst/internal/iterator"
+	"amethyst/internal/merge"
+	"amethyst/internal/metadata"
+	"amethyst/internal/segmentfile"
+	"amethyst/internal/sparseindex"
+	"amethyst/internal/sstable/block"
+	"amethyst/internal/sstable/reader"
+	"amethyst/internal/sstable/writer"
+	"amethyst/internal/wal"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOpen_RecoversSegmentsAndWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	// 1. First run: two keys flushed into a segment, then a put and a delete
+	// that only live in the WAL
+	e, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if err := e.Put("a", []byte("1")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if err := e.Put("b", []byte("2")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := e.Put("c", []byte("3")); err != nil {
+		t.Fatalf("put after flush failed: %v", err)
+	}
+	if err := e.Delete("a"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if _, err := e.Get("b"); err != ErrClosed {
+		t.Errorf("expected ErrClosed after close, got %v", err)
+	}
+
+	// 2. Second run sees all of it
+	e, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+
+	segs := e.meta.GetAllSegments()
+	if len(segs) != 1 || segs[0].MinKey != "a" || segs[0].MaxKey != "b" {
+		t.Fatalf("expected one segment [a,b], got %+v", segs)
+	}
+	if val, err := e.Get("b"); err != nil || string(val) != "2" {
+		t.Errorf("segment value lost: %q %v", val, err)
+	}
+	if val, err := e.Get("c"); err != nil || string(val) != "3" {
+		t.Errorf("WAL put not replayed: %q %v", val, err)
+	}
+	// the replayed tombstone must hide the older value in the segment
+	if _, err := e.Get("a"); err != ErrNotFound {
+		t.Errorf("WAL tombstone not replayed: %v", err)
+	}
+}
+
+func TestOpen_ManifestKeepsObsoleteSegmentsDead(t *testing.T) {
+	dir := t.TempDir()
+
+	// two runs, one flushed segment each
+	var ids []string
+	for _, key := range []string{"a", "b"} {
+		e, err := Open(dir)
+		if err != nil {
+			t.Fatalf("open failed: %v", err)
+		}
+		if err := e.Put(key, []byte(key)); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+		if err := e.Flush(); err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+		ids = append(ids, e.meta.GetAllSegments()[len(ids)].ID)
+		e.Close()
+	}
+
+	e, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if err := e.meta.MarkObsolete(ids[0]); err != nil {
+		t.Fatalf("mark obsolete failed: %v", err)
+	}
+	e.Close()
+
+	// the first segment is still in sstable.data but must not come back
+	e, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	segs := e.meta.GetAllSegments()
+	if len(segs) != 1 || segs[0].ID != ids[1] {
+		t.Fatalf("expected only segment %s live, got %+v", ids[1], segs)
+	}
+	if segs[0].SparseIndex == nil {
+		t.Errorf("sparse index not reattached")
+	}
+}
+
+// testdata/baseline holds files the first version of the engine wrote, with
+// its own writer and WAL: sstable.data has two flat segments, k00..k19 and
+// then k03, k05 deleted, k07 and k25
+func copyBaseline(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join("testdata", "baseline", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// the values the baseline segments hold, newest first
+func baselineValues() map[string]string {
+	want := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		want[fmt.Sprintf("k%02d", i)] = fmt.Sprintf("v%02d-1", i)
+	}
+	want["k03"], want["k07"], want["k25"] = "v03-2", "v07-2", "v25-2"
+	delete(want, "k05")
+	return want
+}
+
+// setup writes, failing the test on an error
+func mustPut(t *testing.T, e *Engine, key string, value []byte) {
+	t.Helper()
+	if err := e.Put(key, value); err != nil {
+		t.Fatalf("put %s failed: %v", key, err)
+	}
+}
+
+func mustDelete(t *testing.T, e *Engine, key string) {
+	t.Helper()
+	if err := e.Delete(key); err != nil {
+		t.Fatalf("delete %s failed: %v", key, err)
+	}
+}
+
+func mustFlush(t *testing.T, e *Engine) {
+	t.Helper()
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+}
+
+func TestOpen_ReadsBaselineDataFile(t *testing.T) {
+	dir := t.TempDir()
+	copyBaseline(t, dir, DataFileName)
+	want := baselineValues()
+
+	check := func(e *Engine, stage string) {
+		t.Helper()
+		for key, val := range want {
+			if got, err := e.Get(key); err != nil || string(got) != val {
+				t.Errorf("%s: %s = %q %v, want %q", stage, key, got, err, val)
+			}
+		}
+		if _, err := e.Get("k05"); err != ErrNotFound {
+			t.Errorf("%s: deleted k05 came back: %v", stage, err)
+		}
+		it, err := e.NewIterator("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for ok := it.SeekToFirst(); ok; ok = it.Next() {
+			if it.Key() == "k05" || want[it.Key()] != string(it.Value()) {
+				t.Errorf("%s: iterator at %s = %q", stage, it.Key(), it.Value())
+			}
+			n++
+		}
+		if err := it.Close(); err != nil || n != len(want) {
+			t.Errorf("%s: iterator saw %d of %d keys: %v", stage, n, len(want), err)
+		}
+	}
+
+	e, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	segs := e.meta.GetAllSegments()
+	if len(segs) != 2 || !segs[0].Unsequenced || segs[0].MaxSeq != 1 || segs[1].MaxSeq != 2 {
+		t.Fatalf("expected the two baseline segments at seq 1 and 2, got %+v", segs)
+	}
+	check(e, "open")
+
+	// new writes are newer than anything in the old file
+	if err := e.Put("k03", []byte("v03-3")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	want["k03"] = "v03-3"
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	e, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	check(e, "reopen")
+	if err := e.compact(&compaction.Plan{Inputs: e.meta.GetAllSegments(), OutputStrategy: common.LEVELED}); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	check(e, "compacted")
+	if _, err := os.Stat(filepath.Join(dir, DataFileName)); !os.IsNotExist(err) {
+		t.Errorf("legacy data file outlived its segments: %v", err)
+	}
+}
+
+func TestOpen_ReplaysBaselineWAL(t *testing.T) {
+	dir := t.TempDir()
+	copyBaseline(t, dir, DataFileName, wal.LegacyFileName)
+	// the log was written after both segments
+	want := baselineValues()
+	want["k07"], want["k30"] = "v07-wal", "v30-wal"
+	delete(want, "k09")
+
+	check := func(e *Engine, stage string) {
+		t.Helper()
+		for key, val := range want {
+			if got, err := e.Get(key); err != nil || string(got) != val {
+				t.Errorf("%s: %s = %q %v, want %q", stage, key, got, err, val)
+			}
+		}
+		for _, key := range []string{"k05", "k09"} {
+			if _, err := e.Get(key); err != ErrNotFound {
+				t.Errorf("%s: deleted %s came back: %v", stage, key, err)
+			}
+		}
+	}
+
+	e, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	check(e, "open")
+	if _, err := os.Stat(filepath.Join(dir, wal.LegacyFileName)); !os.IsNotExist(err) {
+		t.Errorf("legacy log still there after open: %v", err)
+	}
+	if segs := e.meta.GetAllSegments(); len(segs) != 3 || segs[2].Unsequenced || segs[2].MaxSeq != 5 {
+		t.Errorf("expected the log flushed after the baseline segments, got %+v", segs)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	e, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	check(e, "reopen")
+}
+
+func TestOpen_LeavesUnreadableDataFileAlone(t *testing.T) {
+	baseline, err := os.ReadFile(filepath.Join("testdata", "baseline", DataFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"not a segment":             []byte("some file that isn't ours at all"),
+		"torn first segment":        baseline[:40],
+		"bad header after segments": append(append([]byte{}, baseline...), 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'),
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, DataFileName)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if e, err := Open(dir); err == nil {
+			e.Close()
+			t.Errorf("%s: open succeeded", name)
+		}
+		if left, err := os.ReadFile(path); err != nil || !bytes.Equal(left, data) {
+			t.Errorf("%s: data file changed to %d bytes: %v", name, len(left), err)
+		}
+	}
+
+	// a segment torn off the end is still cut, the ones before it kept
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, DataFileName), baseline[:len(baseline)-10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open with a torn tail failed: %v", err)
+	}
+	defer e.Close()
+	if val, err := e.Get("k03"); err != nil || string(val) != "v03-1" {
+		t.Errorf("first segment lost with the torn one: %q %v", val, err)
+	}
+	if _, err := e.Get("k25"); err != ErrNotFound {
+		t.Errorf("torn segment read: %v", err)
+	}
+}
+
+func TestCompaction_NewestSeqWins(t *testing.T) {
+	fileMgr, err := segmentfile.NewSegmentFileManager(filepath.Join(t.TempDir(), DataFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sstWriter := writer.NewWriter(fileMgr, sparseindex.NewBuilder(sparseindex.DefaultStride))
+	sstReader := reader.NewReader(fileMgr)
+	meta := metadata.NewTracker()
+
+	older, _ := sstWriter.WriteSegment([]common.KVEntry{
+		{Key: "a", Value: []byte("old"), Seq: 1},
+		{Key: "b", Value: []byte("kept"), Seq: 2},
+	}, common.TIERED)
+	newer, _ := sstWriter.WriteSegment([]common.KVEntry{
+		{Key: "a", Value: []byte("new"), Seq: 3},
+		{Key: "b", Tombstone: true, Seq: 4},
+	}, common.TIERED)
+	// left out of the plan, b's tombstone still has to hide its value
+	oldest, _ := sstWriter.WriteSegment([]common.KVEntry{
+		{Key: "b", Value: []byte("buried"), Seq: 0},
+	}, common.TIERED)
+	meta.RegisterSegment(oldest)
+	meta.RegisterSegment(older)
+	meta.RegisterSegment(newer)
+
+	// newest input first, the opposite of what map order used to assume
+	plan := &compaction.Plan{Inputs: []*common.SegmentMeta{newer, older}, OutputStrategy: common.LEVELED}
+	outs, err := compaction.NewExecutor(meta, sstReader, sstWriter).Execute(plan)
+	if err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if len(outs) != 1 {
+		t.Fatalf("expected one output segment, got %d", len(outs))
+	}
+	out := outs[0]
+
+	if entry, ok, _ := sstReader.Get(out, "a"); !ok || string(entry.Value) != "new" || entry.Seq != 3 {
+		t.Errorf("expected a=new@3, got %+v", entry)
+	}
+	if entry, ok, _ := sstReader.Get(out, "b"); !ok || !entry.Tombstone {
+		t.Errorf("expected b tombstone, got %+v", entry)
+	}
+	if out.MaxSeq != 4 {
+		t.Errorf("expected MaxSeq 4, got %d", out.MaxSeq)
+	}
+}
+
+func TestCompaction_SplitsOutputIntoDisjointRun(t *testing.T) {
+	fileMgr, err := segmentfile.NewSegmentFileManager(filepath.Join(t.TempDir(), DataFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sstWriter := writer.NewWriter(fileMgr, sparseindex.NewBuilder(4))
+	sstReader := reader.NewReader(fileMgr)
+	meta := metadata.NewTracker()
+
+	// three segments with interleaved keys, each spanning several blocks
+	var inputs []*common.SegmentMeta
+	for s := 0; s < 3; s++ {
+		var data []common.KVEntry
+		for i := s; i < 90; i += 3 {
+			data = append(data, common.KVEntry{Key: fmt.Sprintf("k%03d", i), Value: []byte("v"), Seq: uint64(i + 1)})
+		}
+		seg, err := sstWriter.WriteSegment(data, common.TIERED)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta.RegisterSegment(seg)
+		inputs = append(inputs, seg)
+	}
+
+	// ~30 bytes per record, so roughly 20 records per output
+	executor := compaction.NewExecutorWithTargetSize(meta, sstReader, sstWriter, 600)
+	outs, err := executor.Execute(&compaction.Plan{Inputs: inputs})
+	if err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if len(outs) < 3 {
+		t.Fatalf("expected the output split into several segments, got %d", len(outs))
+	}
+	if live := meta.GetAllSegments(); len(live) != len(outs) {
+		t.Errorf("expected only the %d outputs live, got %d", len(outs), len(live))
+	}
+
+	var data []common.KVEntry
+	for i, out := range outs {
+		if i > 0 && out.MinKey <= outs[i-1].MaxKey {
+			t.Errorf("outputs %d and %d overlap", i-1, i)
+		}
+		if out.OverlapCount != 0 {
+			t.Errorf("output %s registered with %d overlaps", out.ID, out.OverlapCount)
+		}
+		part, err := sstReader.Scan(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, part...)
+	}
+	if len(data) != 90 {
+		t.Fatalf("expected 90 merged entries, got %d", len(data))
+	}
+	for i, entry := range data {
+		if want := fmt.Sprintf("k%03d", i); entry.Key != want {
+			t.Fatalf("entry %d: got %s, want %s", i, entry.Key, want)
+		}
+	}
+}
+
+func TestWriteBatch_AppliedAndRecoveredTogether(t *testing.T) {
+	dir := t.TempDir()
+
+	e, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	mustPut(t, e, "user/1", []byte("old"))
+	mustPut(t, e, "idx/a", []byte("1"))
+	mustFlush(t, e)
+	mustPut(t, e, "idx/b", []byte("1"))
+
+	b := NewWriteBatch()
+	b.Put("user/1", []byte("new"))
+	b.DeleteRange("idx/", "idx0")
+	b.Put("idx/c", []byte("1"))
+	if err := e.Write(b); err != nil {
+		t.Fatalf("batch write failed: %v", err)
+	}
+	e.Close()
+
+	// the batch survives a restart as a whole
+	e, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	if val, err := e.Get("user/1"); err != nil || string(val) != "new" {
+		t.Errorf("expected user/1=new, got %q %v", val, err)
+	}
+	for _, key := range []string{"idx/a", "idx/b"} {
+		if _, err := e.Get(key); err != ErrNotFound {
+			t.Errorf("%s should be deleted by the range", key)
+		}
+	}
+	if _, err := e.Get("idx/c"); err != nil {
+		t.Errorf("idx/c written after the range delete is missing")
+	}
+}
+
+func TestIterator_MergesMemtableAndSegments(t *testing.T) {
+	// tiny blocks so segment scans cross block boundaries
+	opts := DefaultOptions()
+	opts.BlockSize = 64
+	e, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer e.Close()
+
+	// spread versions over two segments and the memtable
+	mustPut(t, e, "user/1", []byte("old"))
+	mustPut(t, e, "user/2", []byte("2"))
+	mustPut(t, e, "user/4", []byte("4"))
+	mustPut(t, e, "zzz", []byte("out of prefix"))
+	mustFlush(t, e)
+	mustPut(t, e, "user/1", []byte("new"))
+	mustDelete(t, e, "user/2")
+	mustFlush(t, e)
+	mustPut(t, e, "user/3", []byte("3"))
+	mustDelete(t, e, "user/4")
+	mustPut(t, e, "user/5", []byte("5"))
+
+	it, err := e.NewIterator(iterator.Prefix("user/"))
+	if err != nil {
+		t.Fatalf("iterator failed: %v", err)
+	}
+	defer it.Close()
+
+	var got []string
+	for ok := it.SeekToFirst(); ok; ok = it.Next() {
+		got = append(got, it.Key()+"="+string(it.Value()))
+	}
+	want := []string{"user/1=new", "user/3=3", "user/5=5"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("forward scan: got %v, want %v", got, want)
+	}
+
+	got = got[:0]
+	for ok := it.SeekToLast(); ok; ok = it.Prev() {
+		got = append(got, it.Key())
+	}
+	if strings.Join(got, ",") != "user/5,user/3,user/1" {
+		t.Errorf("backward scan: got %v", got)
+	}
+
+	// change direction in the middle
+	if !it.Seek("user/2") || it.Key() != "user/3" {
+		t.Fatalf("seek to deleted key should land on user/3")
+	}
+	if !it.Prev() || it.Key() != "user/1" {
+		t.Errorf("prev after seek: got %q", it.Key())
+	}
+	if !it.Next() || it.Key() != "user/3" {
+		t.Errorf("next after prev: got %q", it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("iterator error: %v", err)
+	}
+}
+
+func TestBloomFilter_SkipsSegmentsAndSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	// first segment without a filter, second with one, both spanning a..z
+	opts := DefaultOptions()
+	opts.BloomBitsPerKey = 0
+	e, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	mustPut(t, e, "a", []byte("1"))
+	mustPut(t, e, "z", []byte("1"))
+	mustFlush(t, e)
+	e.Close()
+
+	e, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		mustPut(t, e, fmt.Sprintf("k%03d", i), []byte("v"))
+	}
+	mustPut(t, e, "a", []byte("2"))
+	mustPut(t, e, "z", []byte("2"))
+	mustFlush(t, e)
+	e.Close()
+
+	e, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+
+	for _, seg := range e.meta.GetAllSegments() {
+		if f, err := e.reader.Filter(seg); seg.MaxSeq > 2 && (f == nil || err != nil) {
+			t.Errorf("filter of segment %s not found: %v", seg.ID, err)
+		}
+	}
+	if val, err := e.Get("k042"); err != nil || string(val) != "v" {
+		t.Errorf("expected k042=v, got %q %v", val, err)
+	}
+	if val, err := e.Get("a"); err != nil || string(val) != "2" {
+		t.Errorf("expected a=2, got %q %v", val, err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := e.Get(fmt.Sprintf("missing%03d", i)); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	stats := e.FilterStats()
+	if stats.Misses < 90 {
+		t.Errorf("expected most missing keys filtered out, got %+v", stats)
+	}
+}
+
+func TestBlockFormat_CoexistsWithFlatSegments(t *testing.T) {
+	dir := t.TempDir()
+	// a data file left by a version that wrote flat segments only
+	copyBaseline(t, dir, DataFileName)
+
+	opts := DefaultOptions()
+	opts.BlockSize = 64
+	opts.Compression = block.Flate
+	e, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if err := e.Put("k03", []byte("new")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := e.Put(fmt.Sprintf("k%03d", i), []byte(strings.Repeat("v", 20))); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	e.Close()
+
+	e, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	var blockSeg *common.SegmentMeta
+	for _, seg := range e.meta.GetAllSegments() {
+		if _, ok := seg.SparseIndex.(*block.Footer); ok {
+			blockSeg = seg
+		}
+	}
+	if blockSeg == nil || len(e.meta.GetAllSegments()) != 3 {
+		t.Fatalf("expected the two baseline segments and a block one, got %+v", e.meta.GetAllSegments())
+	}
+	for key, want := range map[string]string{
+		"k03": "new", "k07": "v07-2", "k12": "v12-1", "k25": "v25-2", "k042": strings.Repeat("v", 20),
+	} {
+		if val, err := e.Get(key); err != nil || string(val) != want {
+			t.Errorf("%s: got %q %v, want %q", key, val, err, want)
+		}
+	}
+	if _, err := e.Get("k05"); err != ErrNotFound {
+		t.Errorf("k05 deleted in the baseline segments: %v", err)
+	}
+	e.Close()
+
+	// flip a byte inside the first data block: the checksum must catch it
+	f, err := os.OpenFile(filepath.Join(dir, SegmentDirName, blockSeg.ID+segmentfile.SegmentFileExt), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first data block starts right after the preamble
+	pos := int64(block.PreambleSize + 1)
+	b := make([]byte, 1)
+	f.ReadAt(b, pos)
+	f.WriteAt([]byte{b[0] ^ 0xff}, pos)
+	f.Close()
+
+	e, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	if _, err := e.Get("k000"); !errors.Is(err, block.ErrChecksum) {
+		t.Errorf("expected a checksum error, got %v", err)
+	}
+}
+
+func TestGet_ValueIsTheCallers(t *testing.T) {
+	e, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer e.Close()
+	// one data block, served from the block cache after the first read
+	for _, key := range []string{"a", "b", "c"} {
+		if err := e.Put(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	for round := 0; round < 2; round++ {
+		for _, key := range []string{"a", "b", "c"} {
+			val, err := e.Get(key)
+			if err != nil || string(val) != "value-"+key {
+				t.Fatalf("round %d: %s = %q %v", round, key, val, err)
+			}
+			for i := range val {
+				val[i] = 'X'
+			}
+		}
+	}
+	if st := e.CacheStats(); st.Hits == 0 {
+		t.Errorf("reads never hit the cache: %+v", st)
+	}
+}
+
+func TestGC_RemovesObsoleteSegmentFilesOnceUnreferenced(t *testing.T) {
+	dir := t.TempDir()
+	// a legacy data file with two flat segments, soon to be compacted away
+	copyBaseline(t, dir, DataFileName)
+	want := baselineValues()
+
+	e, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer e.Close()
+	for _, key := range []string{"k03", "a"} {
+		if err := e.Put(key, []byte("new")); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+		want[key] = "new"
+		if err := e.Flush(); err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+	}
+	inputs := e.meta.GetAllSegments()
+	if len(inputs) != 4 {
+		t.Fatalf("expected 4 segments, got %d", len(inputs))
+	}
+	segFile := func(id string) string {
+		return filepath.Join(dir, SegmentDirName, id+segmentfile.SegmentFileExt)
+	}
+
+	// an open iterator keeps the inputs' files alive through the compaction
+	it, err := e.NewIterator("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.compact(&compaction.Plan{Inputs: inputs, OutputStrategy: common.LEVELED}); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	st, err := e.SpaceStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ObsoleteBytes == 0 {
+		t.Errorf("expected the inputs to wait for the iterator, got %+v", st)
+	}
+	n := 0
+	for ok := it.SeekToFirst(); ok; ok = it.Next() {
+		if want[it.Key()] != string(it.Value()) {
+			t.Errorf("iterator over compacted segments at %s = %q", it.Key(), it.Value())
+		}
+		n++
+	}
+	if err := it.Err(); err != nil || n != len(want) {
+		t.Errorf("iterator over compacted segments saw %d of %d keys: %v", n, len(want), err)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("iterator close failed: %v", err)
+	}
+
+	// now nothing holds them: the files and the legacy data file are gone
+	for _, seg := range inputs {
+		if seg.Shared {
+			continue
+		}
+		if _, err := os.Stat(segFile(seg.ID)); !os.IsNotExist(err) {
+			t.Errorf("segment file %s not removed: %v", seg.ID, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, DataFileName)); !os.IsNotExist(err) {
+		t.Errorf("legacy data file not removed: %v", err)
+	}
+	out := e.meta.GetAllSegments()
+	if len(out) != 1 {
+		t.Fatalf("expected one output segment, got %d", len(out))
+	}
+	st, err = e.SpaceStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ObsoleteBytes != 0 || st.DiskBytes != out[0].Length || st.LiveBytes != out[0].Length {
+		t.Errorf("expected only the output on disk, got %+v, output %d bytes", st, out[0].Length)
+	}
+	for _, key := range []string{"a", "k03", "k07"} {
+		if val, err := e.Get(key); err != nil || string(val) != want[key] {
+			t.Errorf("%s after GC: %q %v", key, val, err)
+		}
+	}
+}
+
+func TestVersion_PinsSegmentsUntilLastUnref(t *testing.T) {
+	e, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer e.Close()
+	for _, key := range []string{"a", "b"} {
+		mustPut(t, e, key, []byte(key))
+		if err := e.Flush(); err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+	}
+
+	// two readers on the same version
+	v := e.meta.CurrentVersion()
+	v.Ref()
+	inputs := v.Segments()
+	if err := e.compact(&compaction.Plan{Inputs: inputs, OutputStrategy: common.LEVELED}); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+
+	cur := e.meta.CurrentVersion()
+	if len(cur.Segments()) != 1 || len(v.Segments()) != 2 {
+		t.Fatalf("expected the new version to hold 1 segment and the old one 2, got %d and %d",
+			len(cur.Segments()), len(v.Segments()))
+	}
+	cur.Unref()
+
+	for i := 0; i < 2; i++ {
+		for _, seg := range inputs {
+			if entry, ok, err := e.reader.Get(seg, seg.MinKey); err != nil || !ok {
+				t.Fatalf("pinned segment %s unreadable: %+v %v %v", seg.ID, entry, ok, err)
+			}
+		}
+		v.Unref()
+	}
+
+	if n := len(e.meta.Pinned()); n != 1 {
+		t.Errorf("expected only the output pinned, got %d segments", n)
+	}
+	for _, seg := range inputs {
+		if _, err := e.store.Size(seg.ID); !errors.Is(err, segmentfile.ErrSegmentNotFound) {
+			t.Errorf("segment %s not removed after the last unref: %v", seg.ID, err)
+		}
+	}
+}
+
+func TestSnapshot_SeesPointInTimeThroughFlushAndCompaction(t *testing.T) {
+	e, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer e.Close()
+	mustPut(t, e, "a", []byte("a1"))
+	mustPut(t, e, "b", []byte("b1"))
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	mustPut(t, e, "c", []byte("c1"))
+
+	snap, err := e.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// overwrite on disk and in the memtable, delete, add
+	mustPut(t, e, "a", []byte("a2"))
+	mustPut(t, e, "c", []byte("c2"))
+	mustPut(t, e, "c", []byte("c3"))
+	mustDelete(t, e, "b")
+	mustPut(t, e, "d", []byte("d1"))
+
+	check := func(stage string) {
+		t.Helper()
+		for key, want := range map[string]string{"a": "a1", "b": "b1", "c": "c1", "d": ""} {
+			val, err := e.GetAt(snap, key)
+			if want == "" {
+				if err != ErrNotFound {
+					t.Errorf("%s: %s should not exist at the snapshot, got %q %v", stage, key, val, err)
+				}
+				continue
+			}
+			if err != nil || string(val) != want {
+				t.Errorf("%s: %s at the snapshot: got %q %v, want %q", stage, key, val, err, want)
+			}
+		}
+		it, err := e.NewIteratorAt(snap, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fwd, bwd []string
+		for ok := it.SeekToFirst(); ok; ok = it.Next() {
+			fwd = append(fwd, it.Key()+"="+string(it.Value()))
+		}
+		for ok := it.SeekToLast(); ok; ok = it.Prev() {
+			bwd = append([]string{it.Key() + "=" + string(it.Value())}, bwd...)
+		}
+		it.Close()
+		if got := strings.Join(fwd, ","); got != "a=a1,b=b1,c=c1" || got != strings.Join(bwd, ",") {
+			t.Errorf("%s: snapshot iterator saw %v forward, %v backward", stage, fwd, bwd)
+		}
+		if val, err := e.Get("c"); err != nil || string(val) != "c3" {
+			t.Errorf("%s: latest c: %q %v", stage, val, err)
+		}
+	}
+
+	check("memtable")
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	check("flushed")
+
+	plan := &compaction.Plan{Inputs: e.meta.GetAllSegments(), OutputStrategy: common.LEVELED, Snapshots: e.snapshots.list()}
+	if err := e.compact(plan); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	check("compacted")
+
+	// once released, compaction drops the versions only it read
+	snap.Release()
+	if _, err := e.GetAt(snap, "a"); err != ErrSnapshotReleased {
+		t.Errorf("expected ErrSnapshotReleased, got %v", err)
+	}
+	plan = &compaction.Plan{Inputs: e.meta.GetAllSegments(), OutputStrategy: common.LEVELED, Snapshots: e.snapshots.list()}
+	if err := e.compact(plan); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	entries, err := e.reader.Scan(e.meta.GetAllSegments()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b's tombstone has nothing left to hide at the bottom
+	if len(entries) != 3 {
+		t.Errorf("expected one version of each live key left, got %+v", entries)
+	}
+}
+
+func TestFlush_BackgroundQueueStaysReadableAndStallsWrites(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MemtableSize = 1024 // a handful of entries
+	opts.MaxImmutableMemtables = 1
+	opts.SlowdownImmutableMemtables = 1
+	e, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	// queue a memtable by hand; the flusher can't take it while we hold mu
+	mustPut(t, e, "held", []byte("v"))
+	e.mu.Lock()
+	if err := e.rotateMemtable(); err != nil {
+		e.mu.Unlock()
+		t.Fatal(err)
+	}
+	if val, err := e.Get("held"); err != nil || string(val) != "v" {
+		t.Errorf("key in the immutable memtable: got %q %v", val, err)
+	}
+	it, err := e.NewIterator("", "")
+	if err != nil {
+		e.mu.Unlock()
+		t.Fatal(err)
+	}
+	if !it.SeekToFirst() || it.Key() != "held" {
+		t.Errorf("iterator missed the immutable memtable")
+	}
+	it.Close()
+	e.mu.Unlock()
+
+	for i := 0; i < 400; i++ {
+		if err := e.Put(fmt.Sprintf("key-%04d", i), []byte("value")); err != nil {
+			t.Fatalf("put %d failed: %v", i, err)
+		}
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	e.mu.Lock()
+	queued := len(e.imm)
+	e.mu.Unlock()
+	if queued != 0 || e.mem.Len() != 0 {
+		t.Errorf("flush left %d queued memtables, %d entries", queued, e.mem.Len())
+	}
+	if st := e.StallStats(); st.Slowdowns+st.Stops == 0 {
+		t.Errorf("a one memtable queue never held a write back: %+v", st)
+	}
+	mustPut(t, e, "tail", []byte("t"))
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	for _, key := range []string{"held", "key-0000", "key-0399", "tail"} {
+		if _, err := e.Get(key); err != nil {
+			t.Errorf("%s lost across reopen: %v", key, err)
+		}
+	}
+}
+
+// counts the puts inside the WAL at the same time
+type overlapWAL struct {
+	wal.WAL
+	inFlight, maxInFlight atomic.Int32
+}
+
+func (w *overlapWAL) LogPut(seq uint64, key string, value []byte) error {
+	n := w.inFlight.Add(1)
+	defer w.inFlight.Add(-1)
+	for {
+		m := w.maxInFlight.Load()
+		if n <= m || w.maxInFlight.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(100 * time.Microsecond) // stands in for a slow fsync
+	return w.WAL.LogPut(seq, key, value)
+}
+
+func TestWrite_ConcurrentPutsShareFsync(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(dir) // SyncAlways
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	counted := &overlapWAL{WAL: e.wal}
+	e.mu.Lock()
+	e.wal = counted
+	e.mu.Unlock()
+
+	// writers only take their Seq under e.mu, so while one waits for its
+	// fsync the others queue up behind it in the WAL's group commit. They
+	// need Ps of their own to get there while the leader's thread is in fsync
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	const writers, perWriter = 16, 50
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if err := e.Put(fmt.Sprintf("k-%02d-%03d", g, i), []byte(fmt.Sprint(i))); err != nil {
+					t.Errorf("put failed: %v", err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// holding e.mu across the WAL write lets one put in at a time
+	puts := uint64(writers * perWriter)
+	if n := counted.maxInFlight.Load(); n < 2 {
+		t.Errorf("at most %d put in the WAL at once, writers never shared a commit", n)
+	}
+
+	// every put reached the memtable, in Seq order
+	e.mu.Lock()
+	applied, seq, inLine := e.applied, e.seq, len(e.writes)
+	e.mu.Unlock()
+	if applied != seq || inLine != 0 {
+		t.Errorf("writes left in line: applied %d of %d", applied, seq)
+	}
+	snap, err := e.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Seq() != puts {
+		t.Errorf("snapshot at %d, want %d", snap.Seq(), puts)
+	}
+	snap.Release()
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	for g := 0; g < writers; g++ {
+		key := fmt.Sprintf("k-%02d-%03d", g, perWriter-1)
+		if val, err := e.Get(key); err != nil || string(val) != fmt.Sprint(perWriter-1) {
+			t.Errorf("%s lost across reopen: %q %v", key, val, err)
+		}
+	}
+}
+
+func TestMemtable_FlushTriggerCountsBytes(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemtableSize = 64 * 1024
+	e, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer e.Close()
+
+	// readers go through the skiplist without a lock while writes land
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			e.Get("small-0050")
+			if it, err := e.NewIterator("small-", "small-~"); err == nil {
+				for ok := it.SeekToFirst(); ok; ok = it.Next() {
+				}
+				it.Close()
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := e.Put(fmt.Sprintf("small-%04d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+	if n := e.mem.Len(); n != 100 {
+		t.Fatalf("100 small entries should fit the budget, memtable holds %d", n)
+	}
+
+	big := bytes.Repeat([]byte("x"), 20*1024)
+	for i := 0; i < 2; i++ {
+		if err := e.Put(fmt.Sprintf("big-%d", i), big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := e.mem.Len(); n != 102 {
+		t.Fatalf("memtable rotated early, holds %d entries", n)
+	}
+	// the third large value takes it past 64KB
+	if err := e.Put("big-2", big); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.mem.Len(); n != 0 {
+		t.Errorf("memtable over its byte budget still takes writes, holds %d entries", n)
+	}
+	for _, key := range []string{"small-0000", "small-0099", "big-2"} {
+		if _, err := e.Get(key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
+
+func TestScheduler_CompactsAfterFlushAndPauses(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Controller = &MockController{NextStrategy: common.LEVELED}
+	e, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer e.Close()
+
+	e.PauseCompactions()
+	// overlapping key ranges, so a leveled plan takes all three
+	for i := 0; i < 3; i++ {
+		mustPut(t, e, "a", []byte{byte(i)})
+		mustPut(t, e, fmt.Sprintf("k%d", i), []byte("v"))
+		mustPut(t, e, "z", []byte{byte(i)})
+		if err := e.Flush(); err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+	}
+	e.scheduler.Notify()
+	e.scheduler.WaitIdle()
+	if n := len(e.meta.GetAllSegments()); n != 3 || e.CompactionStats().Completed != 0 {
+		t.Fatalf("paused scheduler compacted: %d segments, %+v", n, e.CompactionStats())
+	}
+
+	e.ResumeCompactions()
+	e.scheduler.WaitIdle()
+	if st := e.CompactionStats(); st.Completed == 0 || st.BytesWritten == 0 {
+		t.Fatalf("no compaction after resume: %+v", st)
+	}
+	e.PauseCompactions()
+	if n := len(e.meta.GetAllSegments()); n != 1 {
+		t.Errorf("expected the flushes merged into one segment, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := e.Get(fmt.Sprintf("k%d", i)); err != nil {
+			t.Errorf("k%d lost in compaction: %v", i, err)
+		}
+	}
+}
+
+// blockingExecutor holds every compaction until release is closed
+type blockingExecutor struct {
+	started chan *compaction.Plan
+	release chan struct{}
+}
+
+func (b *blockingExecutor) Execute(plan *compaction.Plan) ([]*common.SegmentMeta, error) {
+	b.started <- plan
+	<-b.release
+	return nil, nil
+}
+
+type planOnce struct {
+	plans []*compaction.Plan
+}
+
+func (d *planOnce) MaybePlan() *compaction.Plan { return d.MaybePlanExcluding(nil) }
+func (d *planOnce) MaybePlanExcluding(busy map[string]bool) *compaction.Plan {
+	for i, plan := range d.plans {
+		if !busy[plan.Inputs[0].ID] {
+			d.plans = append(d.plans[:i], d.plans[i+1:]...)
+			return plan
+		}
+	}
+	return nil
+}
+
+func TestScheduler_BoundsWorkersAndReportsProgress(t *testing.T) {
+	seg := func(id string) *common.SegmentMeta { return &common.SegmentMeta{ID: id} }
+	plans := []*compaction.Plan{
+		{Inputs: []*common.SegmentMeta{seg("a")}, Reason: "first"},
+		{Inputs: []*common.SegmentMeta{seg("b")}, Reason: "second"},
+		{Inputs: []*common.SegmentMeta{seg("c")}, Reason: "third"},
+	}
+	exec := &blockingExecutor{started: make(chan *compaction.Plan, 3), release: make(chan struct{})}
+	s := compaction.NewSchedulerWithOptions(&planOnce{plans: plans}, exec,
+		compaction.SchedulerOptions{Workers: 2, Interval: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	s.Notify()
+	<-exec.started
+	<-exec.started
+	select {
+	case plan := <-exec.started:
+		t.Fatalf("third compaction %q started past the worker limit", plan.Reason)
+	case <-time.After(50 * time.Millisecond):
+	}
+	running := s.InProgress()
+	if len(running) != 2 {
+		t.Fatalf("expected 2 compactions in progress, got %+v", running)
+	}
+	if _, err := s.Run(&compaction.Plan{Inputs: []*common.SegmentMeta{seg(running[0].Inputs[0])}}); err != compaction.ErrInputsBusy {
+		t.Errorf("a plan sharing a running compaction's input ran: %v", err)
+	}
+
+	// shutting down lets the running ones finish and starts nothing new
+	cancel()
+	close(exec.release)
+	s.Stop()
+	if st := s.Stats(); st.Completed != 2 || len(s.InProgress()) != 0 {
+		t.Errorf("after stop: %+v, %d in progress", st, len(s.InProgress()))
+	}
+}
+
+func TestCompaction_DropsTombstonesAtTheBottom(t *testing.T) {
+	e, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer e.Close()
+	e.PauseCompactions()
+
+	// a..c are only in the two compacted segments, z also in one left out
+	mustPut(t, e, "a", []byte("alpha"))
+	mustPut(t, e, "b", []byte("bravo"))
+	mustPut(t, e, "z", []byte("zulu"))
+	mustFlush(t, e)
+	mustPut(t, e, "y", []byte("yankee"))
+	mustPut(t, e, "z", []byte("zulu2"))
+	mustFlush(t, e)
+	mustDelete(t, e, "a")
+	mustDelete(t, e, "b")
+	mustPut(t, e, "c", []byte("charlie"))
+	mustDelete(t, e, "z")
+	mustFlush(t, e)
+
+	var inputs []*common.SegmentMeta
+	for _, seg := range e.meta.GetAllSegments() {
+		if seg.MinKey != "y" {
+			inputs = append(inputs, seg)
+		}
+	}
+	plan := &compaction.Plan{Inputs: inputs, OutputStrategy: common.LEVELED}
+	if err := e.compact(plan); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if plan.Stats.TombstonesDropped != 2 {
+		t.Errorf("expected the tombstones of a and b dropped, got %+v", plan.Stats)
+	}
+	// both tombstones and the values they hid
+	if want := int64(len("a") + len("alpha") + len("b") + len("bravo") + 2); plan.Stats.BytesReclaimed != want {
+		t.Errorf("expected %d bytes reclaimed, got %+v", want, plan.Stats)
+	}
+	for key, want := range map[string]string{"a": "", "b": "", "c": "charlie", "y": "yankee", "z": ""} {
+		val, err := e.Get(key)
+		if want == "" {
+			if err != ErrNotFound {
+				t.Errorf("%s should stay deleted, got %q %v", key, val, err)
+			}
+			continue
+		}
+		if err != nil || string(val) != want {
+			t.Errorf("%s: got %q %v, want %q", key, val, err, want)
+		}
+	}
+}
+
+func TestDeleteRange_HidesKeysEverywhereAndCompactsThemAway(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	e.PauseCompactions()
+
+	for i := 0; i < 10; i++ {
+		mustPut(t, e, fmt.Sprintf("tenant1/%d", i), []byte("v"))
+	}
+	mustPut(t, e, "tenant2/0", []byte("keep"))
+	mustFlush(t, e)
+	mustPut(t, e, "tenant1/3", []byte("newer but still deleted"))
+	snap, _ := e.NewSnapshot()
+	lower, upper := iterator.Prefix("tenant1/")
+	if err := e.DeleteRange(lower, upper); err != nil {
+		t.Fatalf("delete range failed: %v", err)
+	}
+	mustPut(t, e, "tenant1/5", []byte("after"))
+
+	check := func(stage string) {
+		t.Helper()
+		for _, key := range []string{"tenant1/0", "tenant1/3", "tenant1/9"} {
+			if val, err := e.Get(key); err != ErrNotFound {
+				t.Errorf("%s: %s should be range deleted, got %q %v", stage, key, val, err)
+			}
+		}
+		if val, err := e.Get("tenant1/5"); err != nil || string(val) != "after" {
+			t.Errorf("%s: tenant1/5 written after the range delete: got %q %v", stage, val, err)
+		}
+		it, err := e.NewIterator("", "")
+		if err != nil {
+			t.Fatalf("%s: iterator failed: %v", stage, err)
+		}
+		defer it.Close()
+		var keys []string
+		for ok := it.SeekToFirst(); ok; ok = it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if got := strings.Join(keys, ","); got != "tenant1/5,tenant2/0" {
+			t.Errorf("%s: iterator saw %s", stage, got)
+		}
+	}
+	check("memtable")
+	if val, err := e.GetAt(snap, "tenant1/3"); err != nil || string(val) != "newer but still deleted" {
+		t.Errorf("snapshot taken before the range delete: got %q %v", val, err)
+	}
+	snap.Release()
+
+	// replayed from the WAL, then read from the segment's block
+	e.Close()
+	if e, err = Open(dir); err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	check("replayed")
+	mustFlush(t, e)
+	e.Close()
+	if e, err = Open(dir); err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	e.PauseCompactions()
+	check("flushed")
+	// only the segment holding the range tombstone is searched for one
+	var flagged int
+	for _, seg := range e.meta.GetAllSegments() {
+		if seg.RangeDeletes {
+			flagged++
+		}
+	}
+	if flagged != 1 || len(e.meta.GetAllSegments()) != 2 {
+		t.Errorf("expected 1 of 2 segments flagged with range deletes, got %d of %d", flagged, len(e.meta.GetAllSegments()))
+	}
+
+	// nothing else holds the range, the deleted versions and the range
+	// tombstone itself go
+	plan := &compaction.Plan{Inputs: e.meta.GetAllSegments(), OutputStrategy: common.LEVELED}
+	if err := e.compact(plan); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if plan.Stats.RangeDeleted != 9 || plan.Stats.RangeTombstonesDropped != 1 {
+		t.Errorf("expected 9 versions range deleted and the tombstone dropped, got %+v", plan.Stats)
+	}
+	check("compacted")
+}
+
+func TestTTL_ExpiredValuesVanishAndTriggerRewrite(t *testing.T) {
+	dir := t.TempDir()
+	e, err := Open(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	e.PauseCompactions()
+
+	mustPut(t, e, "session/0", []byte("older, without a ttl"))
+	mustFlush(t, e)
+	for i := 0; i < 64; i++ {
+		if err := e.PutWithTTL(fmt.Sprintf("session/%d", i), bytes.Repeat([]byte("s"), 128), 200*time.Millisecond); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		mustPut(t, e, fmt.Sprintf("user/%d", i), []byte("forever"))
+	}
+	if err := e.PutWithTTL("session/x", []byte("v"), 0); err != ErrBadTTL {
+		t.Errorf("expected ErrBadTTL for a zero ttl, got %v", err)
+	}
+	if _, err := e.Get("session/1"); err != nil {
+		t.Errorf("session/1 should live until its ttl is up: %v", err)
+	}
+
+	// the expiry survives the WAL and the segment
+	e.Close()
+	if e, err = Open(dir); err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	mustFlush(t, e)
+	e.Close()
+	if e, err = Open(dir); err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	e.PauseCompactions()
+	time.Sleep(250 * time.Millisecond)
+
+	check := func(stage string) {
+		t.Helper()
+		// an expired value deletes the older one under it too
+		for _, key := range []string{"session/0", "session/5"} {
+			if val, err := e.Get(key); err != ErrNotFound {
+				t.Errorf("%s: %s should have expired, got %q %v", stage, key, val, err)
+			}
+		}
+		it, err := e.NewIterator("", "")
+		if err != nil {
+			t.Fatalf("%s: iterator failed: %v", stage, err)
+		}
+		defer it.Close()
+		n := 0
+		for ok := it.SeekToFirst(); ok; ok = it.Next() {
+			if !strings.HasPrefix(it.Key(), "user/") {
+				t.Errorf("%s: iterator saw expired %s", stage, it.Key())
+			}
+			n++
+		}
+		if n != 8 {
+			t.Errorf("%s: expected the 8 user keys, iterator saw %d", stage, n)
+		}
+	}
+	check("expired")
+
+	var expiring *common.SegmentMeta
+	for _, seg := range e.meta.GetAllSegments() {
+		if seg.Expiries != nil {
+			expiring = seg
+		}
+	}
+	if expiring == nil {
+		t.Fatalf("no segment records expiry times")
+	}
+	aged := *expiring
+	aged.LastRewriteAt -= adaptive.MinRewriteInterval
+	if ok, _, reason := adaptive.NewFSMController().ShouldRewrite(&aged); !ok || !strings.Contains(reason, "expired") {
+		t.Errorf("a mostly expired segment should be rewritten, got %v %q", ok, reason)
+	}
+
+	plan := &compaction.Plan{Inputs: e.meta.GetAllSegments(), OutputStrategy: common.TIERED}
+	if err := e.compact(plan); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if plan.Stats.Expired != 64 {
+		t.Errorf("expected the 64 expired values dropped, got %+v", plan.Stats)
+	}
+	check("compacted")
+}
+
+func TestMerge_FoldsOperandsOnReadAndInCompaction(t *testing.T) {
+	plain, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if err := plain.Merge("k", merge.EncodeInt64(1)); err != merge.ErrNoMergeOperator {
+		t.Errorf("expected ErrNoMergeOperator without an operator, got %v", err)
+	}
+	plain.Close()
+
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MergeOperator = merge.Int64Add()
+	e, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	e.PauseCompactions()
+
+	add := func(key string, n int64) {
+		t.Helper()
+		if err := e.Merge(key, merge.EncodeInt64(n)); err != nil {
+			t.Fatalf("merge %s failed: %v", key, err)
+		}
+	}
+	mustPut(t, e, "count/a", merge.EncodeInt64(10))
+	mustFlush(t, e)
+	add("count/a", 1)
+	snap, err := e.NewSnapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	defer snap.Release()
+	add("count/a", 2)
+	mustFlush(t, e)
+	add("count/a", 5)
+	add("count/b", 2) // no value under it
+	add("count/b", 3)
+	mustPut(t, e, "count/c", merge.EncodeInt64(100))
+	mustDelete(t, e, "count/c")
+	add("count/c", 7) // starts over from nothing
+
+	check := func(stage string, s *Snapshot, key string, want int64) {
+		t.Helper()
+		val, err := e.GetAt(s, key)
+		if err != nil {
+			t.Fatalf("%s: get %s failed: %v", stage, key, err)
+		}
+		if got, err := merge.DecodeInt64(val); err != nil || got != want {
+			t.Errorf("%s: %s = %d (%v), want %d", stage, key, got, err, want)
+		}
+	}
+	checkAll := func(stage string) {
+		t.Helper()
+		check(stage, nil, "count/a", 18)
+		check(stage, nil, "count/b", 5)
+		check(stage, nil, "count/c", 7)
+		check(stage, snap, "count/a", 11)
+
+		it, err := e.NewIterator(iterator.Prefix("count/"))
+		if err != nil {
+			t.Fatalf("%s: iterator failed: %v", stage, err)
+		}
+		defer it.Close()
+		want := map[string]int64{"count/a": 18, "count/b": 5, "count/c": 7}
+		n := 0
+		for ok := it.SeekToFirst(); ok; ok = it.Next() {
+			if got, _ := merge.DecodeInt64(it.Value()); got != want[it.Key()] {
+				t.Errorf("%s: iterator %s = %d, want %d", stage, it.Key(), got, want[it.Key()])
+			}
+			n++
+		}
+		if err := it.Err(); err != nil || n != len(want) {
+			t.Errorf("%s: iterator saw %d keys (%v), want %d", stage, n, err, len(want))
+		}
+	}
+	checkAll("memtable and segments")
+
+	mustFlush(t, e)
+	plan := &compaction.Plan{Inputs: e.meta.GetAllSegments(), OutputStrategy: common.LEVELED, Snapshots: e.snapshots.list()}
+	if err := e.compact(plan); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if plan.Stats.OperandsMerged != 6 {
+		t.Errorf("expected every operand folded, got %+v", plan.Stats)
+	}
+	for _, seg := range e.meta.GetAllSegments() {
+		entries, err := e.reader.Scan(seg)
+		if err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.Merge {
+				t.Errorf("operand %s@%d survived compaction", entry.Key, entry.Seq)
+			}
+		}
+	}
+	checkAll("compacted")
+
+	// operands in the WAL come back as operands
+	add("count/a", 100)
+	e.Close()
+	if e, err = OpenWithOptions(dir, opts); err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer e.Close()
+	check("reopened", nil, "count/a", 118)
+}
+
+func TestCompactionFilter_KeepsDropsAndReplacesValues(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CompactionFilter = compaction.CompactionFilterFunc(func(key string, value []byte) (compaction.FilterDecision, []byte) {
+		switch {
+		case strings.HasPrefix(key, "tmp/"):
+			return compaction.FilterDrop, nil
+		case strings.HasPrefix(key, "name/"):
+			return compaction.FilterReplace, bytes.ToUpper(value)
+		}
+		return compaction.FilterKeep, nil
+	})
+	e, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer e.Close()
+	e.PauseCompactions()
+
+	mustPut(t, e, "tmp/a", []byte("old"))
+	mustFlush(t, e)
+	mustPut(t, e, "tmp/a", []byte("scratch"))
+	mustPut(t, e, "tmp/b", []byte("scratch"))
+	mustPut(t, e, "name/1", []byte("ada"))
+	mustPut(t, e, "keep/1", []byte("v"))
+	mustDelete(t, e, "keep/2")
+	snap, err := e.NewSnapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	defer snap.Release()
+	mustPut(t, e, "tmp/c", []byte("scratch")) // after the snapshot, which doesn't see it
+	mustFlush(t, e)
+
+	plan := &compaction.Plan{Inputs: e.meta.GetAllSegments(), OutputStrategy: common.LEVELED, Snapshots: e.snapshots.list()}
+	if err := e.compact(plan); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	// the snapshot reads tmp/a, tmp/b, name/1 and keep/1, they are written
+	// as they are; only tmp/c is the filter's
+	if plan.Stats.FilterDropped != 1 || plan.Stats.FilterKept != 0 || plan.Stats.FilterReplaced != 0 {
+		t.Errorf("expected only tmp/c filtered while the snapshot lives, got %+v", plan.Stats)
+	}
+	if _, err := e.Get("tmp/c"); err != ErrNotFound {
+		t.Errorf("tmp/c should have been dropped, got %v", err)
+	}
+	if val, err := e.GetAt(snap, "tmp/a"); err != nil || string(val) != "scratch" {
+		t.Errorf("snapshot should still read tmp/a, got %q %v", val, err)
+	}
+
+	snap.Release()
+	plan = &compaction.Plan{Inputs: e.meta.GetAllSegments(), OutputStrategy: common.LEVELED}
+	if err := e.compact(plan); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if plan.Stats.FilterDropped != 2 || plan.Stats.FilterReplaced != 1 || plan.Stats.FilterKept != 1 {
+		t.Errorf("expected 2 dropped, 1 replaced, 1 kept, got %+v", plan.Stats)
+	}
+	// a dropped key stays gone, the older tmp/a doesn't come back
+	for _, key := range []string{"tmp/a", "tmp/b", "tmp/c", "keep/2"} {
+		if val, err := e.Get(key); err != ErrNotFound {
+			t.Errorf("%s should be gone, got %q %v", key, val, err)
+		}
+	}
+	if val, err := e.Get("name/1"); err != nil || string(val) != "ADA" {
+		t.Errorf("name/1 should have been replaced, got %q %v", val, err)
+	}
+	if val, err := e.Get("keep/1"); err != nil || string(val) != "v" {
+		t.Errorf("keep/1 should be kept, got %q %v", val, err)
+	}
+	if stats := e.scheduler.Stats(); stats.FilterDropped != 3 || stats.FilterReplaced != 1 {
+		t.Errorf("scheduler should sum the filter decisions, got %+v", stats)
+	}
+}
@@ -1,9 +1,12 @@
 package engine
 
 import (
+	"amethyst/internal/bloom"
 	"amethyst/internal/common"
 	"amethyst/internal/compaction"
+	"amethyst/internal/iterator"
 	"amethyst/internal/metadata"
+	"amethyst/internal/sstable/writer"
 	"testing"
 )
 
@@ -23,11 +26,49 @@ func (m *MockWriter) WriteSegment(data []common.KVEntry, strat common.Compaction
 	return &common.SegmentMeta{ID: "new-seg", Strategy: strat}, nil
 }
 
+func (m *MockWriter) NewSegment(strat common.CompactionType) writer.SegmentBuilder {
+	return &MockBuilder{w: m, strat: strat}
+}
+
+type MockBuilder struct {
+	w       *MockWriter
+	strat   common.CompactionType
+	entries []common.KVEntry
+}
+
+func (b *MockBuilder) Add(entry common.KVEntry) error {
+	b.entries = append(b.entries, entry)
+	return nil
+}
+func (b *MockBuilder) AddRangeTombstone(rt common.RangeTombstone) error {
+	return nil
+}
+func (b *MockBuilder) Count() int  { return len(b.entries) }
+func (b *MockBuilder) Size() int64 { return 0 }
+func (b *MockBuilder) Finish() (*common.SegmentMeta, error) {
+	return b.w.WriteSegment(b.entries, b.strat)
+}
+
 type MockReader struct{}
 
-func (m *MockReader) Get(meta *common.SegmentMeta, key string) ([]byte, bool) { return nil, false }
-func (m *MockReader) Scan(meta *common.SegmentMeta) (map[string][]byte, error) {
-	return map[string][]byte{"key": []byte("val")}, nil
+func (m *MockReader) Get(meta *common.SegmentMeta, key string) (common.KVEntry, bool, error) {
+	return common.KVEntry{}, false, nil
+}
+func (m *MockReader) GetAt(meta *common.SegmentMeta, key string, seq uint64) (common.KVEntry, bool, error) {
+	return common.KVEntry{}, false, nil
+}
+func (m *MockReader) Scan(meta *common.SegmentMeta) ([]common.KVEntry, error) {
+	return []common.KVEntry{{Key: "key", Value: []byte("val")}}, nil
+}
+func (m *MockReader) Filter(meta *common.SegmentMeta) (*bloom.Filter, error) {
+	return nil, nil
+}
+func (m *MockReader) RangeTombstones(meta *common.SegmentMeta) ([]common.RangeTombstone, error) {
+	return nil, nil
+}
+func (m *MockReader) NewIterator(meta *common.SegmentMeta) iterator.EntryIterator {
+	data, _ := m.Scan(meta)
+	return iterator.NewSliceIterator(data)
 }
 
 // --- THE ACTUAL TEST ---
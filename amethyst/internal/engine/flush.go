@@ -0,0 +1,297 @@
+package engine
+
+import (
+	"amethyst/internal/common"
+	"amethyst/internal/memtable"
+	"fmt"
+	"log"
+	"time"
+)
+
+// immutable memtables waiting to be flushed, per Options
+const (
+	DefaultMaxImmutableMemtables      = 4
+	DefaultSlowdownImmutableMemtables = 2
+)
+
+// how long a write is held back once the flush queue reaches
+// SlowdownImmutableMemtables
+const WriteSlowdownDelay = time.Millisecond
+
+// immutable is a full memtable taken out of the write path, together with
+// the last WAL file covering it, which can go once the memtable is a segment
+type immutable struct {
+	mem    memtable.Memtable
+	sealed uint64
+}
+
+// StallStats counts writes held back because flushing fell behind.
+type StallStats struct {
+	Slowdowns uint64        // writes delayed by WriteSlowdownDelay
+	Stops     uint64        // writes that waited for a flush to finish
+	StallTime time.Duration // time writes spent in either
+}
+
+// StallStats reports how often writes had to wait for the flusher.
+func (e *Engine) StallStats() StallStats {
+	return StallStats{
+		Slowdowns: e.slowdowns.Load(),
+		Stops:     e.stops.Load(),
+		StallTime: time.Duration(e.stallNanos.Load()),
+	}
+}
+
+// memtables returns the active memtable and the immutable ones, newest
+// first. A memtable leaves the list only after its segment is registered,
+// so taking the list before the segment version misses nothing.
+func (e *Engine) memtables() []memtable.Memtable {
+	e.memMu.RLock()
+	defer e.memMu.RUnlock()
+	mems := make([]memtable.Memtable, 0, len(e.imm)+1)
+	mems = append(mems, e.mem)
+	for i := len(e.imm) - 1; i >= 0; i-- {
+		mems = append(mems, e.imm[i].mem)
+	}
+	return mems
+}
+
+// delays a write while the flush queue is long, before it takes e.mu so
+// the flusher isn't held up by it
+func (e *Engine) slowDownWrite() {
+	e.memMu.RLock()
+	queued := len(e.imm)
+	e.memMu.RUnlock()
+	if queued < e.slowdownImm {
+		return
+	}
+	e.slowdowns.Add(1)
+	e.stallNanos.Add(int64(WriteSlowdownDelay))
+	time.Sleep(WriteSlowdownDelay)
+}
+
+// makeRoomForWrite stops the write until the flush queue has room, and
+// fails it if the engine closed or a background flush failed meanwhile.
+// caller holds e.mu
+func (e *Engine) makeRoomForWrite() error {
+	var start time.Time
+	for {
+		if e.closed.Load() {
+			return ErrClosed
+		}
+		if e.bgErr != nil {
+			return e.bgErr
+		}
+		if e.draining > 0 {
+			// the memtable is about to be swapped
+			e.writeCond.Wait()
+			continue
+		}
+		if len(e.imm) < e.maxImm {
+			break
+		}
+		if start.IsZero() {
+			start = time.Now()
+			e.stops.Add(1)
+		}
+		e.flushCond.Wait()
+	}
+	if !start.IsZero() {
+		e.stallNanos.Add(int64(time.Since(start)))
+	}
+	return nil
+}
+
+// rotates the memtable if the last write filled it, once the writes still
+// in line are in it. caller holds e.mu
+func (e *Engine) maybeRotateMemtable() error {
+	if !e.mem.ShouldFlush() {
+		return nil
+	}
+	e.waitForWrites()
+	// another write may have rotated it meanwhile, or Close come along
+	if e.closed.Load() || !e.mem.ShouldFlush() {
+		return nil
+	}
+	return e.rotateMemtable()
+}
+
+// waitForWrites waits until every write that took its Seq is in the
+// memtable, holding back new ones in makeRoomForWrite meanwhile, so the
+// memtable and the WAL file can be swapped together. caller holds e.mu
+func (e *Engine) waitForWrites() {
+	e.draining++
+	for len(e.writes) > 0 {
+		e.writeCond.Wait()
+	}
+	e.draining--
+	if e.draining == 0 {
+		e.writeCond.Broadcast()
+	}
+}
+
+// rotateMemtable queues the active memtable for the flusher and gives
+// writes a fresh one. The WAL is rotated with it, so the sealed files cover
+// exactly the queued memtables. caller holds e.mu and no write is in line,
+// see waitForWrites
+func (e *Engine) rotateMemtable() error {
+	sealed, err := e.wal.Rotate()
+	if err != nil {
+		return fmt.Errorf("WAL rotate failure: %w", err)
+	}
+	e.memMu.Lock()
+	e.imm = append(e.imm, &immutable{mem: e.mem, sealed: sealed})
+	e.mem = e.newMemtable()
+	e.memMu.Unlock()
+
+	select {
+	case e.flushWake <- struct{}{}:
+	default: // already pending
+	}
+	return nil
+}
+
+// Flush queues the memtable and waits until the flusher has written every
+// queued memtable. Compaction of the new segments is left to the scheduler.
+func (e *Engine) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed.Load() {
+		return ErrClosed
+	}
+	e.waitForWrites()
+	if e.closed.Load() {
+		return ErrClosed
+	}
+	if e.bgErr != nil {
+		return e.bgErr
+	}
+	if e.mem.Len() > 0 {
+		if err := e.rotateMemtable(); err != nil {
+			return err
+		}
+	}
+	for len(e.imm) > 0 || e.flushing {
+		if e.closed.Load() {
+			return ErrClosed
+		}
+		if e.bgErr != nil {
+			return e.bgErr
+		}
+		e.flushCond.Wait()
+	}
+	return e.bgErr
+}
+
+// flushLoop is the background flusher: it drains the queue oldest first,
+// then wakes the compaction scheduler. The first failure stops it and is
+// returned by every later write, the WAL still holds what wasn't flushed.
+func (e *Engine) flushLoop() {
+	defer e.bgDone.Done()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-e.flushWake:
+		}
+
+		e.mu.Lock()
+		e.flushing = true
+		e.mu.Unlock()
+
+		var err error
+		for err == nil && !e.stopping() {
+			var flushed bool
+			if flushed, err = e.flushOldest(); !flushed {
+				break
+			}
+		}
+		e.scheduler.Notify()
+
+		e.mu.Lock()
+		if err != nil && e.bgErr == nil {
+			log.Printf("background flush: %v", err)
+			e.bgErr = err
+		}
+		e.flushing = false
+		e.flushCond.Broadcast()
+		e.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (e *Engine) stopping() bool {
+	select {
+	case <-e.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// flushOldest writes the oldest immutable memtable to a segment. Readers
+// keep finding its data in the memtable until the segment is registered.
+func (e *Engine) flushOldest() (bool, error) {
+	e.mu.Lock()
+	if len(e.imm) == 0 {
+		e.mu.Unlock()
+		return false, nil
+	}
+	imm := e.imm[0]
+	e.mu.Unlock()
+
+	//Sorted copy of the memtable; nothing writes to it any more
+	data := imm.mem.Range("", "")
+	ranges := imm.mem.RangeTombstones()
+
+	//Hand off to the SSTable Writer (The disk storage logic)
+	//TIERED default for new flushes
+	seg, err := e.writeSegment(data, ranges)
+	if err != nil {
+		return false, fmt.Errorf("SSTable write failure: %w", err)
+	}
+
+	// make the new segment visible to reads and compaction, and durable in
+	// the manifest before the WAL covering it goes away
+	if err := e.meta.RegisterSegment(seg); err != nil {
+		return false, fmt.Errorf("manifest update failure: %w", err)
+	}
+	if err := e.meta.SnapshotStats(); err != nil {
+		return false, fmt.Errorf("manifest update failure: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.memMu.Lock()
+	e.imm = e.imm[1:]
+	e.memMu.Unlock()
+	e.flushCond.Broadcast()
+
+	// only drop the sealed WAL files after disk write is confirmed
+	if err := e.wal.Release(imm.sealed); err != nil {
+		return false, fmt.Errorf("WAL cleanup failure: %w", err)
+	}
+
+	log.Printf("flush: %d entries, %d range tombstones -> segment %s", len(data), len(ranges), seg.ID)
+	return true, nil
+}
+
+// writes a flushed memtable, range tombstones in their own block
+func (e *Engine) writeSegment(data []common.KVEntry, ranges []common.RangeTombstone) (*common.SegmentMeta, error) {
+	if len(ranges) == 0 {
+		return e.writer.WriteSegment(data, common.TIERED)
+	}
+	b := e.writer.NewSegment(common.TIERED)
+	for _, entry := range data {
+		if err := b.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	for _, rt := range ranges {
+		if err := b.AddRangeTombstone(rt); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"amethyst/internal/common"
+	"amethyst/internal/iterator"
+	"amethyst/internal/metadata"
+	"math"
+	"time"
+)
+
+// NewIterator returns an iterator over the live keys in [lower, upper),
+// newest value per key, deleted keys skipped. An empty upper means no upper
+// bound; iterator.Prefix gives the bounds for a prefix scan:
+//
+//	it, err := e.NewIterator(iterator.Prefix("user/"))
+//
+// Values past their time to live as of this call are skipped like deleted
+// ones. The memtable parts are snapshots taken here, segments are read
+// lazily and their files kept until the iterator is closed, even if
+// compaction makes them obsolete meanwhile. With a merge operator the
+// iterator reads as of a snapshot it holds until then. The iterator must be
+// closed, and doesn't outlive the engine.
+func (e *Engine) NewIterator(lower, upper string) (iterator.Iterator, error) {
+	return e.NewIteratorAt(nil, lower, upper)
+}
+
+// NewIteratorAt is NewIterator as of snap; a nil snap reads the current
+// state.
+func (e *Engine) NewIteratorAt(snap *Snapshot, lower, upper string) (iterator.Iterator, error) {
+	if snap != nil && snap.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+	if e.closed.Load() {
+		return nil, ErrClosed
+	}
+	// an operand is folded once the iterator gets to it, which needs the
+	// versions under it; a snapshot keeps them around until then
+	var owned *Snapshot
+	if snap == nil && e.mergeOp != nil {
+		var err error
+		if snap, err = e.NewSnapshot(); err != nil {
+			return nil, err
+		}
+		owned = snap
+	}
+	// memtables before the version: a flushed memtable leaves the list only
+	// once its segment is registered, so no key is caught between the two
+	mems := e.memtables()
+	v := e.meta.CurrentVersion()
+
+	// range tombstones before the memtable snapshots, so none deletes a
+	// write the iterator doesn't see
+	seq := uint64(math.MaxUint64)
+	if snap != nil {
+		seq = snap.seq
+	}
+	var rts []common.RangeTombstone
+	addRanges := func(all []common.RangeTombstone) {
+		for _, rt := range all {
+			if rt.Seq <= seq && (rt.End == "" || rt.End > lower) && (upper == "" || rt.Start < upper) {
+				rts = append(rts, rt)
+			}
+		}
+	}
+	for _, mem := range mems {
+		addRanges(mem.RangeTombstones())
+	}
+	for _, seg := range v.Segments() {
+		if !seg.RangeDeletes {
+			continue
+		}
+		segRanges, err := e.reader.RangeTombstones(seg)
+		if err != nil {
+			v.Unref()
+			if owned != nil {
+				owned.Release()
+			}
+			return nil, err
+		}
+		addRanges(segRanges)
+	}
+
+	children := make([]iterator.EntryIterator, 0, len(mems)+len(v.Segments()))
+	for _, mem := range mems {
+		children = append(children, mem.NewIterator(lower, upper))
+	}
+	for _, seg := range v.Segments() {
+		if seg.MaxKey < lower || (upper != "" && seg.MinKey >= upper) {
+			continue
+		}
+		children = append(children, e.reader.NewIterator(seg))
+	}
+	if snap != nil {
+		for i, c := range children {
+			children[i] = iterator.NewSnapshotIterator(c, snap.seq)
+		}
+	}
+	merged := iterator.NewRangeDeleteIterator(iterator.NewMergingIterator(children), rts)
+	merged = iterator.NewExpiryIterator(merged, time.Now().UnixNano())
+	merged = iterator.NewMergeResolvingIterator(merged, func(key string) ([]byte, bool, error) {
+		return e.handler.GetAt(key, seq)
+	})
+	it := iterator.NewBoundedIterator(merged, lower, upper)
+	return &pinnedIterator{Iterator: it, version: v, snap: owned}, nil
+}
+
+// pinnedIterator holds the version it reads, and the snapshot it took if
+// any, until Close
+type pinnedIterator struct {
+	iterator.Iterator
+	version *metadata.Version
+	snap    *Snapshot
+}
+
+func (it *pinnedIterator) Close() error {
+	err := it.Iterator.Close()
+	if it.version != nil {
+		it.version.Unref()
+		it.version = nil
+	}
+	if it.snap != nil {
+		it.snap.Release()
+		it.snap = nil
+	}
+	return err
+}
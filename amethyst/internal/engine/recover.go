@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"amethyst/internal/common"
+	"amethyst/internal/memtable"
+	"amethyst/internal/metadata"
+	"amethyst/internal/segmentfile"
+	"amethyst/internal/sstable/reader"
+	"amethyst/internal/wal"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Recover matches the segments found in the segment store and the legacy
+// data file against meta and replays the WAL (tombstones and range deletes
+// included) into mem. Segments meta already tracks get their block index or
+// sparse index, Bloom filter and expiry histogram reattached; unknown ones
+// are registered only when adopt is set, otherwise they are leftovers of a
+// flush or compaction that never reached the manifest (flushes keep their
+// WAL until then) or obsolete segments dropped by a manifest rewrite.
+// Leftover and obsolete segment files are deleted; in the legacy file they
+// stay until the whole file can go. A half-written segment at the end of
+// the legacy file is cut off so later appends land on good data, but only
+// after at least one good segment: a file that doesn't start with one, or
+// holds a header that doesn't parse, is not ours to cut and fails recovery.
+// fileMgr is nil when there is no legacy file. It returns the highest sequence number
+// seen, new writes continue after it.
+func Recover(w wal.WAL, mem memtable.Memtable, fileMgr segmentfile.SegmentFileManager,
+	store segmentfile.SegmentStore, r *reader.Reader, meta metadata.Tracker, adopt bool) (uint64, error) {
+
+	// 1. Segments, oldest first so the tracker ends up newest-first. The
+	// legacy file is older than any store file.
+	var segs []*common.SegmentMeta
+	if fileMgr != nil {
+		shared, goodSize, err := r.LoadSegments()
+		if errors.Is(err, reader.ErrTornSegment) && goodSize > 0 {
+			log.Printf("recovery: dropping torn segment data after offset %d", goodSize)
+			if err := fileMgr.Truncate(goodSize); err != nil {
+				return 0, err
+			}
+		} else if err != nil {
+			return 0, fmt.Errorf("legacy data file %s: %w", DataFileName, err)
+		}
+		segs = shared
+	}
+	if store != nil {
+		own, err := r.LoadStoreSegments()
+		if err != nil {
+			return 0, err
+		}
+		sort.Slice(own, func(i, j int) bool { return own[i].MaxSeq < own[j].MaxSeq })
+		segs = append(segs, own...)
+	}
+
+	found := make(map[string]bool, len(segs))
+	for _, seg := range segs {
+		found[seg.ID] = true
+		tracked, ok := meta.GetSegment(seg.ID)
+		if ok && !tracked.Obsolete {
+			tracked.SparseIndex = seg.SparseIndex
+			tracked.Filter = seg.Filter
+			tracked.Expiries = seg.Expiries
+			tracked.Shared = seg.Shared
+			tracked.Unsequenced = seg.Unsequenced
+			tracked.RangeDeletes = seg.RangeDeletes
+			continue
+		}
+		if !ok && adopt {
+			if err := meta.RegisterSegment(seg); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if !seg.Shared {
+			log.Printf("recovery: removing dead segment file %s", seg.ID)
+			if err := store.Remove(seg.ID); err != nil {
+				return 0, err
+			}
+		}
+	}
+	var lastSeq uint64
+	for _, seg := range meta.GetAllSegments() {
+		if seg.MaxSeq > lastSeq {
+			lastSeq = seg.MaxSeq
+		}
+		if !found[seg.ID] {
+			return 0, fmt.Errorf("segment %s is in the manifest but has no data", seg.ID)
+		}
+	}
+
+	// 2. WAL entries that never made it into a segment
+	entries, err := w.ReadAll()
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		replayEntry(mem, entry)
+		if entry.Seq > lastSeq {
+			lastSeq = entry.Seq
+		}
+	}
+
+	log.Printf("recovery: %d live segments, %d WAL entries replayed", len(meta.GetAllSegments()), len(entries))
+	return lastSeq, nil
+}
+
+// RecoverLegacyWAL replays the log of a version from before numbered WAL
+// files (wal.LegacyFileName in dir) into mem, after everything Recover
+// found: its entries get the sequence numbers following lastSeq. It
+// returns the new last sequence number and how many entries it replayed;
+// the file stays until they are flushed, see wal.RemoveLegacy.
+func RecoverLegacyWAL(dir string, mem memtable.Memtable, lastSeq uint64) (uint64, int, error) {
+	entries, err := wal.ReadLegacy(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range entries {
+		lastSeq++
+		entry.Seq = lastSeq
+		replayEntry(mem, entry)
+	}
+	if len(entries) > 0 {
+		log.Printf("recovery: %d entries replayed from legacy %s", len(entries), wal.LegacyFileName)
+	}
+	return lastSeq, len(entries), nil
+}
+
+func replayEntry(mem memtable.Memtable, entry common.WALEntry) {
+	if entry.RangeDelete {
+		mem.DeleteRange(entry.Key, entry.End, entry.Seq)
+	} else if entry.Tombstone {
+		mem.Delete(entry.Key, entry.Seq)
+	} else {
+		mem.Apply([]common.KVEntry{{
+			Key: entry.Key, Value: entry.Value, Seq: entry.Seq, ExpiresAt: entry.ExpiresAt, Merge: entry.Merge,
+		}})
+	}
+}
@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"amethyst/internal/compaction"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrSnapshotReleased = errors.New("engine: snapshot released")
+
+// Snapshot is a point in time to read at: GetAt and NewIteratorAt see
+// every write made before NewSnapshot returned and none made after. Older
+// versions of keys a snapshot reads are kept, in the memtable and through
+// compaction, until it is released, so snapshots shouldn't be held longer
+// than needed.
+type Snapshot struct {
+	e        *Engine
+	seq      uint64
+	released atomic.Bool
+}
+
+// NewSnapshot takes a snapshot of the current state. It must be released.
+func (e *Engine) NewSnapshot() (*Snapshot, error) {
+	// writes reach the memtable in Seq order and e.applied moves under
+	// e.mu, so every write up to it is whole and none after it visible
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed.Load() {
+		return nil, ErrClosed
+	}
+	e.snapshots.add(e.applied)
+	return &Snapshot{e: e, seq: e.applied}, nil
+}
+
+// Seq is the sequence number of the last write the snapshot sees.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Release lets compaction drop what only this snapshot still read. It is
+// safe to call more than once.
+func (s *Snapshot) Release() {
+	if s.released.Swap(true) {
+		return
+	}
+	s.e.snapshots.remove(s.seq)
+}
+
+// snapshotList holds the Seq of every live snapshot, ascending, one entry
+// per snapshot.
+type snapshotList struct {
+	mu   sync.Mutex
+	seqs []uint64
+}
+
+func (l *snapshotList) add(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := sort.Search(len(l.seqs), func(i int) bool { return l.seqs[i] > seq })
+	l.seqs = append(l.seqs, 0)
+	copy(l.seqs[i+1:], l.seqs[i:])
+	l.seqs[i] = seq
+}
+
+func (l *snapshotList) remove(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := sort.Search(len(l.seqs), func(i int) bool { return l.seqs[i] >= seq })
+	if i < len(l.seqs) && l.seqs[i] == seq {
+		l.seqs = append(l.seqs[:i], l.seqs[i+1:]...)
+	}
+}
+
+// list returns a copy for a compaction plan
+func (l *snapshotList) list() []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.seqs) == 0 {
+		return nil
+	}
+	return append([]uint64(nil), l.seqs...)
+}
+
+// keep is the memtable's retention rule, the same one compaction applies
+func (l *snapshotList) keep(seq, newer uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return compaction.KeepVersion(seq, newer, l.seqs)
+}
@@ -0,0 +1,88 @@
+package iterator
+
+// boundedIterator is the user-facing view of a merged stream: it hides
+// tombstones and keys outside [lower, upper).
+type boundedIterator struct {
+	src   EntryIterator
+	lower string
+	upper string // empty means unbounded
+}
+
+// NewBoundedIterator limits src to lower <= key < upper and skips deleted
+// keys. An empty upper means no upper bound. It closes src on Close.
+func NewBoundedIterator(src EntryIterator, lower, upper string) Iterator {
+	return &boundedIterator{src: src, lower: lower, upper: upper}
+}
+
+func (b *boundedIterator) Seek(key string) bool {
+	if key < b.lower {
+		key = b.lower
+	}
+	b.src.Seek(key)
+	return b.skipForward()
+}
+
+func (b *boundedIterator) SeekToFirst() bool {
+	if b.lower == "" {
+		b.src.SeekToFirst()
+	} else {
+		b.src.Seek(b.lower)
+	}
+	return b.skipForward()
+}
+
+func (b *boundedIterator) SeekToLast() bool {
+	if b.upper == "" {
+		b.src.SeekToLast()
+	} else if b.src.Seek(b.upper) {
+		b.src.Prev()
+	} else if b.src.Err() == nil {
+		// nothing at or past upper, the last key overall is in range
+		b.src.SeekToLast()
+	}
+	return b.skipBackward()
+}
+
+func (b *boundedIterator) Next() bool {
+	if !b.Valid() {
+		return false
+	}
+	b.src.Next()
+	return b.skipForward()
+}
+
+func (b *boundedIterator) Prev() bool {
+	if !b.Valid() {
+		return false
+	}
+	b.src.Prev()
+	return b.skipBackward()
+}
+
+// stepping stops at the bound, so a long run of deletes past it isn't walked
+func (b *boundedIterator) skipForward() bool {
+	for b.src.Valid() && b.src.Entry().Tombstone && (b.upper == "" || b.src.Key() < b.upper) {
+		b.src.Next()
+	}
+	return b.Valid()
+}
+
+func (b *boundedIterator) skipBackward() bool {
+	for b.src.Valid() && b.src.Entry().Tombstone && b.src.Key() >= b.lower {
+		b.src.Prev()
+	}
+	return b.Valid()
+}
+
+func (b *boundedIterator) Valid() bool {
+	if !b.src.Valid() {
+		return false
+	}
+	key := b.src.Key()
+	return key >= b.lower && (b.upper == "" || key < b.upper)
+}
+
+func (b *boundedIterator) Key() string   { return b.src.Key() }
+func (b *boundedIterator) Value() []byte { return b.src.Value() }
+func (b *boundedIterator) Err() error    { return b.src.Err() }
+func (b *boundedIterator) Close() error  { return b.src.Close() }
@@ -0,0 +1,60 @@
+package iterator
+
+import "amethyst/internal/common"
+
+// hidingIterator shows the entries of a merged stream that are gone for a
+// reason the sources can't see themselves as tombstones, for the bounded
+// iterator on top to skip.
+type hidingIterator struct {
+	src    EntryIterator
+	hidden func(entry common.KVEntry) bool
+}
+
+// NewRangeDeleteIterator hides every entry of src that one of rts deletes.
+// src has to be merged already, one entry per key, its newest version. It
+// closes src on Close.
+func NewRangeDeleteIterator(src EntryIterator, rts []common.RangeTombstone) EntryIterator {
+	if len(rts) == 0 {
+		return src
+	}
+	return &hidingIterator{src: src, hidden: func(entry common.KVEntry) bool {
+		for _, rt := range rts {
+			if rt.Deletes(entry) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// NewExpiryIterator hides every entry of src whose time to live is up at
+// now, in unix nanoseconds. Like NewRangeDeleteIterator it goes on top of a
+// merged stream, an expired version deletes the older ones.
+func NewExpiryIterator(src EntryIterator, now int64) EntryIterator {
+	return &hidingIterator{src: src, hidden: func(entry common.KVEntry) bool {
+		return entry.Expired(now)
+	}}
+}
+
+func (h *hidingIterator) Entry() common.KVEntry {
+	entry := h.src.Entry()
+	if !entry.Tombstone && h.hidden(entry) {
+		entry.Tombstone = true
+		entry.Value = nil
+	}
+	return entry
+}
+
+func (h *hidingIterator) Value() []byte {
+	return h.Entry().Value
+}
+
+func (h *hidingIterator) Seek(key string) bool { return h.src.Seek(key) }
+func (h *hidingIterator) SeekToFirst() bool    { return h.src.SeekToFirst() }
+func (h *hidingIterator) SeekToLast() bool     { return h.src.SeekToLast() }
+func (h *hidingIterator) Next() bool           { return h.src.Next() }
+func (h *hidingIterator) Prev() bool           { return h.src.Prev() }
+func (h *hidingIterator) Valid() bool          { return h.src.Valid() }
+func (h *hidingIterator) Key() string          { return h.src.Key() }
+func (h *hidingIterator) Err() error           { return h.src.Err() }
+func (h *hidingIterator) Close() error         { return h.src.Close() }
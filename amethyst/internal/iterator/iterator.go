@@ -0,0 +1,49 @@
+package iterator
+
+import "amethyst/internal/common"
+
+// Iterator walks keys in ascending order and can step back. A fresh
+// iterator is unpositioned; call Seek, SeekToFirst or SeekToLast first.
+// Every positioning call returns Valid().
+type Iterator interface {
+	// Seek moves to the first key >= key.
+	Seek(key string) bool
+	SeekToFirst() bool
+	SeekToLast() bool
+	Next() bool
+	Prev() bool
+	Valid() bool
+
+	// Key and Value are only meaningful while Valid. Value may be shared
+	// with the block cache and must not be modified, copy it to keep it
+	Key() string
+	Value() []byte
+
+	// Err reports the first I/O or decode error; the iterator becomes
+	// invalid when one happens
+	Err() error
+	Close() error
+}
+
+// EntryIterator is an Iterator over one source (a memtable or a segment)
+// that also shows tombstones and sequence numbers, which is what the
+// merging iterator needs to pick the newest version of a key. A source may
+// hold several versions of a key, they come newest first.
+type EntryIterator interface {
+	Iterator
+	Entry() common.KVEntry
+}
+
+// Prefix returns the [lower, upper) bounds covering every key that starts
+// with p. upper is empty (unbounded) when no key sorts after the prefix
+// range, e.g. for a prefix of only 0xff bytes.
+func Prefix(p string) (lower, upper string) {
+	b := []byte(p)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return p, string(b[:i+1])
+		}
+	}
+	return p, ""
+}
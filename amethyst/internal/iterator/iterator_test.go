@@ -0,0 +1,169 @@
+package iterator
+
+import (
+	"amethyst/internal/common"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func put(key string, seq uint64) common.KVEntry {
+	return common.KVEntry{Key: key, Value: []byte(fmt.Sprintf("%s%d", key, seq)), Seq: seq}
+}
+
+func del(key string, seq uint64) common.KVEntry {
+	return common.KVEntry{Key: key, Tombstone: true, Seq: seq}
+}
+
+// three sources over the same keys, the newest version of a key may be in
+// any of them; the second holds two versions of b
+func sources() []EntryIterator {
+	return []EntryIterator{
+		NewSliceIterator([]common.KVEntry{put("a", 5), del("c", 7), put("e", 9)}),
+		NewSliceIterator([]common.KVEntry{put("a", 2), put("b", 4), put("b", 3), put("d", 6)}),
+		NewSliceIterator([]common.KVEntry{put("c", 1), put("d", 8), put("f", 1)}),
+	}
+}
+
+func show(entry common.KVEntry) string {
+	if entry.Tombstone {
+		return fmt.Sprintf("%s@%d deleted", entry.Key, entry.Seq)
+	}
+	return fmt.Sprintf("%s@%d=%s", entry.Key, entry.Seq, entry.Value)
+}
+
+// walks it from the first or the last entry
+func walk(it EntryIterator, backward bool) string {
+	var seen []string
+	ok := it.SeekToFirst()
+	step := it.Next
+	if backward {
+		ok, step = it.SeekToLast(), it.Prev
+	}
+	for ; ok; ok = step() {
+		seen = append(seen, show(it.Entry()))
+	}
+	return strings.Join(seen, ", ")
+}
+
+func TestMergingIterator_NewestVersionInKeyOrder(t *testing.T) {
+	want := []string{"a@5=a5", "b@4=b4", "c@7 deleted", "d@8=d8", "e@9=e9", "f@1=f1"}
+	it := NewMergingIterator(sources())
+	defer it.Close()
+	if got := walk(it, false); got != strings.Join(want, ", ") {
+		t.Errorf("forward: %s", got)
+	}
+	for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+		want[i], want[j] = want[j], want[i]
+	}
+	if got := walk(it, true); got != strings.Join(want, ", ") {
+		t.Errorf("backward: %s", got)
+	}
+}
+
+func TestMergingIterator_ChangesDirection(t *testing.T) {
+	it := NewMergingIterator(sources())
+	defer it.Close()
+
+	var moves []string
+	record := func(ok bool) {
+		if ok {
+			moves = append(moves, show(it.Entry()))
+		} else {
+			moves = append(moves, "end")
+		}
+	}
+	record(it.SeekToFirst())
+	record(it.Next())
+	record(it.Next())
+	record(it.Prev())
+	record(it.Prev())
+	record(it.Prev())
+	// stepping back onto b lands on its oldest version in the second source
+	record(it.Seek("c"))
+	record(it.Prev())
+	record(it.Next())
+	record(it.Next())
+	record(it.SeekToLast())
+	record(it.Prev())
+	record(it.Next())
+	record(it.Next())
+
+	want := "a@5=a5, b@4=b4, c@7 deleted, b@4=b4, a@5=a5, end, " +
+		"c@7 deleted, b@4=b4, c@7 deleted, d@8=d8, f@1=f1, e@9=e9, f@1=f1, end"
+	if got := strings.Join(moves, ", "); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if it.Seek("g") || it.Err() != nil {
+		t.Errorf("seek past the last key: valid %v, %v", it.Valid(), it.Err())
+	}
+}
+
+func TestBoundedIterator_SkipsTombstonesAndKeysOutOfRange(t *testing.T) {
+	for _, tc := range []struct {
+		lower, upper string
+		want         string
+	}{
+		{"", "", "a,b,d,e,f"},
+		{"b", "e", "b,d"},
+		{"c", "", "d,e,f"},
+		{"", "c", "a,b"},
+		{"c", "d", ""},
+		{"g", "", ""},
+	} {
+		it := NewBoundedIterator(NewMergingIterator(sources()), tc.lower, tc.upper)
+		var forward, backward []string
+		for ok := it.SeekToFirst(); ok; ok = it.Next() {
+			forward = append(forward, it.Key())
+		}
+		for ok := it.SeekToLast(); ok; ok = it.Prev() {
+			backward = append([]string{it.Key()}, backward...)
+		}
+		if got := strings.Join(forward, ","); got != tc.want {
+			t.Errorf("[%q, %q) forward: %s, want %s", tc.lower, tc.upper, got, tc.want)
+		}
+		if got := strings.Join(backward, ","); got != tc.want {
+			t.Errorf("[%q, %q) backward: %s, want %s", tc.lower, tc.upper, got, tc.want)
+		}
+		// seeking below the range starts at its lower bound
+		if ok := it.Seek(""); ok != (tc.want != "") || (ok && it.Key() != tc.want[:1]) {
+			t.Errorf("[%q, %q) seek below the range: %v", tc.lower, tc.upper, ok)
+		}
+		it.Close()
+	}
+}
+
+func TestSnapshotIterator_HidesLaterVersions(t *testing.T) {
+	var children []EntryIterator
+	for _, src := range sources() {
+		children = append(children, NewSnapshotIterator(src, 5))
+	}
+	it := NewMergingIterator(children)
+	defer it.Close()
+	// c's delete, both versions of d and e were written after the snapshot
+	want := "a@5=a5, b@4=b4, c@1=c1, f@1=f1"
+	if got := walk(it, false); got != want {
+		t.Errorf("forward: %s", got)
+	}
+	if got := walk(it, true); got != "f@1=f1, c@1=c1, b@4=b4, a@5=a5" {
+		t.Errorf("backward: %s", got)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, upper string
+	}{
+		{"tenant1/", "tenant10"},
+		{"a", "b"},
+		{"a\xff", "b"},
+		{"a\xff\xff", "b"},
+		{"\xff\xff", ""},
+		{"", ""},
+	} {
+		lower, upper := Prefix(tc.prefix)
+		if lower != tc.prefix || upper != tc.upper {
+			t.Errorf("Prefix(%q) = [%q, %q), want upper %q", tc.prefix, lower, upper, tc.upper)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package iterator
+
+import "amethyst/internal/common"
+
+type direction int
+
+const (
+	forward direction = iota
+	backward
+)
+
+// mergingIterator combines several sources into one ordered stream with a
+// single entry per key: the version with the highest Seq. Tombstones are
+// passed through so the caller decides whether they hide the key.
+//
+// Moving forward every child sits on its first key >= the current key,
+// moving backward on its last key <= the current key; either way on the
+// newest version of that key. Children are compared with a linear scan,
+// there are only ever a handful of them.
+type mergingIterator struct {
+	children []EntryIterator
+	dir      direction
+	current  common.KVEntry
+	valid    bool
+	err      error
+}
+
+// NewMergingIterator merges children newest-wins. It takes ownership of
+// them and closes them on Close.
+func NewMergingIterator(children []EntryIterator) EntryIterator {
+	return &mergingIterator{children: children}
+}
+
+func (m *mergingIterator) Seek(key string) bool {
+	for _, c := range m.children {
+		c.Seek(key)
+	}
+	m.dir = forward
+	return m.pickSmallest()
+}
+
+func (m *mergingIterator) SeekToFirst() bool {
+	for _, c := range m.children {
+		c.SeekToFirst()
+	}
+	m.dir = forward
+	return m.pickSmallest()
+}
+
+func (m *mergingIterator) SeekToLast() bool {
+	for _, c := range m.children {
+		c.SeekToLast()
+		toNewest(c)
+	}
+	m.dir = backward
+	return m.pickLargest()
+}
+
+func (m *mergingIterator) Next() bool {
+	if !m.valid {
+		return false
+	}
+	key := m.current.Key
+
+	if m.dir == backward {
+		// children sit at or before key, bring each one past it
+		for _, c := range m.children {
+			if !c.Valid() {
+				c.SeekToFirst()
+			}
+			for c.Valid() && c.Key() <= key {
+				c.Next()
+			}
+		}
+		m.dir = forward
+		return m.pickSmallest()
+	}
+
+	for _, c := range m.children {
+		for c.Valid() && c.Key() == key {
+			c.Next()
+		}
+	}
+	return m.pickSmallest()
+}
+
+func (m *mergingIterator) Prev() bool {
+	if !m.valid {
+		return false
+	}
+	key := m.current.Key
+
+	if m.dir == forward {
+		// children sit at or after key, bring each one before it
+		for _, c := range m.children {
+			if !c.Valid() {
+				c.SeekToLast()
+			}
+			for c.Valid() && c.Key() >= key {
+				c.Prev()
+			}
+			toNewest(c)
+		}
+		m.dir = backward
+		return m.pickLargest()
+	}
+
+	for _, c := range m.children {
+		for c.Valid() && c.Key() == key {
+			c.Prev()
+		}
+		toNewest(c)
+	}
+	return m.pickLargest()
+}
+
+// stepping back lands on the oldest version of a key, this moves c on to
+// its newest
+func toNewest(c EntryIterator) {
+	if !c.Valid() {
+		return
+	}
+	key := c.Key()
+	for c.Prev() && c.Key() == key {
+	}
+	if c.Valid() {
+		c.Next()
+	} else if c.Err() == nil {
+		c.Seek(key)
+	}
+}
+
+// picks the smallest key among the children, newest version on ties
+func (m *mergingIterator) pickSmallest() bool {
+	return m.pick(func(a, b string) bool { return a < b })
+}
+
+// picks the largest key among the children, newest version on ties
+func (m *mergingIterator) pickLargest() bool {
+	return m.pick(func(a, b string) bool { return a > b })
+}
+
+func (m *mergingIterator) pick(before func(a, b string) bool) bool {
+	m.valid = false
+	for _, c := range m.children {
+		if err := c.Err(); err != nil {
+			m.err = err
+			return false
+		}
+		if !c.Valid() {
+			continue
+		}
+		entry := c.Entry()
+		if !m.valid || before(entry.Key, m.current.Key) ||
+			(entry.Key == m.current.Key && entry.Seq > m.current.Seq) {
+			m.current = entry
+			m.valid = true
+		}
+	}
+	return m.valid
+}
+
+func (m *mergingIterator) Valid() bool           { return m.valid && m.err == nil }
+func (m *mergingIterator) Key() string           { return m.current.Key }
+func (m *mergingIterator) Value() []byte         { return m.current.Value }
+func (m *mergingIterator) Entry() common.KVEntry { return m.current }
+func (m *mergingIterator) Err() error            { return m.err }
+
+func (m *mergingIterator) Close() error {
+	var firstErr error
+	for _, c := range m.children {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	m.children = nil
+	m.valid = false
+	return firstErr
+}
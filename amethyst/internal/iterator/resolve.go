@@ -0,0 +1,59 @@
+package iterator
+
+import "amethyst/internal/common"
+
+// resolvingIterator shows the merge operands of a merged stream as the
+// values they fold into, looked up when the iterator gets to them. A key
+// whose operands fold into nothing shows as a tombstone.
+type resolvingIterator struct {
+	src     EntryIterator
+	resolve func(key string) ([]byte, bool, error)
+
+	resolved common.KVEntry // the last operand's value, valid if cached
+	cached   bool
+	err      error
+}
+
+// NewMergeResolvingIterator replaces each merge operand of src with what
+// resolve(key) returns, the key's value as of that operand. src has to be
+// merged already, one entry per key. It closes src on Close.
+func NewMergeResolvingIterator(src EntryIterator, resolve func(key string) ([]byte, bool, error)) EntryIterator {
+	return &resolvingIterator{src: src, resolve: resolve}
+}
+
+func (r *resolvingIterator) Entry() common.KVEntry {
+	entry := r.src.Entry()
+	if !entry.Merge || entry.Tombstone {
+		return entry // a hidden operand stays hidden
+	}
+	if r.cached && r.resolved.Key == entry.Key && r.resolved.Seq == entry.Seq {
+		return r.resolved
+	}
+	value, ok, err := r.resolve(entry.Key)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	r.resolved = common.KVEntry{Key: entry.Key, Value: value, Tombstone: !ok || err != nil, Seq: entry.Seq}
+	r.cached = true
+	return r.resolved
+}
+
+func (r *resolvingIterator) Value() []byte {
+	return r.Entry().Value
+}
+
+func (r *resolvingIterator) Seek(key string) bool { return r.src.Seek(key) && r.err == nil }
+func (r *resolvingIterator) SeekToFirst() bool    { return r.src.SeekToFirst() && r.err == nil }
+func (r *resolvingIterator) SeekToLast() bool     { return r.src.SeekToLast() && r.err == nil }
+func (r *resolvingIterator) Next() bool           { return r.src.Next() && r.err == nil }
+func (r *resolvingIterator) Prev() bool           { return r.src.Prev() && r.err == nil }
+func (r *resolvingIterator) Valid() bool          { return r.src.Valid() && r.err == nil }
+func (r *resolvingIterator) Key() string          { return r.src.Key() }
+func (r *resolvingIterator) Close() error         { return r.src.Close() }
+
+func (r *resolvingIterator) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.src.Err()
+}
@@ -0,0 +1,62 @@
+package iterator
+
+import (
+	"amethyst/internal/common"
+	"sort"
+)
+
+// sliceIterator walks a sorted slice of entries, e.g. a memtable snapshot
+type sliceIterator struct {
+	entries []common.KVEntry
+	pos     int // -1 or len(entries) when not positioned
+}
+
+// NewSliceIterator iterates over entries, which must be sorted by key, the
+// versions of a key newest first. The slice is not copied.
+func NewSliceIterator(entries []common.KVEntry) EntryIterator {
+	return &sliceIterator{entries: entries, pos: -1}
+}
+
+func (it *sliceIterator) Seek(key string) bool {
+	it.pos = sort.Search(len(it.entries), func(i int) bool { return it.entries[i].Key >= key })
+	return it.Valid()
+}
+
+func (it *sliceIterator) SeekToFirst() bool {
+	it.pos = 0
+	return it.Valid()
+}
+
+func (it *sliceIterator) SeekToLast() bool {
+	it.pos = len(it.entries) - 1
+	return it.Valid()
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.Valid() {
+		it.pos++
+	}
+	return it.Valid()
+}
+
+func (it *sliceIterator) Prev() bool {
+	if it.Valid() {
+		it.pos--
+	}
+	return it.Valid()
+}
+
+func (it *sliceIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) Key() string           { return it.entries[it.pos].Key }
+func (it *sliceIterator) Value() []byte         { return it.entries[it.pos].Value }
+func (it *sliceIterator) Entry() common.KVEntry { return it.entries[it.pos] }
+func (it *sliceIterator) Err() error            { return nil }
+
+func (it *sliceIterator) Close() error {
+	it.entries = nil
+	it.pos = -1
+	return nil
+}
@@ -0,0 +1,68 @@
+package iterator
+
+import "amethyst/internal/common"
+
+// snapshotIterator hides the versions of a source written after a snapshot.
+type snapshotIterator struct {
+	src EntryIterator
+	seq uint64
+}
+
+// NewSnapshotIterator shows only the entries of src with Seq <= seq, so
+// the newest version of a key it shows is the one visible at that point.
+// It closes src on Close.
+func NewSnapshotIterator(src EntryIterator, seq uint64) EntryIterator {
+	return &snapshotIterator{src: src, seq: seq}
+}
+
+func (s *snapshotIterator) Seek(key string) bool {
+	s.src.Seek(key)
+	return s.skipForward()
+}
+
+func (s *snapshotIterator) SeekToFirst() bool {
+	s.src.SeekToFirst()
+	return s.skipForward()
+}
+
+func (s *snapshotIterator) SeekToLast() bool {
+	s.src.SeekToLast()
+	return s.skipBackward()
+}
+
+func (s *snapshotIterator) Next() bool {
+	if !s.Valid() {
+		return false
+	}
+	s.src.Next()
+	return s.skipForward()
+}
+
+func (s *snapshotIterator) Prev() bool {
+	if !s.Valid() {
+		return false
+	}
+	s.src.Prev()
+	return s.skipBackward()
+}
+
+func (s *snapshotIterator) skipForward() bool {
+	for s.src.Valid() && s.src.Entry().Seq > s.seq {
+		s.src.Next()
+	}
+	return s.src.Valid()
+}
+
+func (s *snapshotIterator) skipBackward() bool {
+	for s.src.Valid() && s.src.Entry().Seq > s.seq {
+		s.src.Prev()
+	}
+	return s.src.Valid()
+}
+
+func (s *snapshotIterator) Valid() bool           { return s.src.Valid() }
+func (s *snapshotIterator) Key() string           { return s.src.Key() }
+func (s *snapshotIterator) Value() []byte         { return s.src.Value() }
+func (s *snapshotIterator) Entry() common.KVEntry { return s.src.Entry() }
+func (s *snapshotIterator) Err() error            { return s.src.Err() }
+func (s *snapshotIterator) Close() error          { return s.src.Close() }
@@ -2,63 +2,144 @@ package memtable
 
 import (
 	"amethyst/internal/common"
+	"amethyst/internal/iterator"
 	"sort" //sort keys in Flush
 	"sync"
 )
 
 type Memtable interface {
-	Put(key string, value []byte)
-	Delete(key string)
+	Put(key string, value []byte, seq uint64)
+	Delete(key string, seq uint64)
 	Get(key string) ([]byte, bool)
+	// GetEntry also reports tombstones, so a delete here can hide older
+	// versions on disk
+	GetEntry(key string) (common.KVEntry, bool)
+	// GetEntryAt is GetEntry for the newest version with Seq <= seq
+	GetEntryAt(key string, seq uint64) (common.KVEntry, bool)
+	// Apply inserts several entries at once, readers see all of them or
+	// none
+	Apply(entries []common.KVEntry)
+	// DeleteRange records a range tombstone deleting the keys with
+	// start <= key < end written before seq; an empty end means no upper
+	// bound
+	DeleteRange(start, end string, seq uint64)
+	// ApplyWithRanges is Apply for a batch that deletes ranges too
+	ApplyWithRanges(entries []common.KVEntry, ranges []common.RangeTombstone)
+	// RangeTombstones returns the range tombstones held. Get, Range and
+	// iterators don't apply them, that is up to the caller, since they hide
+	// older versions in other memtables and on disk as well
+	RangeTombstones() []common.RangeTombstone
+	// Range returns the entries with start <= key < end in key order, every
+	// version kept newest first and tombstones included; an empty end means
+	// no upper bound
+	Range(start, end string) []common.KVEntry
+	// NewIterator iterates over a snapshot of [lower, upper); writes made
+	// after the call are not seen
+	NewIterator(lower, upper string) iterator.EntryIterator
 
 	ShouldFlush() bool
+	// Len is the number of entries, every version and range tombstone
+	// counted
+	Len() int
+	// Size is the memory the entries take, keys, values and EntryOverhead
+	// per version
+	Size() int64
+	// Flush returns the entries and clears the memtable, range tombstones
+	// included
 	Flush() []common.KVEntry
 }
 
 type memtable struct {
-	data       []common.KVEntry //sorted order
+	data       []common.KVEntry //sorted by key, versions newest first
+	ranges     []common.RangeTombstone
 	maxEntries int
+	retain     func(seq, newer uint64) bool // nil keeps only the newest version
 	mu         sync.RWMutex
 }
 
+// NewMemtable keeps the newest version of each key only, and the versions
+// under a merge operand, which are part of its value.
 func NewMemtable(maxEntries int) Memtable {
+	return NewMemtableWithRetention(maxEntries, nil)
+}
+
+// NewMemtableWithRetention keeps an older version of a key, seq, next to
+// the newer one, newer, when retain(seq, newer) says a snapshot still
+// reads it.
+func NewMemtableWithRetention(maxEntries int, retain func(seq, newer uint64) bool) Memtable {
 	return &memtable{
 		data:       make([]common.KVEntry, 0),
 		maxEntries: maxEntries,
+		retain:     retain,
 	}
 }
 
-func (m *memtable) Put(key string, value []byte) {
+func (m *memtable) Put(key string, value []byte, seq uint64) {
+	m.insert(common.KVEntry{Key: key, Value: value, Tombstone: false, Seq: seq})
+}
+
+func (m *memtable) Delete(key string, seq uint64) {
+	m.insert(common.KVEntry{Key: key, Value: nil, Tombstone: true, Seq: seq})
+}
+
+func (m *memtable) Apply(entries []common.KVEntry) {
+	m.ApplyWithRanges(entries, nil)
+}
+
+func (m *memtable) DeleteRange(start, end string, seq uint64) {
+	m.ApplyWithRanges(nil, []common.RangeTombstone{{Start: start, End: end, Seq: seq}})
+}
+
+func (m *memtable) ApplyWithRanges(entries []common.KVEntry, ranges []common.RangeTombstone) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	// Binary search to find the correct insertion point
-	i := sort.Search(len(m.data), func(i int) bool { return m.data[i].Key >= key })
-	if i < len(m.data) && m.data[i].Key == key {
-		m.data[i] = common.KVEntry{Key: key, Value: value, Tombstone: false}
-	} else {
-		// Insert while maintaining sort order
-		m.data = append(m.data, common.KVEntry{})
-		copy(m.data[i+1:], m.data[i:])
-		m.data[i] = common.KVEntry{Key: key, Value: value, Tombstone: false}
+	for _, entry := range entries {
+		m.insertLocked(entry)
 	}
+	m.ranges = append(m.ranges, ranges...)
 }
 
-func (m *memtable) Delete(key string) {
+func (m *memtable) RangeTombstones() []common.RangeTombstone {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]common.RangeTombstone(nil), m.ranges...)
+}
+
+func (m *memtable) insert(entry common.KVEntry) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.insertLocked(entry)
+}
+
+// caller holds m.mu
+func (m *memtable) insertLocked(entry common.KVEntry) {
 	// Binary search to find the correct insertion point
-	i := sort.Search(len(m.data), func(i int) bool { return m.data[i].Key >= key })
+	i := sort.Search(len(m.data), func(i int) bool {
+		return m.data[i].Key > entry.Key || (m.data[i].Key == entry.Key && m.data[i].Seq <= entry.Seq)
+	})
+	older := i < len(m.data) && m.data[i].Key == entry.Key
 
-	if i < len(m.data) && m.data[i].Key == key {
-		m.data[i] = common.KVEntry{Key: key, Value: nil, Tombstone: true}
-	} else {
-		// Insert tombstone while maintaining sort order
+	switch {
+	case older && m.data[i].Seq == entry.Seq:
+		// the same write applied again
+		m.data[i] = entry
+	case i > 0 && m.data[i-1].Key == entry.Key && !m.data[i-1].Merge && !m.keep(entry.Seq, m.data[i-1].Seq):
+		// an older write arriving late, hidden by the newer one
+	case older && !entry.Merge && !m.keep(m.data[i].Seq, entry.Seq):
+		m.data[i] = entry
+	default:
+		// Insert while maintaining sort order
 		m.data = append(m.data, common.KVEntry{})
 		copy(m.data[i+1:], m.data[i:])
-		m.data[i] = common.KVEntry{Key: key, Value: nil, Tombstone: true}
+		m.data[i] = entry
 	}
 }
 
+// whether the version seq has to stay next to the newer version newer
+func (m *memtable) keep(seq, newer uint64) bool {
+	return m.retain != nil && m.retain(seq, newer)
+}
+
 func (m *memtable) Get(key string) ([]byte, bool) {
 	m.mu.RLock() // Request shared read access
 	defer m.mu.RUnlock()
@@ -70,17 +151,82 @@ func (m *memtable) Get(key string) ([]byte, bool) {
 	return nil, false
 }
 
+func (m *memtable) GetEntry(key string) (common.KVEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := sort.Search(len(m.data), func(i int) bool { return m.data[i].Key >= key })
+	if i < len(m.data) && m.data[i].Key == key {
+		return m.data[i], true
+	}
+	return common.KVEntry{}, false
+}
+
+func (m *memtable) GetEntryAt(key string, seq uint64) (common.KVEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := sort.Search(len(m.data), func(i int) bool {
+		return m.data[i].Key > key || (m.data[i].Key == key && m.data[i].Seq <= seq)
+	})
+	if i < len(m.data) && m.data[i].Key == key {
+		return m.data[i], true
+	}
+	return common.KVEntry{}, false
+}
+
+func (m *memtable) Range(start, end string) []common.KVEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := sort.Search(len(m.data), func(i int) bool { return m.data[i].Key >= start })
+	j := len(m.data)
+	if end != "" {
+		j = sort.Search(len(m.data), func(i int) bool { return m.data[i].Key >= end })
+	}
+	if i >= j {
+		return nil
+	}
+	result := make([]common.KVEntry, j-i)
+	copy(result, m.data[i:j])
+	return result
+}
+
+func (m *memtable) NewIterator(lower, upper string) iterator.EntryIterator {
+	return iterator.NewSliceIterator(m.Range(lower, upper))
+}
+
 // returns true if mem is full
 func (m *memtable) ShouldFlush() bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return len(m.data) >= m.maxEntries
+	return len(m.data)+len(m.ranges) >= m.maxEntries
+}
+
+func (m *memtable) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.data) + len(m.ranges)
+}
+
+func (m *memtable) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var size int64
+	for _, entry := range m.data {
+		size += entrySize(entry)
+	}
+	for _, rt := range m.ranges {
+		size += rangeSize(rt)
+	}
+	return size
 }
 
 // clears data and returns sorted for SSTable Writer
 func (m *memtable) Flush() []common.KVEntry {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.ranges = nil
 
 	// If there's no data, return nil so her main.go skips the write
 	if len(m.data) == 0 {
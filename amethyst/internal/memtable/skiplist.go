@@ -0,0 +1,355 @@
+package memtable
+
+import (
+	"amethyst/internal/common"
+	"amethyst/internal/iterator"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bytes a skiplist memtable holds before ShouldFlush, when not given
+const DefaultMaxBytes = 4 << 20
+
+// EntryOverhead is what a version costs on top of its key and value: the
+// node, the entry it holds and an average tower of links.
+const EntryOverhead = 96
+
+const (
+	maxHeight = 12
+	branching = 4 // one node in branching gets the next level too
+)
+
+// node is one version of a key. Nodes are never modified once linked, an
+// older version that is no longer needed is unlinked instead.
+type node struct {
+	entry common.KVEntry
+	next  []atomic.Pointer[node]
+	stale bool // on skiplist.stale, only writers look at it
+}
+
+// skiplist is a Memtable readers use without taking a lock: writers are
+// serialized by mu and link a node level by level from the bottom, so a
+// reader following the links sees it either everywhere it looks or not at
+// all. Versions are ordered like the slice memtable's, key ascending then
+// Seq descending.
+type skiplist struct {
+	head    atomic.Pointer[node] // sentinel with a full tower, swapped by Flush
+	height  atomic.Int32         // levels in use, a hint for where searches start
+	visible atomic.Uint64        // highest Seq readers may see, see Apply
+	size    atomic.Int64         // bytes charged against maxBytes
+	count   atomic.Int64
+	ranges  atomic.Pointer[[]common.RangeTombstone] // replaced, never modified
+	readers atomic.Int64                            // readers walking the list, see unlinkStaleLocked
+
+	maxBytes int64
+	retain   func(seq, newer uint64) bool // nil keeps only the newest version
+
+	mu    sync.Mutex // serializes writers
+	rnd   *rand.Rand // guarded by mu
+	stale []*node    // replaced versions still linked, guarded by mu
+}
+
+// NewSkiplist keeps the newest version of each key only, and the versions
+// under a merge operand, and asks for a flush once maxBytes of keys, values
+// and EntryOverhead are held.
+func NewSkiplist(maxBytes int64) Memtable {
+	return NewSkiplistWithRetention(maxBytes, nil)
+}
+
+// NewSkiplistWithRetention is NewSkiplist keeping older versions the way
+// NewMemtableWithRetention does.
+func NewSkiplistWithRetention(maxBytes int64, retain func(seq, newer uint64) bool) Memtable {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	s := &skiplist{
+		maxBytes: maxBytes,
+		retain:   retain,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.head.Store(newNode(common.KVEntry{}, maxHeight))
+	s.height.Store(1)
+	return s
+}
+
+func newNode(entry common.KVEntry, height int) *node {
+	return &node{entry: entry, next: make([]atomic.Pointer[node], height)}
+}
+
+func entrySize(entry common.KVEntry) int64 {
+	return int64(len(entry.Key) + len(entry.Value) + EntryOverhead)
+}
+
+func rangeSize(rt common.RangeTombstone) int64 {
+	return int64(len(rt.Start) + len(rt.End) + EntryOverhead)
+}
+
+// whether n sorts before the version seq of key
+func before(n *node, key string, seq uint64) bool {
+	return n.entry.Key < key || (n.entry.Key == key && n.entry.Seq > seq)
+}
+
+// findGE returns the first node at or after the version seq of key, and if
+// preds isn't nil fills it with the last node before it on every level.
+func (s *skiplist) findGE(key string, seq uint64, preds []*node) *node {
+	x := s.head.Load()
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		next := x.next[level].Load()
+		for next != nil && before(next, key, seq) {
+			x = next
+			next = x.next[level].Load()
+		}
+		if preds != nil {
+			preds[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+func (s *skiplist) randomHeight() int {
+	h := 1
+	for h < maxHeight && s.rnd.Intn(branching) == 0 {
+		h++
+	}
+	return h
+}
+
+func (s *skiplist) Put(key string, value []byte, seq uint64) {
+	s.Apply([]common.KVEntry{{Key: key, Value: value, Seq: seq}})
+}
+
+func (s *skiplist) Delete(key string, seq uint64) {
+	s.Apply([]common.KVEntry{{Key: key, Tombstone: true, Seq: seq}})
+}
+
+func (s *skiplist) DeleteRange(start, end string, seq uint64) {
+	s.ApplyWithRanges(nil, []common.RangeTombstone{{Start: start, End: end, Seq: seq}})
+}
+
+func (s *skiplist) Apply(entries []common.KVEntry) {
+	s.ApplyWithRanges(entries, nil)
+}
+
+// ApplyWithRanges links every entry and adds the range tombstones, then
+// makes them visible at once by raising the visible Seq, and only then
+// unlinks the versions they replace, once no reader is left that might
+// still look for them, so readers never see part of a batch nor a key
+// missing in between.
+func (s *skiplist) ApplyWithRanges(entries []common.KVEntry, ranges []common.RangeTombstone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var replaced []*node
+	maxSeq := s.visible.Load()
+	for _, entry := range entries {
+		if old, ok := s.insertLocked(entry); ok {
+			if old != nil {
+				replaced = append(replaced, old)
+			}
+			if entry.Seq > maxSeq {
+				maxSeq = entry.Seq
+			}
+		}
+	}
+	if len(ranges) > 0 {
+		var all []common.RangeTombstone
+		if old := s.ranges.Load(); old != nil {
+			all = append(all, *old...)
+		}
+		for _, rt := range ranges {
+			all = append(all, rt)
+			s.size.Add(rangeSize(rt))
+			s.count.Add(1)
+			if rt.Seq > maxSeq {
+				maxSeq = rt.Seq
+			}
+		}
+		s.ranges.Store(&all)
+	}
+	s.visible.Store(maxSeq)
+	s.stale = append(s.stale, replaced...)
+	s.unlinkStaleLocked()
+}
+
+// unlinkStaleLocked unlinks the replaced versions unless a reader is
+// walking the list: one that loaded the visible Seq before their newer
+// versions were published skips those and needs the old ones. A reader
+// starting after the check sees the newer versions. Versions left linked
+// wait for the next write and stay charged to the budget meanwhile.
+// caller holds s.mu
+func (s *skiplist) unlinkStaleLocked() {
+	if len(s.stale) == 0 || s.readers.Load() != 0 {
+		return
+	}
+	for _, old := range s.stale {
+		s.unlinkLocked(old)
+	}
+	s.stale = s.stale[:0]
+}
+
+// insertLocked links entry unless a newer version hides it, returning the
+// version it replaces, if any. caller holds s.mu
+func (s *skiplist) insertLocked(entry common.KVEntry) (*node, bool) {
+	var preds [maxHeight]*node
+	height := int(s.height.Load())
+	head := s.head.Load()
+	for level := height; level < maxHeight; level++ {
+		preds[level] = head
+	}
+	succ := s.findGE(entry.Key, entry.Seq, preds[:])
+	prev := preds[0]
+	older := succ != nil && succ.entry.Key == entry.Key
+
+	var replaced *node
+	switch {
+	case prev != head && prev.entry.Key == entry.Key && !prev.entry.Merge && !s.keep(entry.Seq, prev.entry.Seq):
+		// an older write arriving late, hidden by the newer one
+		return nil, false
+	case older && succ.entry.Seq == entry.Seq:
+		// the same write applied again
+		replaced = succ
+	case older && !entry.Merge && !s.keep(succ.entry.Seq, entry.Seq):
+		replaced = succ
+	}
+	if replaced != nil {
+		if replaced.stale {
+			replaced = nil // replaced before, waiting to be unlinked
+		} else {
+			replaced.stale = true
+		}
+	}
+
+	h := s.randomHeight()
+	if h > height {
+		s.height.Store(int32(h))
+	}
+	n := newNode(entry, h)
+	for level := 0; level < h; level++ {
+		n.next[level].Store(preds[level].next[level].Load())
+	}
+	// publish bottom up: a node reachable on a level is on every one below
+	for level := 0; level < h; level++ {
+		preds[level].next[level].Store(n)
+	}
+	s.size.Add(entrySize(entry) + int64(h-1)*8)
+	s.count.Add(1)
+	return replaced, true
+}
+
+// unlinkLocked takes n out of every level it is on. Readers standing on n
+// still find their way on through its links. caller holds s.mu
+func (s *skiplist) unlinkLocked(n *node) {
+	var preds [maxHeight]*node
+	s.findGE(n.entry.Key, n.entry.Seq, preds[:])
+	for level := len(n.next) - 1; level >= 0; level-- {
+		p := preds[level]
+		// a newer node with the same Seq may sit before n
+		for next := p.next[level].Load(); next != n; next = p.next[level].Load() {
+			p = next
+		}
+		p.next[level].Store(n.next[level].Load())
+	}
+	s.size.Add(-(entrySize(n.entry) + int64(len(n.next)-1)*8))
+	s.count.Add(-1)
+}
+
+// whether the version seq has to stay next to the newer version newer
+func (s *skiplist) keep(seq, newer uint64) bool {
+	return s.retain != nil && s.retain(seq, newer)
+}
+
+func (s *skiplist) Get(key string) ([]byte, bool) {
+	entry, ok := s.GetEntry(key)
+	if !ok || entry.Tombstone {
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+func (s *skiplist) GetEntry(key string) (common.KVEntry, bool) {
+	return s.GetEntryAt(key, s.visible.Load())
+}
+
+func (s *skiplist) GetEntryAt(key string, seq uint64) (common.KVEntry, bool) {
+	s.readers.Add(1)
+	defer s.readers.Add(-1)
+	if visible := s.visible.Load(); seq > visible {
+		seq = visible
+	}
+	n := s.findGE(key, seq, nil)
+	if n != nil && n.entry.Key == key {
+		return n.entry, true
+	}
+	return common.KVEntry{}, false
+}
+
+// Range may return a replaced version next to its newer one, until it is
+// unlinked.
+func (s *skiplist) Range(start, end string) []common.KVEntry {
+	s.readers.Add(1)
+	defer s.readers.Add(-1)
+	visible := s.visible.Load()
+	var result []common.KVEntry
+	for n := s.findGE(start, visible, nil); n != nil; n = n.next[0].Load() {
+		if end != "" && n.entry.Key >= end {
+			break
+		}
+		if n.entry.Seq <= visible {
+			result = append(result, n.entry)
+		}
+	}
+	return result
+}
+
+// RangeTombstones leaves out those of a batch still being applied.
+func (s *skiplist) RangeTombstones() []common.RangeTombstone {
+	all := s.ranges.Load()
+	if all == nil {
+		return nil
+	}
+	visible := s.visible.Load()
+	result := make([]common.RangeTombstone, 0, len(*all))
+	for _, rt := range *all {
+		if rt.Seq <= visible {
+			result = append(result, rt)
+		}
+	}
+	return result
+}
+
+func (s *skiplist) NewIterator(lower, upper string) iterator.EntryIterator {
+	return iterator.NewSliceIterator(s.Range(lower, upper))
+}
+
+// returns true once the byte budget is used up
+func (s *skiplist) ShouldFlush() bool {
+	return s.size.Load() >= s.maxBytes
+}
+
+func (s *skiplist) Len() int {
+	return int(s.count.Load())
+}
+
+func (s *skiplist) Size() int64 {
+	return s.size.Load()
+}
+
+// clears data and returns sorted for SSTable Writer; readers still walking
+// the old list finish on it
+func (s *skiplist) Flush() []common.KVEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.Range("", "")
+	s.head.Store(newNode(common.KVEntry{}, maxHeight))
+	s.height.Store(1)
+	s.ranges.Store(nil)
+	s.stale = nil
+	s.size.Store(0)
+	s.count.Store(0)
+	return data
+}
@@ -0,0 +1,202 @@
+package memtable
+
+import (
+	"amethyst/internal/common"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bytes charged for the nodes linked at level 0, towers included
+func linkedBytes(s *skiplist) int64 {
+	var size int64
+	for n := s.head.Load().next[0].Load(); n != nil; n = n.next[0].Load() {
+		size += entrySize(n.entry) + int64(len(n.next)-1)*8
+	}
+	return size
+}
+
+func TestSkiplist_ConcurrentReadersDuringInserts(t *testing.T) {
+	s := NewSkiplist(1 << 30).(*skiplist)
+	const keys = 64
+	for i := 0; i < keys; i++ {
+		s.Put(fmt.Sprintf("k%03d", i), []byte("0"), uint64(i+1))
+	}
+
+	// every key is overwritten over and over; a reader must find each one
+	// in every pass, versions in key order then newest first
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i := 0; i < keys; i++ {
+					key := fmt.Sprintf("k%03d", i)
+					if _, ok := s.GetEntry(key); !ok {
+						t.Errorf("%s missing while being overwritten", key)
+						return
+					}
+				}
+				entries := s.Range("", "")
+				seen := make(map[string]bool, keys)
+				for j, entry := range entries {
+					if j > 0 {
+						prev := entries[j-1]
+						if prev.Key > entry.Key || (prev.Key == entry.Key && prev.Seq <= entry.Seq) {
+							t.Errorf("out of order: %s@%d before %s@%d", prev.Key, prev.Seq, entry.Key, entry.Seq)
+							return
+						}
+					}
+					seen[entry.Key] = true
+				}
+				if len(seen) != keys {
+					t.Errorf("range saw %d of %d keys", len(seen), keys)
+					return
+				}
+			}
+		}()
+	}
+
+	seq := uint64(keys)
+	for round := 1; round <= 200; round++ {
+		for i := 0; i < keys; i++ {
+			seq++
+			s.Put(fmt.Sprintf("k%03d", i), []byte(fmt.Sprint(round)), seq)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// once the readers are gone the next write unlinks what they kept
+	s.Put("k000", []byte("last"), seq+1)
+	if n := s.Len(); n != keys {
+		t.Errorf("expected one version per key, %d linked", n)
+	}
+	if size := s.Size(); size != linkedBytes(s) {
+		t.Errorf("size %d, linked nodes take %d", size, linkedBytes(s))
+	}
+}
+
+func TestSkiplist_BatchInvisibleUntilApplied(t *testing.T) {
+	var s *skiplist
+	checks := 0
+	// retain runs while the batch is being linked, between its inserts
+	retain := func(seq, newer uint64) bool {
+		for _, key := range []string{"a", "b", "c"} {
+			if entry, ok := s.GetEntry(key); !ok || entry.Seq > 3 {
+				t.Errorf("%s half applied: %+v %v", key, entry, ok)
+			}
+		}
+		if entries := s.Range("", ""); len(entries) != 3 {
+			t.Errorf("range sees part of the batch: %+v", entries)
+		}
+		if rts := s.RangeTombstones(); len(rts) != 0 {
+			t.Errorf("range tombstone visible before its batch: %+v", rts)
+		}
+		checks++
+		return false
+	}
+	s = NewSkiplistWithRetention(1<<20, retain).(*skiplist)
+	s.Apply([]common.KVEntry{
+		{Key: "a", Value: []byte("1"), Seq: 1},
+		{Key: "b", Value: []byte("1"), Seq: 2},
+		{Key: "c", Value: []byte("1"), Seq: 3},
+	})
+	checks = 0
+
+	s.ApplyWithRanges([]common.KVEntry{
+		{Key: "a", Value: []byte("2"), Seq: 4},
+		{Key: "b", Value: []byte("2"), Seq: 5},
+		{Key: "c", Value: []byte("2"), Seq: 6},
+	}, []common.RangeTombstone{{Start: "x", End: "z", Seq: 7}})
+	if checks == 0 {
+		t.Fatal("retention never consulted during the batch")
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if val, ok := s.Get(key); !ok || string(val) != "2" {
+			t.Errorf("%s after the batch: %q %v", key, val, ok)
+		}
+	}
+	if rts := s.RangeTombstones(); len(rts) != 1 || rts[0].Seq != 7 {
+		t.Errorf("range tombstone after the batch: %+v", rts)
+	}
+}
+
+func TestSkiplist_NewestFirstAndRetention(t *testing.T) {
+	s := NewSkiplist(1 << 20)
+	s.Put("a", []byte("2"), 2)
+	s.Put("a", []byte("1"), 1) // late, hidden by seq 2
+	if entry, ok := s.GetEntry("a"); !ok || entry.Seq != 2 || s.Len() != 1 {
+		t.Fatalf("late write not hidden: %+v, %d entries", entry, s.Len())
+	}
+	s.Put("a", []byte("3"), 3)
+	if _, ok := s.GetEntryAt("a", 2); ok || s.Len() != 1 {
+		t.Errorf("replaced version kept without a snapshot, %d entries", s.Len())
+	}
+	s.Put("a", []byte("3 again"), 3) // the same write replayed
+	if val, _ := s.Get("a"); string(val) != "3 again" || s.Len() != 1 {
+		t.Errorf("replay of seq 3: %q, %d entries", val, s.Len())
+	}
+
+	// a merge operand keeps the versions under it
+	s.Apply([]common.KVEntry{{Key: "m", Value: []byte("+1"), Seq: 5, Merge: true}})
+	s.Put("m", []byte("base"), 4)
+	if entries := s.Range("m", "n"); len(entries) != 2 || entries[0].Seq != 5 || entries[1].Seq != 4 {
+		t.Errorf("merge operand and its base: %+v", entries)
+	}
+
+	// a snapshot at 15 keeps the version it reads next to the newer one
+	snapshot := uint64(15)
+	kept := NewSkiplistWithRetention(1<<20, func(seq, newer uint64) bool {
+		return seq <= snapshot && snapshot < newer
+	})
+	kept.Put("b", []byte("10"), 10)
+	kept.Put("b", []byte("20"), 20)
+	kept.Put("b", []byte("30"), 30) // 20 has no reader left
+	entries := kept.Range("", "")
+	if len(entries) != 2 || entries[0].Seq != 30 || entries[1].Seq != 10 {
+		t.Fatalf("expected b@30 then b@10, got %+v", entries)
+	}
+	if entry, ok := kept.GetEntryAt("b", snapshot); !ok || entry.Seq != 10 {
+		t.Errorf("snapshot read: %+v %v", entry, ok)
+	}
+	if entry, _ := kept.GetEntry("b"); entry.Seq != 30 {
+		t.Errorf("latest read: %+v", entry)
+	}
+}
+
+func TestSkiplist_OverwriteChargesOnlyTheLiveVersion(t *testing.T) {
+	s := NewSkiplist(4096).(*skiplist)
+	s.Put("key", []byte("short"), 1)
+	if size := s.Size(); size != linkedBytes(s) || size < entrySize(common.KVEntry{Key: "key", Value: []byte("short")}) {
+		t.Fatalf("size %d after one put", size)
+	}
+
+	// far more than the budget in total, but only one version at a time
+	value := []byte(strings.Repeat("v", 200))
+	for seq := uint64(2); seq <= 100; seq++ {
+		s.Put("key", value, seq)
+	}
+	if s.Len() != 1 {
+		t.Errorf("overwrites left %d versions", s.Len())
+	}
+	if size := s.Size(); size != linkedBytes(s) {
+		t.Errorf("size %d, the one version takes %d", size, linkedBytes(s))
+	}
+	if s.ShouldFlush() {
+		t.Errorf("overwriting one key filled a %d byte budget: %d", s.maxBytes, s.Size())
+	}
+
+	s.Delete("key", 101)
+	if size := s.Size(); size != linkedBytes(s) || s.Len() != 1 {
+		t.Errorf("tombstone over the value: size %d, linked %d, %d entries", size, linkedBytes(s), s.Len())
+	}
+}
@@ -0,0 +1,119 @@
+package merge
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNoMergeOperator = errors.New("merge: no merge operator configured")
+	ErrBadOperand      = errors.New("merge: malformed operand or value")
+)
+
+// MergeOperator folds the operands Engine.Merge writes into a key's value.
+// Reads fold a key's operands every time, compaction folds them once it
+// finds the value under them, sometimes only part of them, so the result
+// has to be the same however the operands are split across calls:
+// FullMerge(FullMerge(v, a), b) == FullMerge(v, a+b).
+type MergeOperator interface {
+	// FullMerge applies operands, oldest first, to existing, which is nil
+	// when the key has no value: never written, deleted or expired.
+	FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// Int64Add adds operands to the value, all of them int64s as written by
+// EncodeInt64. A missing value counts as 0.
+func Int64Add() MergeOperator {
+	return int64Add{}
+}
+
+// Int64Max keeps the largest of the value and the operands, all of them
+// int64s as written by EncodeInt64.
+func Int64Max() MergeOperator {
+	return int64Max{}
+}
+
+// StringAppend appends each operand to the value, sep in between. A
+// missing value starts out as the first operand.
+func StringAppend(sep string) MergeOperator {
+	return stringAppend{sep: sep}
+}
+
+// EncodeInt64 is the value and operand format of Int64Add and Int64Max,
+// 8 bytes big endian.
+func EncodeInt64(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	return buf
+}
+
+func DecodeInt64(buf []byte) (int64, error) {
+	if len(buf) != 8 {
+		return 0, fmt.Errorf("%w: %d bytes, want 8", ErrBadOperand, len(buf))
+	}
+	return int64(binary.BigEndian.Uint64(buf)), nil
+}
+
+type int64Add struct{}
+
+func (int64Add) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int64
+	if existing != nil {
+		v, err := DecodeInt64(existing)
+		if err != nil {
+			return nil, err
+		}
+		sum = v
+	}
+	for _, op := range operands {
+		v, err := DecodeInt64(op)
+		if err != nil {
+			return nil, err
+		}
+		sum += v
+	}
+	return EncodeInt64(sum), nil
+}
+
+type int64Max struct{}
+
+func (int64Max) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	var max int64
+	have := existing != nil
+	if have {
+		v, err := DecodeInt64(existing)
+		if err != nil {
+			return nil, err
+		}
+		max = v
+	}
+	for _, op := range operands {
+		v, err := DecodeInt64(op)
+		if err != nil {
+			return nil, err
+		}
+		if !have || v > max {
+			max, have = v, true
+		}
+	}
+	return EncodeInt64(max), nil
+}
+
+type stringAppend struct {
+	sep string
+}
+
+func (s stringAppend) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	result := append([]byte(nil), existing...)
+	for i, op := range operands {
+		if existing != nil || i > 0 {
+			result = append(result, s.sep...)
+		}
+		result = append(result, op...)
+	}
+	if result == nil {
+		result = []byte{}
+	}
+	return result, nil
+}
@@ -0,0 +1,158 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func ints(vs ...int64) [][]byte {
+	ops := make([][]byte, len(vs))
+	for i, v := range vs {
+		ops[i] = EncodeInt64(v)
+	}
+	return ops
+}
+
+func TestEncodeDecodeInt64(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 42, math.MaxInt64, math.MinInt64} {
+		buf := EncodeInt64(v)
+		if len(buf) != 8 {
+			t.Fatalf("%d encoded to %d bytes", v, len(buf))
+		}
+		got, err := DecodeInt64(buf)
+		if err != nil || got != v {
+			t.Errorf("round trip of %d: %d, %v", v, got, err)
+		}
+	}
+	for _, bad := range [][]byte{nil, {}, {1, 2, 3}, make([]byte, 9)} {
+		if _, err := DecodeInt64(bad); !errors.Is(err, ErrBadOperand) {
+			t.Errorf("decode of %d bytes: got %v", len(bad), err)
+		}
+	}
+}
+
+func TestInt64Add(t *testing.T) {
+	op := Int64Add()
+	for _, tc := range []struct {
+		name     string
+		existing []byte
+		operands [][]byte
+		want     int64
+	}{
+		{"no value", nil, ints(1, 2, 3), 6},
+		{"no value no operands", nil, nil, 0},
+		{"value", EncodeInt64(10), ints(5, -20), -5},
+		{"wraps around", EncodeInt64(math.MaxInt64), ints(1), math.MinInt64},
+	} {
+		got, err := op.FullMerge("k", tc.existing, tc.operands)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if v, _ := DecodeInt64(got); v != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, v, tc.want)
+		}
+	}
+
+	// an empty value is there but isn't an int64, unlike a missing one
+	if _, err := op.FullMerge("k", []byte{}, ints(1)); !errors.Is(err, ErrBadOperand) {
+		t.Errorf("empty value: got %v", err)
+	}
+	if _, err := op.FullMerge("k", EncodeInt64(1), [][]byte{EncodeInt64(2), []byte("3")}); !errors.Is(err, ErrBadOperand) {
+		t.Errorf("malformed operand: got %v", err)
+	}
+}
+
+func TestInt64Max(t *testing.T) {
+	op := Int64Max()
+	for _, tc := range []struct {
+		name     string
+		existing []byte
+		operands [][]byte
+		want     int64
+	}{
+		{"no value", nil, ints(3, 9, 4), 9},
+		{"no value negative operands", nil, ints(-7, -3, -5), -3},
+		{"value wins", EncodeInt64(100), ints(3, 9), 100},
+		{"operand wins", EncodeInt64(-100), ints(-50), -50},
+		{"no operands", EncodeInt64(-8), nil, -8},
+	} {
+		got, err := op.FullMerge("k", tc.existing, tc.operands)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if v, _ := DecodeInt64(got); v != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, v, tc.want)
+		}
+	}
+
+	if _, err := op.FullMerge("k", []byte{}, ints(1)); !errors.Is(err, ErrBadOperand) {
+		t.Errorf("empty value: got %v", err)
+	}
+	if _, err := op.FullMerge("k", nil, [][]byte{EncodeInt64(2), {0xff}}); !errors.Is(err, ErrBadOperand) {
+		t.Errorf("malformed operand: got %v", err)
+	}
+}
+
+func TestStringAppend(t *testing.T) {
+	op := StringAppend(",")
+	for _, tc := range []struct {
+		name     string
+		existing []byte
+		operands [][]byte
+		want     string
+	}{
+		{"no value", nil, [][]byte{[]byte("a"), []byte("b")}, "a,b"},
+		{"empty value", []byte{}, [][]byte{[]byte("a")}, ",a"},
+		{"value", []byte("x"), [][]byte{[]byte("a"), []byte("b")}, "x,a,b"},
+		{"empty operand", []byte("x"), [][]byte{{}}, "x,"},
+		{"no value no operands", nil, nil, ""},
+	} {
+		got, err := op.FullMerge("k", tc.existing, tc.operands)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got == nil || string(got) != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// the value may sit in a larger buffer, appending must not write past it
+	buf := []byte("x.......")
+	op.FullMerge("k", buf[:1], [][]byte{[]byte("a")})
+	if string(buf) != "x......." {
+		t.Errorf("merge wrote into the existing value's buffer: %q", buf)
+	}
+}
+
+// compaction may fold a key's operands in several goes
+func TestFullMerge_SplitOperands(t *testing.T) {
+	for name, tc := range map[string]struct {
+		op       MergeOperator
+		existing []byte
+		operands [][]byte
+	}{
+		"Int64Add":     {Int64Add(), nil, ints(4, -9, 12, 1)},
+		"Int64Max":     {Int64Max(), nil, ints(-4, -9, -12, -1)},
+		"StringAppend": {StringAppend("/"), nil, [][]byte{[]byte("a"), []byte("b"), []byte("c")}},
+	} {
+		whole, err := tc.op.FullMerge("k", tc.existing, tc.operands)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for split := 1; split < len(tc.operands); split++ {
+			part, err := tc.op.FullMerge("k", tc.existing, tc.operands[:split])
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got, err := tc.op.FullMerge("k", part, tc.operands[split:])
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(got, whole) {
+				t.Errorf("%s split at %d: %q, in one go %q", name, split, got, whole)
+			}
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package metadata
+
+import (
+	"amethyst/internal/common"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// edits recorded in the manifest
+const (
+	editAddSegment byte = iota + 1
+	editObsoleteSegment
+	editStats
+	editReplace // adds and obsoletes applied together, see LogReplace
+)
+
+// number of edits appended before the manifest is rewritten down to the live set
+const ManifestRewriteEdits = 1024
+
+var errBadEdit = errors.New("manifest: malformed edit")
+
+// ErrCorrupt is a record that fails its checksum with more records after
+// it, so it isn't the torn tail of a crashed append
+var ErrCorrupt = errors.New("manifest: corrupt record")
+
+// Manifest is an append-only log of segment lifecycle edits. Replaying it
+// gives back the live segment set, in registration order, with the last
+// recorded stats.
+type Manifest interface {
+	LogAdd(meta *common.SegmentMeta) error
+	LogObsolete(id string) error
+	// LogReplace records adds and obsoletes as one edit, replay applies all
+	// of them or, if the append was torn, none
+	LogReplace(adds []*common.SegmentMeta, obsolete []string) error
+	LogStats(segs []*common.SegmentMeta) error
+	Replay() ([]*common.SegmentMeta, error)
+	Rewrite(live []*common.SegmentMeta) error
+	Edits() int
+	Close() error
+}
+
+type diskManifest struct {
+	file  *os.File
+	path  string
+	edits int //edits appended since the last rewrite
+	mu    sync.Mutex
+}
+
+// opens (or creates) the manifest at path
+func NewManifest(path string) (Manifest, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &diskManifest{file: f, path: path}, nil
+}
+
+func (m *diskManifest) LogAdd(meta *common.SegmentMeta) error {
+	return m.append(encodeAdd(meta))
+}
+
+func (m *diskManifest) LogObsolete(id string) error {
+	buf := []byte{editObsoleteSegment}
+	buf = appendString(buf, id)
+	return m.append(buf)
+}
+
+// Format: Count(4) then per edit Len(4)| Payload of an add or obsolete edit
+func (m *diskManifest) LogReplace(adds []*common.SegmentMeta, obsolete []string) error {
+	buf := []byte{editReplace}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(adds)+len(obsolete)))
+	for _, seg := range adds {
+		buf = appendString(buf, string(encodeAdd(seg)))
+	}
+	for _, id := range obsolete {
+		buf = appendString(buf, string(appendString([]byte{editObsoleteSegment}, id)))
+	}
+	return m.append(buf)
+}
+
+func (m *diskManifest) LogStats(segs []*common.SegmentMeta) error {
+	buf := []byte{editStats}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(segs)))
+	for _, seg := range segs {
+		buf = appendString(buf, seg.ID)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(seg.ReadCount))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(seg.WriteCount))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(seg.LastRewriteAt))
+	}
+	return m.append(buf)
+}
+
+func (m *diskManifest) Edits() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.edits
+}
+
+// Format: Len(4)| CRC32(4)| Payload, payload starts with the edit type
+func (m *diskManifest) append(payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.file.Write(frame(payload)); err != nil {
+		return err
+	}
+	m.edits++
+	return m.file.Sync()
+}
+
+// Replay rebuilds the live set. A torn or corrupt last record is the tail
+// of a crashed append and ends the log; a corrupt record before others fails
+// with ErrCorrupt, the edits after it can't be applied without it.
+func (m *diskManifest) Replay() ([]*common.SegmentMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	stat, err := m.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+
+	segs := make(map[string]*common.SegmentMeta)
+	var order []string
+
+	var good int64 //end of the last intact record
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(m.file, header); err != nil {
+			break //EOF or torn header
+		}
+		n := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		if good+8+int64(n) > size {
+			break //length runs past the end of the file
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(m.file, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != sum || len(payload) == 0 {
+			if good+8+int64(n) == size {
+				break
+			}
+			return nil, fmt.Errorf("record at offset %d: %w", good, ErrCorrupt)
+		}
+
+		if err := applyEdit(payload, segs, &order); err != nil {
+			return nil, err
+		}
+		good += 8 + int64(n)
+	}
+
+	// cut off a torn tail so new edits don't land behind garbage
+	if size > good {
+		if err := m.file.Truncate(good); err != nil {
+			return nil, err
+		}
+	}
+
+	live := make([]*common.SegmentMeta, 0, len(order))
+	for _, id := range order {
+		if seg, ok := segs[id]; ok {
+			live = append(live, seg)
+		}
+	}
+	return live, nil
+}
+
+// Rewrite replaces the log with one add edit per live segment, written to a
+// temp file first and renamed over the old manifest.
+func (m *diskManifest) Rewrite(live []*common.SegmentMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tmpPath := m.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, seg := range live {
+		if _, err := tmp.Write(frame(encodeAdd(seg))); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(m.path))
+
+	// swap the append handle over to the new file
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	m.file.Close()
+	m.file = f
+	m.edits = 0
+	return nil
+}
+
+func (m *diskManifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.file.Close()
+}
+
+func applyEdit(payload []byte, segs map[string]*common.SegmentMeta, order *[]string) error {
+	d := &decoder{buf: payload[1:]}
+
+	switch payload[0] {
+	case editAddSegment:
+		seg := &common.SegmentMeta{
+			ID:                d.str(),
+			Offset:            d.i64(),
+			Length:            d.i64(),
+			MinKey:            d.str(),
+			MaxKey:            d.str(),
+			Strategy:          common.CompactionType(d.u8()),
+			ReadCount:         d.i64(),
+			WriteCount:        d.i64(),
+			CreatedAt:         d.i64(),
+			LastRewriteAt:     d.i64(),
+			DataStartOffset:   d.i64(),
+			SparseIndexOffset: d.i64(),
+			MaxSeq:            uint64(d.i64()),
+		}
+		if d.err {
+			return errBadEdit
+		}
+		if _, seen := segs[seg.ID]; !seen {
+			*order = append(*order, seg.ID)
+		}
+		segs[seg.ID] = seg
+
+	case editObsoleteSegment:
+		id := d.str()
+		if d.err {
+			return errBadEdit
+		}
+		delete(segs, id)
+
+	case editReplace:
+		n := d.u32()
+		for i := uint32(0); i < n && !d.err; i++ {
+			edit := d.take(int(d.u32()))
+			if d.err {
+				break
+			}
+			if len(edit) == 0 || (edit[0] != editAddSegment && edit[0] != editObsoleteSegment) {
+				return errBadEdit
+			}
+			if err := applyEdit(edit, segs, order); err != nil {
+				return err
+			}
+		}
+		if d.err {
+			return errBadEdit
+		}
+
+	case editStats:
+		n := d.u32()
+		for i := uint32(0); i < n && !d.err; i++ {
+			id := d.str()
+			reads, writes, rewrite := d.i64(), d.i64(), d.i64()
+			if seg, ok := segs[id]; ok {
+				seg.ReadCount = reads
+				seg.WriteCount = writes
+				seg.LastRewriteAt = rewrite
+			}
+		}
+		if d.err {
+			return errBadEdit
+		}
+
+	default:
+		return errBadEdit
+	}
+	return nil
+}
+
+func encodeAdd(meta *common.SegmentMeta) []byte {
+	buf := []byte{editAddSegment}
+	buf = appendString(buf, meta.ID)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(meta.Offset))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(meta.Length))
+	buf = appendString(buf, meta.MinKey)
+	buf = appendString(buf, meta.MaxKey)
+	buf = append(buf, byte(meta.Strategy))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(meta.ReadCount))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(meta.WriteCount))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(meta.CreatedAt))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(meta.LastRewriteAt))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(meta.DataStartOffset))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(meta.SparseIndexOffset))
+	buf = binary.BigEndian.AppendUint64(buf, meta.MaxSeq)
+	return buf
+}
+
+func frame(payload []byte) []byte {
+	buf := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// fsyncs a directory so a rename inside it survives a crash
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// decoder reads big-endian fields and remembers if it ran off the end
+type decoder struct {
+	buf []byte
+	err bool
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err || len(d.buf) < n {
+		d.err = true
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) i64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) str() string {
+	n := d.u32()
+	return string(d.take(int(n)))
+}
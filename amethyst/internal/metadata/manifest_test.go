@@ -0,0 +1,214 @@
+package metadata
+
+import (
+	"amethyst/internal/common"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openManifest(t *testing.T, path string) Manifest {
+	t.Helper()
+	m, err := NewManifest(path)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func seg(id string, maxSeq uint64) *common.SegmentMeta {
+	return &common.SegmentMeta{ID: id, MinKey: "a", MaxKey: "z", Strategy: common.LEVELED, MaxSeq: maxSeq}
+}
+
+func liveIDs(segs []*common.SegmentMeta) []string {
+	ids := make([]string, len(segs))
+	for i, s := range segs {
+		ids[i] = s.ID
+	}
+	return ids
+}
+
+func equalIDs(got []*common.SegmentMeta, want ...string) bool {
+	ids := liveIDs(got)
+	if len(ids) != len(want) {
+		return false
+	}
+	for i := range ids {
+		if ids[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestManifest_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MANIFEST")
+	m := openManifest(t, path)
+	for _, s := range []*common.SegmentMeta{seg("s1", 1), seg("s2", 2), seg("s3", 3)} {
+		if err := m.LogAdd(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.LogObsolete("s2"); err != nil {
+		t.Fatal(err)
+	}
+	stats := seg("s3", 3)
+	stats.ReadCount, stats.WriteCount, stats.LastRewriteAt = 7, 8, 9
+	if err := m.LogStats([]*common.SegmentMeta{stats}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Edits() != 5 {
+		t.Errorf("expected 5 edits, got %d", m.Edits())
+	}
+
+	live, err := openManifest(t, path).Replay()
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if !equalIDs(live, "s1", "s3") {
+		t.Fatalf("expected s1 and s3 in registration order, got %v", liveIDs(live))
+	}
+	if s := live[1]; s.MaxSeq != 3 || s.ReadCount != 7 || s.WriteCount != 8 || s.LastRewriteAt != 9 || s.MaxKey != "z" {
+		t.Errorf("s3 replayed as %+v", s)
+	}
+}
+
+func TestManifest_TornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MANIFEST")
+	m := openManifest(t, path)
+	m.LogAdd(seg("s1", 1))
+	m.LogAdd(seg("s2", 2))
+	stat, _ := os.Stat(path)
+	intact := stat.Size()
+
+	// whole, but failing its checksum: it ends exactly at the end of the file
+	corrupt := frame(encodeAdd(seg("s3", 3)))
+	corrupt[len(corrupt)-1] ^= 0x01
+
+	for name, tail := range map[string][]byte{
+		"torn header":       {0, 0},
+		"length past eof":   frame(encodeAdd(seg("s3", 3)))[:20],
+		"bad last record":   corrupt,
+		"empty last record": frame(nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := os.Truncate(path, intact); err != nil {
+				t.Fatal(err)
+			}
+			f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+			f.Write(tail)
+			f.Close()
+
+			m := openManifest(t, path)
+			live, err := m.Replay()
+			if err != nil {
+				t.Fatalf("replay failed: %v", err)
+			}
+			if !equalIDs(live, "s1", "s2") {
+				t.Fatalf("expected the two intact adds, got %v", liveIDs(live))
+			}
+			// the tail is cut, so a new edit is readable after the old ones
+			if stat, _ := os.Stat(path); stat.Size() != intact {
+				t.Errorf("tail not cut: %d bytes, %d intact", stat.Size(), intact)
+			}
+			m.LogAdd(seg("s4", 4))
+			if live, err := openManifest(t, path).Replay(); err != nil || !equalIDs(live, "s1", "s2", "s4") {
+				t.Errorf("edit after the cut tail: %v %v", liveIDs(live), err)
+			}
+		})
+	}
+}
+
+func TestManifest_CorruptRecordBeforeOthers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MANIFEST")
+	m := openManifest(t, path)
+	m.LogAdd(seg("s1", 1))
+	m.LogAdd(seg("s2", 2))
+	m.LogObsolete("s1")
+
+	data, _ := os.ReadFile(path)
+	second := len(frame(encodeAdd(seg("s1", 1))))
+	data[second+10] ^= 0x01 // inside the payload of s2's add
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openManifest(t, path).Replay(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, data) {
+		t.Errorf("replay changed the manifest: %d bytes, was %d", len(after), len(data))
+	}
+}
+
+func TestManifest_LogReplaceIsAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MANIFEST")
+	m := openManifest(t, path)
+	m.LogAdd(seg("s1", 1))
+	m.LogAdd(seg("s2", 2))
+	stat, _ := os.Stat(path)
+	before := stat.Size()
+
+	if err := m.LogReplace([]*common.SegmentMeta{seg("s3", 3), seg("s4", 3)}, []string{"s1", "s2"}); err != nil {
+		t.Fatal(err)
+	}
+	if live, err := openManifest(t, path).Replay(); err != nil || !equalIDs(live, "s3", "s4") {
+		t.Fatalf("after the replace: %v %v", liveIDs(live), err)
+	}
+
+	// wherever the append stopped, none of the replace is applied
+	data, _ := os.ReadFile(path)
+	for _, cut := range []int64{before + 4, before + 8, before + 30, int64(len(data)) - 1} {
+		if err := os.WriteFile(path, data[:cut], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if live, err := openManifest(t, path).Replay(); err != nil || !equalIDs(live, "s1", "s2") {
+			t.Errorf("replace torn at %d: %v %v", cut, liveIDs(live), err)
+		}
+	}
+}
+
+func TestManifest_Rewrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "MANIFEST")
+	m := openManifest(t, path)
+	for _, id := range []string{"s1", "s2", "s3"} {
+		m.LogAdd(seg(id, 1))
+	}
+	m.LogObsolete("s1")
+	m.LogObsolete("s3")
+
+	live, err := m.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live[0].ReadCount = 42
+	if err := m.Rewrite(live); err != nil {
+		t.Fatalf("rewrite failed: %v", err)
+	}
+	if m.Edits() != 0 {
+		t.Errorf("rewrite left %d edits counted", m.Edits())
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+	stat, _ := os.Stat(path)
+	if want := int64(len(frame(encodeAdd(live[0])))); stat.Size() != want {
+		t.Errorf("rewritten manifest is %d bytes, one add is %d", stat.Size(), want)
+	}
+
+	// appends go to the new file
+	if err := m.LogAdd(seg("s4", 2)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := openManifest(t, path).Replay()
+	if err != nil || !equalIDs(got, "s2", "s4") {
+		t.Fatalf("after the rewrite: %v %v", liveIDs(got), err)
+	}
+	if got[0].ReadCount != 42 {
+		t.Errorf("rewrite lost the stats: %+v", got[0])
+	}
+}
@@ -8,33 +8,96 @@ import (
 
 
 type Tracker interface {
-	RegisterSegment(meta *common.SegmentMeta)
+	RegisterSegment(meta *common.SegmentMeta) error
+	GetSegment(id string) (*common.SegmentMeta, bool)
 	GetSegmentsForKey(key string) []*common.SegmentMeta
 	GetAllSegments() []*common.SegmentMeta
+	// CopyLiveSegments is GetAllSegments returning copies, taken under the
+	// lock, for code reading stats and flags while reads and compactions
+	// keep changing the tracker's own
+	CopyLiveSegments() []*common.SegmentMeta
 	GetOverlappingSegments(target *common.SegmentMeta) []*common.SegmentMeta
 
-	MarkObsolete(id string)
+	// CurrentVersion returns the live segment set with a reference taken,
+	// the caller must Unref it. Reads that touch segment data go through a
+	// version so compaction can't delete a segment under them.
+	CurrentVersion() *Version
+	// Pinned returns every segment some referenced version holds, obsolete
+	// ones whose last reader hasn't finished included
+	Pinned() []*common.SegmentMeta
+	// SetReleaseHook sets the function called, outside the tracker's lock,
+	// with each obsolete segment once no version holds it
+	SetReleaseHook(fn func(seg *common.SegmentMeta))
+
+	MarkObsolete(id string) error
+	// ReplaceSegments swaps a compaction's inputs for its outputs in one
+	// step, so readers never see both or neither
+	ReplaceSegments(inputs []*common.SegmentMeta, outputs []*common.SegmentMeta) error
 	UpdateStats(id string, reads int64, writes int64)
+	SnapshotStats() error
 }
 
 type tracker struct {
 	mu       sync.RWMutex // Use RWMutex for better read performance
 	segments map[string]*common.SegmentMeta
 	ordered  []*common.SegmentMeta
+	manifest Manifest // nil for a purely in-memory tracker
+
+	current   *Version
+	pinned    map[string]int        // segment ID -> versions holding it
+	released  []*common.SegmentMeta // waiting for the hook until t.mu is unlocked
+	onRelease func(seg *common.SegmentMeta)
 }
 
 // NewTracker creates a new MetadataTracker.
 func NewTracker() Tracker {
-	return &tracker{
+	t := &tracker{
 		segments: make(map[string]*common.SegmentMeta),
 		ordered:  make([]*common.SegmentMeta, 0),
+		pinned:   make(map[string]int),
 	}
+	t.installVersion()
+	return t
 }
 
-func (t *tracker) RegisterSegment(meta *common.SegmentMeta) {
+// OpenTracker replays the manifest into a new tracker and writes every later
+// register/obsolete through to it. Replayed segments carry offsets, key range,
+// strategy and stats; the sparse index has to be reattached from the data file.
+func OpenTracker(m Manifest) (Tracker, error) {
+	live, err := m.Replay()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tracker{
+		segments: make(map[string]*common.SegmentMeta),
+		ordered:  make([]*common.SegmentMeta, 0, len(live)),
+		pinned:   make(map[string]int),
+	}
+	for _, seg := range live {
+		t.register(seg)
+	}
+	t.installVersion()
+	t.manifest = m
+	return t, nil
+}
+
+func (t *tracker) RegisterSegment(meta *common.SegmentMeta) error {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	defer t.unlockAndRelease()
 
+	if t.manifest != nil {
+		if err := t.manifest.LogAdd(meta); err != nil {
+			return err
+		}
+	}
+	t.register(meta)
+	t.installVersion()
+	return t.maybeRewrite()
+}
+
+// caller holds t.mu
+func (t *tracker) register(meta *common.SegmentMeta) {
 	var overlaps int64
 	for _, other := range t.segments {
 		if other.Obsolete {
@@ -73,31 +136,22 @@ func (t *tracker) GetOverlappingSegments(target *common.SegmentMeta) []*common.S
 	return overlaps
 }
 
+// GetSegmentsForKey is CurrentVersion().SegmentsForKey(key) without the
+// reference: the segments may be deleted by the time they are read.
 func (t *tracker) GetSegmentsForKey(key string) []*common.SegmentMeta {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	result := make([]*common.SegmentMeta, 0)
-	for _, seg := range t.ordered {
-		if seg.Obsolete {
-			continue
-		}
-		if key >= seg.MinKey && key <= seg.MaxKey {
-			result = append(result, seg)
-		}
-	}
-	return result
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.current.SegmentsForKey(key)
 }
 
+// GetAllSegments returns the current live set sorted by MinKey, without
+// holding a version; see GetSegmentsForKey.
 func (t *tracker) GetAllSegments() []*common.SegmentMeta {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 	
-	result := make([]*common.SegmentMeta, 0, len(t.ordered))
-	for _, seg := range t.ordered {
-		if !seg.Obsolete {
-			result = append(result, seg)
-		}
-	}
+	result := make([]*common.SegmentMeta, len(t.current.segments))
+	copy(result, t.current.segments)
 	
 	// Sort by MinKey while holding the lock
 	sort.Slice(result, func(i, j int) bool {
@@ -107,12 +161,98 @@ func (t *tracker) GetAllSegments() []*common.SegmentMeta {
 	return result
 }
 
-func (t *tracker) MarkObsolete(id string) {
+func (t *tracker) CopyLiveSegments() []*common.SegmentMeta {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := make([]*common.SegmentMeta, len(t.current.segments))
+	for i, seg := range t.current.segments {
+		cp := *seg
+		result[i] = &cp
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].MinKey < result[j].MinKey
+	})
+	return result
+}
+
+func (t *tracker) CurrentVersion() *Version {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	t.current.Ref()
+	return t.current
+}
+
+func (t *tracker) Pinned() []*common.SegmentMeta {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := make([]*common.SegmentMeta, 0, len(t.pinned))
+	for id := range t.pinned {
+		result = append(result, t.segments[id])
+	}
+	return result
+}
+
+func (t *tracker) SetReleaseHook(fn func(seg *common.SegmentMeta)) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	if seg, ok := t.segments[id]; ok {
-		seg.Obsolete = true
+	t.onRelease = fn
+}
+
+func (t *tracker) GetSegment(id string) (*common.SegmentMeta, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	seg, ok := t.segments[id]
+	return seg, ok
+}
+
+func (t *tracker) MarkObsolete(id string) error {
+	t.mu.Lock()
+	defer t.unlockAndRelease()
+	seg, ok := t.segments[id]
+	if !ok || seg.Obsolete {
+		return nil
+	}
+	if t.manifest != nil {
+		if err := t.manifest.LogObsolete(id); err != nil {
+			return err
+		}
+	}
+	seg.Obsolete = true
+	t.installVersion()
+	return t.maybeRewrite()
+}
+
+// The outputs and the inputs' obsoletion go to the manifest as one edit:
+// compaction may rewrite a version under the same Seq, folding merge
+// operands or through a compaction filter, so a crash must never leave
+// inputs and outputs live together. Overlap counts of the outputs are taken
+// against the set without the inputs.
+func (t *tracker) ReplaceSegments(inputs []*common.SegmentMeta, outputs []*common.SegmentMeta) error {
+	t.mu.Lock()
+	defer t.unlockAndRelease()
+
+	if t.manifest != nil {
+		var obsolete []string
+		for _, seg := range inputs {
+			if cur, ok := t.segments[seg.ID]; ok && !cur.Obsolete {
+				obsolete = append(obsolete, seg.ID)
+			}
+		}
+		if err := t.manifest.LogReplace(outputs, obsolete); err != nil {
+			return err
+		}
+	}
+
+	for _, seg := range inputs {
+		if cur, ok := t.segments[seg.ID]; ok {
+			cur.Obsolete = true
+		}
+	}
+	for _, seg := range outputs {
+		t.register(seg)
 	}
+	t.installVersion()
+	return t.maybeRewrite()
 }
 
 func (t *tracker) UpdateStats(id string, reads int64, writes int64) {
@@ -123,3 +263,35 @@ func (t *tracker) UpdateStats(id string, reads int64, writes int64) {
 		seg.WriteCount += writes
 	}
 }
+
+
+// SnapshotStats records the read/write counters of every live segment so the
+// adaptive controller picks up where it left off after a restart.
+func (t *tracker) SnapshotStats() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.manifest == nil {
+		return nil
+	}
+	return t.manifest.LogStats(t.live())
+}
+
+// rewrites the manifest down to the live set once enough edits piled up.
+// caller holds t.mu
+func (t *tracker) maybeRewrite() error {
+	if t.manifest == nil || t.manifest.Edits() < ManifestRewriteEdits {
+		return nil
+	}
+	return t.manifest.Rewrite(t.live())
+}
+
+// live segments, oldest registration first. caller holds t.mu
+func (t *tracker) live() []*common.SegmentMeta {
+	result := make([]*common.SegmentMeta, 0, len(t.ordered))
+	for i := len(t.ordered) - 1; i >= 0; i-- {
+		if !t.ordered[i].Obsolete {
+			result = append(result, t.ordered[i])
+		}
+	}
+	return result
+}
@@ -0,0 +1,47 @@
+package metadata
+
+import (
+	"amethyst/internal/common"
+	"sort"
+	"testing"
+)
+
+func TestTracker_ReleasedSegmentsLeave(t *testing.T) {
+	tr := NewTracker().(*tracker)
+	var released []string
+	tr.SetReleaseHook(func(seg *common.SegmentMeta) { released = append(released, seg.ID) })
+	s1, s2 := seg("s1", 1), seg("s2", 2)
+	tr.RegisterSegment(s1)
+	tr.RegisterSegment(s2)
+
+	// a reader still holds both inputs
+	v := tr.CurrentVersion()
+	if err := tr.ReplaceSegments([]*common.SegmentMeta{s1, s2}, []*common.SegmentMeta{seg("s3", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tr.GetSegment("s1"); !ok || len(released) != 0 || len(tr.Pinned()) != 3 {
+		t.Fatalf("inputs let go of under a reader: released %v, %d pinned", released, len(tr.Pinned()))
+	}
+
+	v.Unref()
+	sort.Strings(released)
+	if len(released) != 2 || released[0] != "s1" || released[1] != "s2" {
+		t.Fatalf("expected s1 and s2 released, got %v", released)
+	}
+	for _, id := range []string{"s1", "s2"} {
+		if _, ok := tr.GetSegment(id); ok {
+			t.Errorf("%s still tracked after its release", id)
+		}
+	}
+	if len(tr.segments) != 1 || len(tr.ordered) != 1 || tr.ordered[0].ID != "s3" {
+		t.Errorf("expected only s3 left, got %d segments, ordered %v", len(tr.segments), liveIDs(tr.ordered))
+	}
+
+	// with no reader the release is immediate
+	if err := tr.MarkObsolete("s3"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.segments) != 0 || len(tr.ordered) != 0 || len(released) != 3 {
+		t.Errorf("s3 kept after it was made obsolete: %d segments, released %v", len(tr.segments), released)
+	}
+}
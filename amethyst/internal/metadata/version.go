@@ -0,0 +1,115 @@
+package metadata
+
+import (
+	"amethyst/internal/common"
+	"sync/atomic"
+)
+
+// Version is an immutable set of live segments, newest registration first.
+// Every change to the live set installs a new one; readers take the current
+// one with Tracker.CurrentVersion, read only the segments in it and Unref it
+// when done. A segment made obsolete stays on disk until no referenced
+// version holds it any more, then the tracker's release hook deletes it.
+type Version struct {
+	t        *tracker
+	segments []*common.SegmentMeta
+	refs     atomic.Int32
+}
+
+// Segments returns the segments of the version, newest registration first.
+// The slice is shared and must not be modified.
+func (v *Version) Segments() []*common.SegmentMeta {
+	return v.segments
+}
+
+// SegmentsForKey returns the segments whose key range holds key, newest
+// registration first, in a slice of the caller's own.
+func (v *Version) SegmentsForKey(key string) []*common.SegmentMeta {
+	result := make([]*common.SegmentMeta, 0)
+	for _, seg := range v.segments {
+		if key >= seg.MinKey && key <= seg.MaxKey {
+			result = append(result, seg)
+		}
+	}
+	return result
+}
+
+// Ref takes another reference, each one needs its own Unref.
+func (v *Version) Ref() {
+	v.refs.Add(1)
+}
+
+// Unref drops a reference. The last one lets go of the version's segments.
+func (v *Version) Unref() {
+	if v.refs.Add(-1) > 0 {
+		return
+	}
+	t := v.t
+	t.mu.Lock()
+	defer t.unlockAndRelease()
+	t.dropVersion(v)
+}
+
+// installs the live set as the current version; the tracker holds the one
+// reference to it until the next install. caller holds t.mu
+func (t *tracker) installVersion() {
+	live := make([]*common.SegmentMeta, 0, len(t.ordered))
+	for _, seg := range t.ordered {
+		if !seg.Obsolete {
+			live = append(live, seg)
+			t.pinned[seg.ID]++
+		}
+	}
+	v := &Version{t: t, segments: live}
+	v.refs.Store(1)
+
+	old := t.current
+	t.current = v
+	if old != nil && old.refs.Add(-1) == 0 {
+		t.dropVersion(old)
+	}
+}
+
+// drops the segment references of an unreferenced version. Obsolete
+// segments no version holds any more leave the tracker and are queued for
+// the release hook. caller holds t.mu
+func (t *tracker) dropVersion(v *Version) {
+	var released bool
+	for _, seg := range v.segments {
+		t.pinned[seg.ID]--
+		if t.pinned[seg.ID] > 0 {
+			continue
+		}
+		delete(t.pinned, seg.ID)
+		if seg.Obsolete {
+			delete(t.segments, seg.ID)
+			t.released = append(t.released, seg)
+			released = true
+		}
+	}
+	if !released {
+		return
+	}
+	ordered := t.ordered[:0]
+	for _, seg := range t.ordered {
+		if _, ok := t.segments[seg.ID]; ok {
+			ordered = append(ordered, seg)
+		}
+	}
+	clear(t.ordered[len(ordered):])
+	t.ordered = ordered
+}
+
+// unlocks t.mu and only then runs the release hook, which may call back into
+// the tracker
+func (t *tracker) unlockAndRelease() {
+	released, hook := t.released, t.onRelease
+	t.released = nil
+	t.mu.Unlock()
+	if hook == nil {
+		return
+	}
+	for _, seg := range released {
+		hook(seg)
+	}
+}
@@ -1,46 +1,278 @@
 package read
 
 import (
+	"amethyst/internal/common"
 	"amethyst/internal/memtable"
+	"amethyst/internal/merge"
 	"amethyst/internal/metadata"
 	"amethyst/internal/sstable/reader"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 type Handler struct {
-	memtable memtable.Memtable
-	meta     metadata.Tracker
-	reader   reader.SSTableReader
+	memtables func() []memtable.Memtable // newest first
+	meta      metadata.Tracker
+	reader    reader.SSTableReader
+	operator  merge.MergeOperator // nil if merge operands are an error
+
+	// Bloom filter outcomes, see FilterStats
+	filterMisses         atomic.Uint64
+	filterHits           atomic.Uint64
+	filterFalsePositives atomic.Uint64
+}
+
+// FilterStats counts Bloom filter checks made by Get. A miss skipped the
+// segment without reading it, a hit sent the lookup on to the segment and
+// a false positive is a hit where the segment didn't have the key after all.
+type FilterStats struct {
+	Misses         uint64
+	Hits           uint64
+	FalsePositives uint64
 }
 
 func NewHandler(
 	mem memtable.Memtable,
 	meta metadata.Tracker,
 	reader reader.SSTableReader,
+) *Handler {
+	mems := []memtable.Memtable{mem}
+	return NewHandlerWithMemtables(func() []memtable.Memtable { return mems }, meta, reader)
+}
+
+// NewHandlerWithMemtables reads from every memtable memtables returns, the
+// active one and those waiting to be flushed, newest first. It is called
+// once per lookup, before the segments are pinned.
+func NewHandlerWithMemtables(
+	memtables func() []memtable.Memtable,
+	meta metadata.Tracker,
+	reader reader.SSTableReader,
+) *Handler {
+	return NewHandlerWithMergeOperator(memtables, meta, reader, nil)
+}
+
+// NewHandlerWithMergeOperator is NewHandlerWithMemtables folding the merge
+// operands it finds into values with operator. Without one a key with an
+// operand can't be read.
+func NewHandlerWithMergeOperator(
+	memtables func() []memtable.Memtable,
+	meta metadata.Tracker,
+	reader reader.SSTableReader,
+	operator merge.MergeOperator,
 ) *Handler {
 	return &Handler{
-		memtable: mem,
-		meta:     meta,
-		reader:   reader,
+		memtables: memtables,
+		meta:      meta,
+		reader:    reader,
+		operator:  operator,
 	}
 }
 
-func (h *Handler) Get(key string) ([]byte, bool) {
-	// 1. Memtable first
-	if val, ok := h.memtable.Get(key); ok {
-		return val, true
+// Get returns the newest live value of key. An error means a segment that
+// could hold the key couldn't be read, so the answer is unknown.
+func (h *Handler) Get(key string) ([]byte, bool, error) {
+	return h.GetAt(key, math.MaxUint64)
+}
+
+// GetAt is Get as of a snapshot taken at seq: writes with a higher Seq are
+// ignored. A value past its time to live is gone whatever seq is. Merge
+// operands are folded into the version under them here, on every read.
+func (h *Handler) GetAt(key string, seq uint64) ([]byte, bool, error) {
+	now := time.Now().UnixNano()
+
+	// 1. Memtables first, they always hold the newest writes, and each one
+	// is newer than the next. A range tombstone deletes the versions older
+	// than itself, in its memtable and in every older place.
+	var rangeSeq uint64
+	var chain mergeChain
+	for _, mem := range h.memtables() {
+		if covering := common.CoveringSeq(mem.RangeTombstones(), key, seq); covering > rangeSeq {
+			rangeSeq = covering
+		}
+		entry, ok := mem.GetEntryAt(key, seq)
+		if !ok {
+			continue
+		}
+		if !entry.Merge && len(chain.operands) == 0 {
+			if entry.Tombstone || entry.Seq < rangeSeq || entry.Expired(now) {
+				return nil, false, nil
+			}
+			return entry.Value, true, nil
+		}
+		// an operand needs the versions under it, down to a value
+		for _, version := range mem.Range(key, key+"\x00") {
+			if version.Seq <= seq && chain.add(version, rangeSeq, now) {
+				return h.fold(key, &chain)
+			}
+		}
+	}
+
+	// 2. On-disk segments, of a version pinned for the whole lookup so none
+	// is deleted mid-read. Registration order says nothing about age once
+	// compaction rewrites old data into a new segment, so versions are
+	// compared by Seq. Probing newest MaxSeq first lets us stop as soon as
+	// no remaining segment can hold anything newer than what we have.
+	v := h.meta.CurrentVersion()
+	defer v.Unref()
+
+	// range tombstones reach past their segment's keys, all of them count
+	for _, seg := range v.Segments() {
+		if !seg.RangeDeletes {
+			continue
+		}
+		rts, err := h.reader.RangeTombstones(seg)
+		if err != nil {
+			return nil, false, err
+		}
+		if covering := common.CoveringSeq(rts, key, seq); covering > rangeSeq {
+			rangeSeq = covering
+		}
 	}
 
-	// 2. On-disk segments (newest → oldest)
-	segs := h.meta.GetSegmentsForKey(key)
+	segs := v.SegmentsForKey(key)
+	sort.SliceStable(segs, func(i, j int) bool { return segs[i].MaxSeq > segs[j].MaxSeq })
+	if len(chain.operands) > 0 {
+		return h.foldSegments(segs, key, seq, rangeSeq, now, &chain)
+	}
 
+	var best common.KVEntry
+	found := false
 	for _, seg := range segs {
-		val, ok := h.reader.Get(seg, key)
+		// nothing older than the range tombstone survives it
+		if (found && seg.MaxSeq < best.Seq) || seg.MaxSeq < rangeSeq {
+			break
+		}
+
+		// segments written without a filter always go to the reader
+		filter, err := h.reader.Filter(seg)
+		if err != nil {
+			return nil, false, err
+		}
+		filtered := filter != nil
+		if filtered && !filter.MayContain(key) {
+			h.filterMisses.Add(1)
+			continue
+		}
+
+		entry, ok, err := h.reader.GetAt(seg, key, seq)
+		if err != nil {
+			return nil, false, err
+		}
 		h.meta.UpdateStats(seg.ID, 1, 0)
+		if filtered {
+			h.filterHits.Add(1)
+			if !ok {
+				h.filterFalsePositives.Add(1)
+			}
+		}
 
-		if ok {
-			return val, true
+		if ok && (!found || entry.Seq > best.Seq) {
+			best = entry
+			found = true
 		}
 	}
 
-	return nil, false
+	if found && best.Merge && best.Seq >= rangeSeq {
+		return h.foldSegments(segs, key, seq, rangeSeq, now, &chain)
+	}
+	if !found || best.Tombstone || best.Seq < rangeSeq || best.Expired(now) {
+		return nil, false, nil
+	}
+	return best.Value, true, nil
+}
+
+// mergeChain gathers the versions of a key a merge operand reads, newest
+// first, up to the first one that isn't an operand
+type mergeChain struct {
+	operands [][]byte // newest first
+	base     []byte   // nil if the operands apply to no value
+}
+
+// add takes the next older version and reports whether the chain is
+// complete. A version deleted, range deleted or expired ends it without a
+// base.
+func (c *mergeChain) add(version common.KVEntry, rangeSeq uint64, now int64) bool {
+	switch {
+	case version.Seq < rangeSeq || version.Tombstone || version.Expired(now):
+	case version.Merge:
+		c.operands = append(c.operands, version.Value)
+		return false
+	case version.Value == nil:
+		c.base = []byte{}
+	default:
+		c.base = version.Value
+	}
+	return true
+}
+
+// foldSegments completes chain with the versions of key in segs, all of
+// them: segment order says nothing about age, so they are put in Seq order
+// first. It only runs for keys with merge operands.
+func (h *Handler) foldSegments(segs []*common.SegmentMeta, key string, seq, rangeSeq uint64, now int64,
+	chain *mergeChain) ([]byte, bool, error) {
+	var versions []common.KVEntry
+	for _, seg := range segs {
+		if seg.MaxSeq < rangeSeq {
+			continue // everything in it is range deleted
+		}
+		filter, err := h.reader.Filter(seg)
+		if err != nil {
+			return nil, false, err
+		}
+		if filter != nil && !filter.MayContain(key) {
+			continue
+		}
+		it := h.reader.NewIterator(seg)
+		for ok := it.Seek(key); ok && it.Key() == key; ok = it.Next() {
+			if entry := it.Entry(); entry.Seq <= seq {
+				versions = append(versions, entry)
+			}
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Seq > versions[j].Seq })
+
+	for i, version := range versions {
+		if i > 0 && version.Seq == versions[i-1].Seq {
+			continue // the same version in two segments
+		}
+		if chain.add(version, rangeSeq, now) {
+			break
+		}
+	}
+	return h.fold(key, chain)
+}
+
+// fold applies the operands of a chain to its base
+func (h *Handler) fold(key string, chain *mergeChain) ([]byte, bool, error) {
+	if len(chain.operands) == 0 {
+		return chain.base, chain.base != nil, nil
+	}
+	if h.operator == nil {
+		return nil, false, merge.ErrNoMergeOperator
+	}
+	operands := make([][]byte, len(chain.operands))
+	for i, op := range chain.operands {
+		operands[len(operands)-1-i] = op
+	}
+	value, err := h.operator.FullMerge(key, chain.base, operands)
+	if err != nil {
+		return nil, false, fmt.Errorf("merge failure for key %q: %w", key, err)
+	}
+	return value, true, nil
+}
+
+func (h *Handler) FilterStats() FilterStats {
+	return FilterStats{
+		Misses:         h.filterMisses.Load(),
+		Hits:           h.filterHits.Load(),
+		FalsePositives: h.filterFalsePositives.Load(),
+	}
 }
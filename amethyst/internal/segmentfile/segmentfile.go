@@ -9,7 +9,9 @@ import (
 type SegmentFileManager interface {
 	Append(data []byte) (offset int64, length int64, err error)
 	ReadAt(offset int64, length int64) ([]byte, error)
-	Delete(offset int64) error
+	Remove() error
+	Truncate(size int64) error
+	Close() error
 	GetMmapData() ([]byte, error)
 	ReleaseMmap() error
 }
@@ -123,8 +125,9 @@ func (s *localFileManager) ReleaseMmap() error {
 	return nil
 }
 
-// marks segment for removal
-func (s *localFileManager) Delete(offset int64) error {
+// closes and deletes the whole data file. Segments can't be removed one by
+// one from a shared file, this is for when none of them is live any more.
+func (s *localFileManager) Remove() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -140,3 +143,33 @@ func (s *localFileManager) Delete(offset int64) error {
 
 	return os.Remove(s.path)
 }
+
+// cuts the file back to size, used by recovery to drop a torn trailing segment
+func (s *localFileManager) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isMMapped && s.mmapData != nil {
+		syscall.Munmap(s.mmapData)
+		s.isMMapped = false
+		s.mmapData = nil
+	}
+
+	if err := s.file.Truncate(size); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// unmaps and closes the file
+func (s *localFileManager) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isMMapped && s.mmapData != nil {
+		syscall.Munmap(s.mmapData)
+		s.isMMapped = false
+		s.mmapData = nil
+	}
+	return s.file.Close()
+}
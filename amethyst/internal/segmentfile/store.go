@@ -0,0 +1,201 @@
+package segmentfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// extension of segment files in a store directory
+const SegmentFileExt = ".sst"
+
+var ErrSegmentNotFound = errors.New("segmentfile: segment file not found")
+
+// SegmentStore keeps every segment in a file of its own, <dir>/<id>.sst, so
+// an obsolete segment can be deleted without touching live ones. Files are
+// written once, whole, and only read afterwards. Knowing when a file is no
+// longer read is up to the caller.
+type SegmentStore interface {
+	// Write stores data as the segment id, durably: a crash leaves either
+	// the complete file or none
+	Write(id string, data []byte) error
+	ReadAt(id string, offset int64, length int64) ([]byte, error)
+	Size(id string) (int64, error)
+	// List returns the ids of all segment files in the store
+	List() ([]string, error)
+	Remove(id string) error
+	// DiskUsage is the total size of the segment files in bytes
+	DiskUsage() (int64, error)
+	Close() error
+}
+
+type dirStore struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*os.File // open read handles, opened on first read
+}
+
+// NewSegmentStore opens (or creates) a store in dir. Temp files left by a
+// write that crashed are removed.
+func NewSegmentStore(dir string) (SegmentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmps, err := filepath.Glob(filepath.Join(dir, "*"+SegmentFileExt+".tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+	return &dirStore{
+		dir:   dir,
+		files: make(map[string]*os.File),
+	}, nil
+}
+
+func (s *dirStore) path(id string) string {
+	return filepath.Join(s.dir, id+SegmentFileExt)
+}
+
+func (s *dirStore) Write(id string, data []byte) error {
+	path := s.path(id)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// read handle for id, caller holds s.mu
+func (s *dirStore) open(id string) (*os.File, error) {
+	if f, ok := s.files[id]; ok {
+		return f, nil
+	}
+	f, err := os.Open(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.files[id] = f
+	return f, nil
+}
+
+func (s *dirStore) ReadAt(id string, offset int64, length int64) ([]byte, error) {
+	s.mu.Lock()
+	f, err := s.open(id)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *dirStore) Size(id string) (int64, error) {
+	stat, err := os.Stat(s.path(id))
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("%w: %s", ErrSegmentNotFound, id)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (s *dirStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && strings.HasSuffix(name, SegmentFileExt) {
+			ids = append(ids, strings.TrimSuffix(name, SegmentFileExt))
+		}
+	}
+	return ids, nil
+}
+
+func (s *dirStore) Remove(id string) error {
+	s.mu.Lock()
+	if f, ok := s.files[id]; ok {
+		f.Close()
+		delete(s.files, id)
+	}
+	s.mu.Unlock()
+
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+func (s *dirStore) DiskUsage() (int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), SegmentFileExt) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // removed while we were listing
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+func (s *dirStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for id, f := range s.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, id)
+	}
+	return firstErr
+}
+
+// fsyncs a directory so a rename or unlink inside it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -11,6 +11,9 @@ type SparseIndex struct {
 
 type Builder interface {
 	Build(keys []string, offsets []int64) *SparseIndex
+	// Sample reports whether the i-th record (0-based) of a segment gets an
+	// index entry, for writers that pick entries as records stream by
+	Sample(i int) bool
 }
 
 type builder struct {
@@ -44,6 +47,10 @@ func (b *builder) Build(sortedKeys []string, offsets []int64) *SparseIndex {
 	}
 }
 
+func (b *builder) Sample(i int) bool {
+	return i%b.stride == 0
+}
+
 //seek function to find largest indexed key, for given object <=target
 //if target is smaller than all indexed keys it returns 0 (keep in mind)
 
@@ -0,0 +1,355 @@
+package block
+
+import (
+	"amethyst/internal/common"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Layout of a version 5 (block based) segment:
+//
+//	Preamble:    Magic(4)| Length(8)
+//	Data blocks: records in key order, cut at about BlockSize bytes
+//	Range dels:  optional range tombstones, see EncodeRangeTombstones
+//	Filter:      optional Bloom filter
+//	Index:       one entry per data block, see Index
+//	Properties:  ID, MinKey, MaxKey, strategy, count, MaxSeq
+//	Footer:      Properties, Index, Filter, RangeDel handles| Version(4)| Magic(8)
+//
+// Version 2 is the same without range tombstones, its footer lacks the
+// RangeDel handle. Version 4 records may be expiring ones and version 5
+// ones merge operands, in step with the WAL; a reader of an older version
+// finds no such flag in them, see RecordFlags. Every block carries a
+// trailer of Codec(1)| CRC32C(4), the checksum covering the stored payload
+// and codec.
+// The preamble lets a forward scan of the data file tell these segments
+// apart from the flat ones, versions 0 and 1, whose first four bytes are
+// the length of a UUID; its length field points the scan at the footer.
+
+const (
+	PreambleMagic uint32 = 0x414d5342         // "AMSB"
+	FooterMagic   uint64 = 0x616d657468797374 // "amethyst"
+	Version       uint32 = 5
+
+	PreambleSize = 12
+	FooterSize   = 4*16 + 4 + 8
+	FooterSizeV2 = 3*16 + 4 + 8
+	TrailerSize  = 5
+
+	DefaultBlockSize = 4 * 1024
+)
+
+var (
+	ErrChecksum       = errors.New("sstable: block checksum mismatch")
+	ErrUnknownCodec   = errors.New("sstable: unknown block compression")
+	ErrBadFooter      = errors.New("sstable: bad segment footer")
+	ErrUnknownVersion = errors.New("sstable: unsupported segment version")
+	ErrMalformedBlock = errors.New("sstable: malformed block")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// a compressed block has to save at least 1/minCompressionGain of its size,
+// otherwise it is stored raw
+const minCompressionGain = 8
+
+// Codec is the compression applied to a block.
+type Codec byte
+
+const (
+	NoCompression Codec = iota
+	Flate
+)
+
+// Handle locates a block, Offset being relative to the segment start and
+// Length including the trailer.
+type Handle struct {
+	Offset int64
+	Length int64
+}
+
+// Encode compresses raw with codec (falling back to storing it raw when
+// that doesn't pay off) and appends the trailer.
+func Encode(raw []byte, codec Codec) []byte {
+	payload := raw
+	if codec == Flate {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		w.Write(raw)
+		w.Close()
+		if buf.Len() < len(raw)-len(raw)/minCompressionGain {
+			payload = buf.Bytes()
+		} else {
+			codec = NoCompression
+		}
+	} else {
+		codec = NoCompression
+	}
+
+	out := make([]byte, 0, len(payload)+TrailerSize)
+	out = append(out, payload...)
+	out = append(out, byte(codec))
+	return binary.BigEndian.AppendUint32(out, crc32.Checksum(out, castagnoli))
+}
+
+// Decode checks the trailer of an encoded block and returns its raw contents.
+func Decode(buf []byte) ([]byte, error) {
+	if len(buf) < TrailerSize {
+		return nil, ErrMalformedBlock
+	}
+	n := len(buf) - 4
+	if crc32.Checksum(buf[:n], castagnoli) != binary.BigEndian.Uint32(buf[n:]) {
+		return nil, ErrChecksum
+	}
+	payload := buf[:n-1]
+	switch Codec(buf[n-1]) {
+	case NoCompression:
+		return payload, nil
+	case Flate:
+		r := flate.NewReader(bytes.NewReader(payload))
+		defer r.Close()
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return nil, ErrMalformedBlock
+		}
+		return raw, nil
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
+
+// Index maps data blocks by the last key they hold. Entries are
+// KeyLen(4)| Key| Offset(8)| Length(8).
+type Index struct {
+	LastKeys []string
+	Handles  []Handle
+}
+
+// Find returns the first block whose last key is >= key, which is the only
+// block that can hold key, or len(Handles) if key sorts after everything.
+func (idx *Index) Find(key string) int {
+	return sort.Search(len(idx.LastKeys), func(i int) bool { return idx.LastKeys[i] >= key })
+}
+
+func (idx *Index) Encode() []byte {
+	var buf []byte
+	for i, k := range idx.LastKeys {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(k)))
+		buf = append(buf, k...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(idx.Handles[i].Offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(idx.Handles[i].Length))
+	}
+	return buf
+}
+
+func DecodeIndex(raw []byte) (*Index, error) {
+	idx := &Index{}
+	for len(raw) > 0 {
+		if len(raw) < 4 {
+			return nil, ErrMalformedBlock
+		}
+		n := int(binary.BigEndian.Uint32(raw))
+		if len(raw) < 4+n+16 {
+			return nil, ErrMalformedBlock
+		}
+		idx.LastKeys = append(idx.LastKeys, string(raw[4:4+n]))
+		idx.Handles = append(idx.Handles, Handle{
+			Offset: int64(binary.BigEndian.Uint64(raw[4+n:])),
+			Length: int64(binary.BigEndian.Uint64(raw[12+n:])),
+		})
+		raw = raw[4+n+16:]
+	}
+	return idx, nil
+}
+
+// Properties is the segment header of the flat format, moved to its own
+// block: ID, MinKey, MaxKey as KeyLen(4)| Key, Strategy(1), Count(8), MaxSeq(8),
+// then if any entry expires N(4)| N times Expiry(8).
+type Properties struct {
+	ID       string
+	MinKey   string
+	MaxKey   string
+	Strategy common.CompactionType
+	Count    uint64
+	MaxSeq   uint64
+	Expiries []int64 // see common.ExpiryHistogram
+}
+
+func (p Properties) Encode() []byte {
+	var buf []byte
+	for _, s := range []string{p.ID, p.MinKey, p.MaxKey} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+		buf = append(buf, s...)
+	}
+	buf = append(buf, byte(p.Strategy))
+	buf = binary.BigEndian.AppendUint64(buf, p.Count)
+	buf = binary.BigEndian.AppendUint64(buf, p.MaxSeq)
+	if len(p.Expiries) > 0 {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.Expiries)))
+		for _, at := range p.Expiries {
+			buf = binary.BigEndian.AppendUint64(buf, uint64(at))
+		}
+	}
+	return buf
+}
+
+func DecodeProperties(raw []byte) (Properties, error) {
+	var p Properties
+	strs := []*string{&p.ID, &p.MinKey, &p.MaxKey}
+	for _, s := range strs {
+		if len(raw) < 4 {
+			return p, ErrMalformedBlock
+		}
+		n := int(binary.BigEndian.Uint32(raw))
+		if len(raw) < 4+n {
+			return p, ErrMalformedBlock
+		}
+		*s = string(raw[4 : 4+n])
+		raw = raw[4+n:]
+	}
+	if len(raw) < 17 {
+		return p, ErrMalformedBlock
+	}
+	p.Strategy = common.CompactionType(raw[0])
+	p.Count = binary.BigEndian.Uint64(raw[1:9])
+	p.MaxSeq = binary.BigEndian.Uint64(raw[9:17])
+	raw = raw[17:]
+	if len(raw) == 0 {
+		return p, nil
+	}
+	if len(raw) < 4 || len(raw) != 4+8*int(binary.BigEndian.Uint32(raw)) {
+		return p, ErrMalformedBlock
+	}
+	for raw = raw[4:]; len(raw) > 0; raw = raw[8:] {
+		p.Expiries = append(p.Expiries, int64(binary.BigEndian.Uint64(raw)))
+	}
+	return p, nil
+}
+
+// RecordFlags returns the record flags segments of version may carry,
+// versions 0 and 1 being the flat layouts; any other bit in a record's
+// flags byte is not one of them and is ignored.
+func RecordFlags(version uint32) byte {
+	flags := common.RecordFlagTombstone
+	if version >= 4 {
+		flags |= common.RecordFlagExpiring
+	}
+	if version >= 5 {
+		flags |= common.RecordFlagMerge
+	}
+	return flags
+}
+
+// Footer is the fixed-size tail of a segment. A zero Filter handle means
+// the segment has no Bloom filter, a zero RangeDel handle that it has no
+// range tombstones.
+type Footer struct {
+	Properties Handle
+	Index      Handle
+	Filter     Handle
+	RangeDel   Handle // version 3 and later
+	Version    uint32
+}
+
+// Size is the encoded length of the footer, which depends on its version.
+func (f Footer) Size() int64 {
+	if f.Version == 2 {
+		return FooterSizeV2
+	}
+	return FooterSize
+}
+
+func (f *Footer) handles() []*Handle {
+	if f.Version == 2 {
+		return []*Handle{&f.Properties, &f.Index, &f.Filter}
+	}
+	return []*Handle{&f.Properties, &f.Index, &f.Filter, &f.RangeDel}
+}
+
+func (f Footer) Encode() []byte {
+	buf := make([]byte, 0, f.Size())
+	for _, h := range f.handles() {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.Offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.Length))
+	}
+	buf = binary.BigEndian.AppendUint32(buf, f.Version)
+	return binary.BigEndian.AppendUint64(buf, FooterMagic)
+}
+
+// DecodeFooter parses the footer at the end of seg, a whole segment or
+// at least its tail. Versions 2 up to Version are read, newer ones than
+// this code knows are refused rather than misread.
+func DecodeFooter(seg []byte) (Footer, error) {
+	n := len(seg)
+	if n < FooterSizeV2 || binary.BigEndian.Uint64(seg[n-8:]) != FooterMagic {
+		return Footer{}, ErrBadFooter
+	}
+	f := Footer{Version: binary.BigEndian.Uint32(seg[n-12 : n-8])}
+	if f.Version < 2 || f.Version > Version {
+		return Footer{}, ErrUnknownVersion
+	}
+	if int64(n) < f.Size() {
+		return Footer{}, ErrBadFooter
+	}
+	buf := seg[n-int(f.Size()):]
+	for i, h := range f.handles() {
+		h.Offset = int64(binary.BigEndian.Uint64(buf[i*16:]))
+		h.Length = int64(binary.BigEndian.Uint64(buf[i*16+8:]))
+	}
+	return f, nil
+}
+
+// EncodeRangeTombstones lays out a range tombstone block: per tombstone
+// StartLen(4)| Start| EndLen(4)| End| Seq(8).
+func EncodeRangeTombstones(rts []common.RangeTombstone) []byte {
+	var buf []byte
+	for _, rt := range rts {
+		for _, s := range []string{rt.Start, rt.End} {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+			buf = append(buf, s...)
+		}
+		buf = binary.BigEndian.AppendUint64(buf, rt.Seq)
+	}
+	return buf
+}
+
+func DecodeRangeTombstones(raw []byte) ([]common.RangeTombstone, error) {
+	var rts []common.RangeTombstone
+	for len(raw) > 0 {
+		var rt common.RangeTombstone
+		for _, s := range []*string{&rt.Start, &rt.End} {
+			if len(raw) < 4 {
+				return nil, ErrMalformedBlock
+			}
+			n := int(binary.BigEndian.Uint32(raw))
+			if len(raw) < 4+n {
+				return nil, ErrMalformedBlock
+			}
+			*s = string(raw[4 : 4+n])
+			raw = raw[4+n:]
+		}
+		if len(raw) < 8 {
+			return nil, ErrMalformedBlock
+		}
+		rt.Seq = binary.BigEndian.Uint64(raw)
+		raw = raw[8:]
+		rts = append(rts, rt)
+	}
+	return rts, nil
+}
+
+// Preamble is Magic(4)| Length(8), Length covering the whole segment.
+func Preamble(length int64) []byte {
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, PreambleSize), PreambleMagic)
+	return binary.BigEndian.AppendUint64(buf, uint64(length))
+}
+
+// IsPreamble reports whether data starts with a version 2 preamble.
+func IsPreamble(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data) == PreambleMagic
+}
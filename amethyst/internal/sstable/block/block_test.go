@@ -0,0 +1,107 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestEncodeDecode_RoundTrip(t *testing.T) {
+	compressible := bytes.Repeat([]byte("key-0001 value-0001 "), 200)
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, tc := range []struct {
+		name  string
+		raw   []byte
+		codec Codec
+		want  Codec // what the trailer should record
+	}{
+		{"raw", compressible, NoCompression, NoCompression},
+		{"flate", compressible, Flate, Flate},
+		{"flate not paying off", random, Flate, NoCompression},
+		{"empty", nil, Flate, NoCompression},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := Encode(tc.raw, tc.codec)
+			if got := Codec(buf[len(buf)-TrailerSize]); got != tc.want {
+				t.Errorf("stored with codec %d, want %d", got, tc.want)
+			}
+			if tc.want == Flate && len(buf) >= len(tc.raw) {
+				t.Errorf("flate block of %d bytes for %d raw", len(buf), len(tc.raw))
+			}
+			raw, err := Decode(buf)
+			if err != nil {
+				t.Fatalf("decode failed: %v", err)
+			}
+			if !bytes.Equal(raw, tc.raw) {
+				t.Errorf("round trip changed the block: %d bytes in, %d out", len(tc.raw), len(raw))
+			}
+		})
+	}
+}
+
+func TestDecode_ChecksumMismatch(t *testing.T) {
+	raw := bytes.Repeat([]byte("abcdefgh"), 64)
+	for _, codec := range []Codec{NoCompression, Flate} {
+		buf := Encode(raw, codec)
+		// payload, codec byte and the checksum itself are all covered
+		for _, i := range []int{0, len(buf) / 2, len(buf) - TrailerSize, len(buf) - 1} {
+			bad := append([]byte(nil), buf...)
+			bad[i] ^= 0x01
+			if _, err := Decode(bad); !errors.Is(err, ErrChecksum) {
+				t.Errorf("codec %d, byte %d flipped: got %v", codec, i, err)
+			}
+		}
+	}
+	if _, err := Decode([]byte{0, 0, 0}); !errors.Is(err, ErrMalformedBlock) {
+		t.Errorf("block shorter than its trailer: got %v", err)
+	}
+}
+
+func TestDecodeFooter_Versions(t *testing.T) {
+	handles := Footer{
+		Properties: Handle{Offset: 100, Length: 20},
+		Index:      Handle{Offset: 120, Length: 30},
+		Filter:     Handle{Offset: 150, Length: 40},
+		RangeDel:   Handle{Offset: 190, Length: 50},
+	}
+	for v := uint32(2); v <= Version; v++ {
+		want := handles
+		want.Version = v
+		if v == 2 {
+			want.RangeDel = Handle{}
+		}
+		// the footer sits at the end of whatever of the segment is at hand
+		seg := append([]byte("segment data"), want.Encode()...)
+		got, err := DecodeFooter(seg)
+		if err != nil {
+			t.Fatalf("version %d refused: %v", v, err)
+		}
+		if got != want {
+			t.Errorf("version %d: got %+v, want %+v", v, got, want)
+		}
+		if int64(len(want.Encode())) != got.Size() {
+			t.Errorf("version %d: footer is %d bytes, Size says %d", v, len(want.Encode()), got.Size())
+		}
+	}
+
+	for _, v := range []uint32{0, 1, Version + 1} {
+		footer := handles
+		footer.Version = v
+		if _, err := DecodeFooter(footer.Encode()); !errors.Is(err, ErrUnknownVersion) {
+			t.Errorf("version %d: got %v, want ErrUnknownVersion", v, err)
+		}
+	}
+
+	footer := Footer{Version: Version}.Encode()
+	if _, err := DecodeFooter(footer[FooterSize-FooterSizeV2:]); !errors.Is(err, ErrBadFooter) {
+		t.Errorf("footer cut to the version 2 size: got %v", err)
+	}
+	binary.BigEndian.PutUint64(footer[len(footer)-8:], FooterMagic+1)
+	if _, err := DecodeFooter(footer); !errors.Is(err, ErrBadFooter) {
+		t.Errorf("wrong magic: got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package reader
+
+import (
+	"amethyst/internal/common"
+	"amethyst/internal/iterator"
+	"amethyst/internal/sparseindex"
+	"amethyst/internal/sstable/block"
+	"sort"
+)
+
+// blockSource is the block structure of one segment as the iterator sees it
+type blockSource interface {
+	numBlocks() int
+	// seekBlock returns the block the first key >= key is in, or the one
+	// just before it
+	seekBlock(key string) int
+	readBlock(b int) ([]common.KVEntry, error)
+}
+
+// flatBlocks treats the records between two sparse index entries of a
+// flat segment as a block. Blocks are read with ReadAt rather than
+// through the mmap, which is dropped on every append and so can't be held
+// across calls.
+type flatBlocks struct {
+	r      *Reader
+	meta   *common.SegmentMeta
+	idx    *sparseindex.SparseIndex // nil: the whole data section is one block
+	starts []int64                  // block start offsets, relative to the data section
+	end    int64                    // end of the data section, relative to it as well
+}
+
+func newFlatBlocks(r *Reader, meta *common.SegmentMeta) *flatBlocks {
+	f := &flatBlocks{
+		r:      r,
+		meta:   meta,
+		starts: []int64{0},
+		end:    meta.SparseIndexOffset - meta.DataStartOffset,
+	}
+	if idx, ok := meta.SparseIndex.(*sparseindex.SparseIndex); ok && idx != nil && len(idx.Offsets) > 0 {
+		f.idx = idx
+		f.starts = idx.Offsets
+	}
+	return f
+}
+
+func (f *flatBlocks) numBlocks() int {
+	return len(f.starts)
+}
+
+func (f *flatBlocks) seekBlock(key string) int {
+	if f.idx == nil {
+		return 0
+	}
+	// last block whose first key is <= key
+	b := sort.Search(len(f.idx.Keys), func(i int) bool { return f.idx.Keys[i] > key }) - 1
+	if b < 0 {
+		b = 0
+	}
+	return b
+}
+
+func (f *flatBlocks) readBlock(b int) ([]common.KVEntry, error) {
+	start := f.starts[b]
+	end := f.end
+	if b+1 < len(f.starts) {
+		end = f.starts[b+1]
+	}
+	if start < 0 || start > end {
+		return nil, ErrTornSegment
+	}
+	if start == end {
+		return nil, nil
+	}
+
+	data, err := f.r.readAt(f.meta, f.meta.DataStartOffset+start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFlatRecords(f.meta, data)
+}
+
+// dataBlocks are the real data blocks of a block format segment
+type dataBlocks struct {
+	r    *Reader
+	meta *common.SegmentMeta
+	idx  *block.Index
+}
+
+func (d *dataBlocks) numBlocks() int {
+	return len(d.idx.Handles)
+}
+
+func (d *dataBlocks) seekBlock(key string) int {
+	return d.idx.Find(key)
+}
+
+func (d *dataBlocks) readBlock(b int) ([]common.KVEntry, error) {
+	return d.r.readDataBlock(d.meta, d.idx.Handles[b])
+}
+
+// segmentIterator walks one segment a block at a time, only the current
+// block is decoded in memory.
+type segmentIterator struct {
+	src blockSource
+
+	block   int // index of the loaded block, -1 if none
+	entries []common.KVEntry
+	pos     int
+	err     error
+}
+
+// NewIterator returns an iterator over every entry of the segment,
+// tombstones included.
+func (r *Reader) NewIterator(meta *common.SegmentMeta) iterator.EntryIterator {
+	footer, ok := meta.SparseIndex.(*block.Footer)
+	if !ok {
+		return &segmentIterator{src: newFlatBlocks(r, meta), block: -1}
+	}
+	idx, err := r.blockIndex(meta, footer)
+	if err != nil {
+		// an iterator that reports the error once positioned
+		return &segmentIterator{src: &dataBlocks{idx: &block.Index{}}, block: -1, err: err}
+	}
+	return &segmentIterator{src: &dataBlocks{r: r, meta: meta, idx: idx}, block: -1}
+}
+
+// reads and decodes block b
+func (it *segmentIterator) load(b int) bool {
+	it.entries = nil
+	it.block = -1
+	it.pos = -1
+	if b < 0 || b >= it.src.numBlocks() || it.err != nil {
+		return false
+	}
+	entries, err := it.src.readBlock(b)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.entries = entries
+	it.block = b
+	return true
+}
+
+func (it *segmentIterator) Seek(key string) bool {
+	b := it.src.seekBlock(key)
+	if b >= it.src.numBlocks() {
+		it.load(-1)
+		return false
+	}
+	if !it.load(b) {
+		return false
+	}
+	it.pos = sort.Search(len(it.entries), func(i int) bool { return it.entries[i].Key >= key })
+	if it.pos == len(it.entries) {
+		return it.loadForward(b + 1)
+	}
+	return true
+}
+
+func (it *segmentIterator) SeekToFirst() bool {
+	return it.loadForward(0)
+}
+
+func (it *segmentIterator) SeekToLast() bool {
+	return it.loadBackward(it.src.numBlocks() - 1)
+}
+
+func (it *segmentIterator) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.pos++
+	if it.pos < len(it.entries) {
+		return true
+	}
+	return it.loadForward(it.block + 1)
+}
+
+func (it *segmentIterator) Prev() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.pos--
+	if it.pos >= 0 {
+		return true
+	}
+	return it.loadBackward(it.block - 1)
+}
+
+// positions on the first entry of block b or the first non-empty block after it
+func (it *segmentIterator) loadForward(b int) bool {
+	for ; b < it.src.numBlocks(); b++ {
+		if !it.load(b) {
+			return false
+		}
+		if len(it.entries) > 0 {
+			it.pos = 0
+			return true
+		}
+	}
+	it.block = -1
+	return false
+}
+
+// positions on the last entry of block b or the first non-empty block before it
+func (it *segmentIterator) loadBackward(b int) bool {
+	for ; b >= 0; b-- {
+		if !it.load(b) {
+			return false
+		}
+		if len(it.entries) > 0 {
+			it.pos = len(it.entries) - 1
+			return true
+		}
+	}
+	it.block = -1
+	return false
+}
+
+func (it *segmentIterator) Valid() bool {
+	return it.err == nil && it.block >= 0 && it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *segmentIterator) Key() string           { return it.entries[it.pos].Key }
+func (it *segmentIterator) Value() []byte         { return it.entries[it.pos].Value }
+func (it *segmentIterator) Entry() common.KVEntry { return it.entries[it.pos] }
+func (it *segmentIterator) Err() error            { return it.err }
+
+func (it *segmentIterator) Close() error {
+	it.entries = nil
+	it.block = -1
+	return nil
+}
@@ -1,41 +1,328 @@
 package reader
 
 import (
+	"amethyst/internal/bloom"
+	"amethyst/internal/cache"
 	"amethyst/internal/common"
+	"amethyst/internal/iterator"
 	"amethyst/internal/segmentfile"
 	"amethyst/internal/sparseindex"
+	"amethyst/internal/sstable/block"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
 )
 
+// returned when a segment in the data file is cut short or malformed
+var ErrTornSegment = errors.New("sstable: torn or malformed segment")
+
+// returned when the data file holds something whose header isn't that of a
+// segment, which is not a torn append and must not be cut off
+var ErrBadSegmentHeader = errors.New("sstable: unreadable segment header")
+
+// length of a segment ID, a UUID in its string form
+const segmentIDLen = 36
+
 type SSTableReader interface {
-	Get(meta *common.SegmentMeta, key string) ([]byte, bool)
-	Scan(meta *common.SegmentMeta) (map[string][]byte, error)
+	// Get reports the entry for key, tombstones included, so the caller
+	// can tell a delete apart from a key the segment never saw. A block
+	// that fails its checksum is an error, not a miss. The value is the
+	// caller's to keep and modify.
+	Get(meta *common.SegmentMeta, key string) (common.KVEntry, bool, error)
+	// GetAt is Get for the newest version of key with Seq <= seq, the one
+	// a snapshot taken at seq sees
+	GetAt(meta *common.SegmentMeta, key string, seq uint64) (common.KVEntry, bool, error)
+	// Scan returns every entry of the segment in file (key) order.
+	Scan(meta *common.SegmentMeta) ([]common.KVEntry, error)
+	// NewIterator walks the segment in key order without loading all of it.
+	NewIterator(meta *common.SegmentMeta) iterator.EntryIterator
+	// Filter returns the segment's Bloom filter, nil if it was written
+	// without one.
+	Filter(meta *common.SegmentMeta) (*bloom.Filter, error)
+	// RangeTombstones returns the range deletes stored in the segment. They
+	// apply to every segment, not only to the keys of this one.
+	RangeTombstones(meta *common.SegmentMeta) ([]common.RangeTombstone, error)
 }
 
+// Reader serves block format segments through a block cache: decoded data
+// blocks are cached by segment ID and block offset, and so are the index
+// and filter blocks, pinned if asked to. Flat segments keep their sparse
+// index and filter in SegmentMeta and are read from the mmap.
 type Reader struct {
-	fileMgr segmentfile.SegmentFileManager
+	fileMgr segmentfile.SegmentFileManager // legacy shared data file, nil if there is none
+	store   segmentfile.SegmentStore       // per-segment files, nil for a shared-file-only reader
+	cache   *cache.Cache
+	pin     bool // index and filter blocks are pinned in the cache
 }
 
+// NewReader gives the reader a cache of its own with the default capacity.
 func NewReader(fileMgr segmentfile.SegmentFileManager) *Reader {
-	return &Reader{fileMgr: fileMgr}
+	return NewReaderWithCache(fileMgr, cache.New(cache.DefaultCapacity, cache.DefaultShards), true)
+}
+
+// NewReaderWithCache reads through c, which may be shared with other readers.
+// With pinIndexAndFilter set, index and filter blocks stay cached for as long
+// as their segment is live; otherwise they compete with data blocks.
+func NewReaderWithCache(fileMgr segmentfile.SegmentFileManager, c *cache.Cache, pinIndexAndFilter bool) *Reader {
+	return &Reader{fileMgr: fileMgr, cache: c, pin: pinIndexAndFilter}
+}
+
+// NewReaderWithStore reads segments from their own files in store, and
+// Shared ones from the legacy data file behind fileMgr, which may be nil
+// when there is no such file.
+func NewReaderWithStore(store segmentfile.SegmentStore, fileMgr segmentfile.SegmentFileManager,
+	c *cache.Cache, pinIndexAndFilter bool) *Reader {
+	return &Reader{fileMgr: fileMgr, store: store, cache: c, pin: pinIndexAndFilter}
+}
+
+// reads length bytes at offset from the start of the segment, wherever it lives
+func (r *Reader) readAt(meta *common.SegmentMeta, offset int64, length int64) ([]byte, error) {
+	if meta.Shared {
+		if r.fileMgr == nil {
+			return nil, fmt.Errorf("segment %s: %w", meta.ID, segmentfile.ErrSegmentNotFound)
+		}
+		return r.fileMgr.ReadAt(meta.Offset+offset, length)
+	}
+	return r.store.ReadAt(meta.ID, offset, length)
+}
+
+// record header: KeyLen(4)| ValLen(4)| Flags(1)| Seq(8), see
+// common.RecordFlagTombstone. Flat version 0 records stop before the Seq
+// and only know the tombstone flag
+const (
+	recordHeaderSize   = 17
+	recordHeaderSizeV0 = 9
+)
+
+func recordHeaderLen(version uint32) int {
+	if version == 0 {
+		return recordHeaderSizeV0
+	}
+	return recordHeaderSize
+}
+
+// version of a flat segment's records, see common.SegmentFlagSeq
+func flatVersion(meta *common.SegmentMeta) uint32 {
+	if meta.Unsequenced {
+		return 0
+	}
+	return 1
+}
+
+// decodes the record at the front of data, of a segment of the given
+// version, returning it and its length. Flags the version doesn't define
+// are not looked at, see block.RecordFlags. A version 0 record comes back
+// with Seq 0, its segment's MaxSeq is the caller's to fill in
+func decodeRecord(data []byte, version uint32) (common.KVEntry, int, bool) {
+	hdr := recordHeaderLen(version)
+	if len(data) < hdr {
+		return common.KVEntry{}, 0, false
+	}
+	kLen := int(binary.BigEndian.Uint32(data[0:4]))
+	vLen := int(binary.BigEndian.Uint32(data[4:8]))
+	flags := data[8] & block.RecordFlags(version)
+	tomb := flags&common.RecordFlagTombstone != 0
+	var seq uint64
+	if version > 0 {
+		seq = binary.BigEndian.Uint64(data[9:17])
+	}
+
+	n := hdr + kLen + vLen
+	if kLen < 0 || vLen < 0 || len(data) < n {
+		return common.KVEntry{}, 0, false
+	}
+	entry := common.KVEntry{
+		Key:       string(data[hdr : hdr+kLen]),
+		Tombstone: tomb,
+		Seq:       seq,
+		Merge:     flags&common.RecordFlagMerge != 0,
+	}
+	value := data[hdr+kLen : n]
+	if flags&common.RecordFlagExpiring != 0 {
+		if len(value) < 8 {
+			return common.KVEntry{}, 0, false
+		}
+		entry.ExpiresAt = int64(binary.BigEndian.Uint64(value))
+		value = value[8:]
+	}
+	if len(value) > 0 && !tomb {
+		entry.Value = make([]byte, len(value))
+		copy(entry.Value, value)
+	}
+	return entry, n, true
+}
+
+func (r *Reader) Filter(meta *common.SegmentMeta) (*bloom.Filter, error) {
+	footer, ok := meta.SparseIndex.(*block.Footer)
+	if !ok {
+		f, _ := meta.Filter.(*bloom.Filter)
+		return f, nil
+	}
+	if footer.Filter.Length == 0 {
+		return nil, nil
+	}
+	v, err := r.cachedBlock(meta, footer.Filter, r.pin, func(raw []byte) (any, error) {
+		return bloom.Decode(raw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*bloom.Filter), nil
+}
+
+// range tombstones are cached like the filter, a lookup checks those of
+// every live segment
+func (r *Reader) RangeTombstones(meta *common.SegmentMeta) ([]common.RangeTombstone, error) {
+	footer, ok := meta.SparseIndex.(*block.Footer)
+	if !ok || footer.RangeDel.Length == 0 {
+		return nil, nil
+	}
+	v, err := r.cachedBlock(meta, footer.RangeDel, r.pin, func(raw []byte) (any, error) {
+		return block.DecodeRangeTombstones(raw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]common.RangeTombstone), nil
+}
+
+// index block of a block format segment
+func (r *Reader) blockIndex(meta *common.SegmentMeta, footer *block.Footer) (*block.Index, error) {
+	v, err := r.cachedBlock(meta, footer.Index, r.pin, func(raw []byte) (any, error) {
+		return block.DecodeIndex(raw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*block.Index), nil
+}
+
+// looks the block at h up in the cache, or reads, checks and decodes it and
+// caches the result charged at its decoded size
+func (r *Reader) cachedBlock(meta *common.SegmentMeta, h block.Handle, pinned bool,
+	decode func(raw []byte) (any, error)) (any, error) {
+
+	key := cache.Key{SegmentID: meta.ID, Offset: h.Offset}
+	if v, ok := r.cache.Get(key); ok {
+		return v, nil
+	}
+	buf, err := r.readAt(meta, h.Offset, h.Length)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := block.Decode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s block at %d: %w", meta.ID, h.Offset, err)
+	}
+	v, err := decode(raw)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s block at %d: %w", meta.ID, h.Offset, err)
+	}
+	r.cache.Put(key, v, int64(len(raw)), pinned)
+	return v, nil
+}
+
+// decodes a run of records that must fill data exactly
+func decodeRecords(data []byte, version uint32) ([]common.KVEntry, error) {
+	var entries []common.KVEntry
+	for len(data) > 0 {
+		entry, n, ok := decodeRecord(data, version)
+		if !ok {
+			return nil, ErrTornSegment
+		}
+		entries = append(entries, entry)
+		data = data[n:]
+	}
+	return entries, nil
+}
+
+// decodes records of the flat segment meta, those of an unsequenced one
+// all taking its MaxSeq
+func decodeFlatRecords(meta *common.SegmentMeta, data []byte) ([]common.KVEntry, error) {
+	entries, err := decodeRecords(data, flatVersion(meta))
+	if err != nil || !meta.Unsequenced {
+		return entries, err
+	}
+	for i := range entries {
+		entries[i].Seq = meta.MaxSeq
+	}
+	return entries, nil
 }
 
-func (r *Reader) Get(meta *common.SegmentMeta, target string) ([]byte, bool) {
-	// Fast reject by key range
+// one data block of a block format segment, decoded. The entries are shared
+// through the cache and must not be modified.
+func (r *Reader) readDataBlock(meta *common.SegmentMeta, h block.Handle) ([]common.KVEntry, error) {
+	footer := meta.SparseIndex.(*block.Footer)
+	v, err := r.cachedBlock(meta, h, false, func(raw []byte) (any, error) {
+		return decodeRecords(raw, footer.Version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]common.KVEntry), nil
+}
+
+func (r *Reader) Get(meta *common.SegmentMeta, target string) (common.KVEntry, bool, error) {
+	return r.GetAt(meta, target, math.MaxUint64)
+}
+
+func (r *Reader) GetAt(meta *common.SegmentMeta, target string, seq uint64) (common.KVEntry, bool, error) {
+	// Fast reject by key range and filter, before any data is touched
 	if target < meta.MinKey || target > meta.MaxKey {
-		return nil, false
+		return common.KVEntry{}, false, nil
+	}
+	filter, err := r.Filter(meta)
+	if err != nil {
+		return common.KVEntry{}, false, err
+	}
+	if filter != nil && !filter.MayContain(target) {
+		return common.KVEntry{}, false, nil
+	}
+
+	// block format: the index names the block the key starts in, its
+	// older versions may run on into the next ones
+	if footer, ok := meta.SparseIndex.(*block.Footer); ok {
+		idx, err := r.blockIndex(meta, footer)
+		if err != nil {
+			return common.KVEntry{}, false, err
+		}
+		for b := idx.Find(target); b < len(idx.Handles); b++ {
+			entries, err := r.readDataBlock(meta, idx.Handles[b])
+			if err != nil {
+				return common.KVEntry{}, false, err
+			}
+			i := sort.Search(len(entries), func(i int) bool { return entries[i].Key >= target })
+			for ; i < len(entries) && entries[i].Key == target; i++ {
+				if entries[i].Seq <= seq {
+					// the block is shared through the cache, the caller
+					// gets a value of its own
+					entry := entries[i]
+					entry.Value = append([]byte(nil), entry.Value...)
+					return entry, true, nil
+				}
+			}
+			if i < len(entries) || idx.LastKeys[b] != target {
+				break
+			}
+		}
+		return common.KVEntry{}, false, nil
 	}
 
 	idx, ok := meta.SparseIndex.(*sparseindex.SparseIndex)
 	if !ok || idx == nil {
-		return nil, false
+		return common.KVEntry{}, false, nil
 	}
 
 	// Get mmapped data
 	mmapData, err := r.fileMgr.GetMmapData()
 	if err != nil {
-		return nil, false
+		return common.KVEntry{}, false, err
 	}
 
 	// Compute absolute start offset
@@ -44,112 +331,375 @@ func (r *Reader) Get(meta *common.SegmentMeta, target string) ([]byte, bool) {
 
 	// Check bounds
 	if start < 0 || end > int64(len(mmapData)) || start > end {
-		return nil, false
+		return common.KVEntry{}, false, nil
 	}
 
 	// Use direct slice from mmap - zero copy!
 	data := mmapData[start:end]
-	buf := bytes.NewReader(data)
-
-	for buf.Len() > 0 {
-		var kLen uint32
-		var vLen uint32
-		var tomb byte
+	version := flatVersion(meta)
+	hdr := recordHeaderLen(version)
 
-		if err := binary.Read(buf, binary.BigEndian, &kLen); err != nil {
-			return nil, false
+	for len(data) > 0 {
+		// compare the key in place before decoding anything
+		if len(data) < hdr {
+			return common.KVEntry{}, false, nil
 		}
-		if err := binary.Read(buf, binary.BigEndian, &vLen); err != nil {
-			return nil, false
+		kLen := int(binary.BigEndian.Uint32(data[0:4]))
+		if len(data) < hdr+kLen {
+			return common.KVEntry{}, false, nil
 		}
-		if err := binary.Read(buf, binary.BigEndian, &tomb); err != nil {
-			return nil, false
-		}
-
-		keyBytes := make([]byte, kLen)
-		if _, err := buf.Read(keyBytes); err != nil {
-			return nil, false
-		}
-		key := string(keyBytes)
+		key := data[hdr : hdr+kLen]
 
-		var valBytes []byte
-		if vLen > 0 {
-			valBytes = make([]byte, vLen)
-			if _, err := buf.Read(valBytes); err != nil {
-				return nil, false
+		switch bytes.Compare(key, []byte(target)) {
+		case 0:
+			entry, _, ok := decodeRecord(data, version)
+			if meta.Unsequenced {
+				entry.Seq = meta.MaxSeq
 			}
-		}
-
-		if key == target {
-			if tomb == 1 {
-				return nil, false
+			if !ok || entry.Seq <= seq {
+				return entry, ok, nil
 			}
-			return valBytes, true
+			// newer than asked for, an older version may follow
+		case 1:
+			// Sorted order invariant: stop early
+			return common.KVEntry{}, false, nil
 		}
 
-		// Sorted order invariant: stop early
-		if key > target {
-			return nil, false
+		_, n, ok := decodeRecord(data, version)
+		if !ok {
+			return common.KVEntry{}, false, nil
 		}
+		data = data[n:]
 	}
 
-	return nil, false
+	return common.KVEntry{}, false, nil
 }
 
-func (r *Reader) Scan(meta *common.SegmentMeta) (map[string][]byte, error) {
-	result := make(map[string][]byte)
+func (r *Reader) Scan(meta *common.SegmentMeta) ([]common.KVEntry, error) {
+	it := r.NewIterator(meta)
+	defer it.Close()
 
-	// Get mmapped data
+	var result []common.KVEntry
+	for ok := it.SeekToFirst(); ok; ok = it.Next() {
+		result = append(result, it.Entry())
+	}
+	return result, it.Err()
+}
+
+// LoadSegments walks the data file segment by segment and rebuilds the
+// metadata WriteSegment produced for each one. Segments come back in file
+// order (oldest first). If the tail of the file holds a half-written segment
+// the intact prefix is returned together with ErrTornSegment and the offset
+// where the good data ends, so the caller can cut the file back; a segment
+// header that doesn't parse is ErrBadSegmentHeader instead. The segments
+// are all Shared. Unsequenced ones get their place in the file, counting
+// from 1, as MaxSeq: they were appended oldest first, and nothing with a
+// real sequence number came before them.
+func (r *Reader) LoadSegments() ([]*common.SegmentMeta, int64, error) {
 	mmapData, err := r.fileMgr.GetMmapData()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var segs []*common.SegmentMeta
+	var off int64
+	for off < int64(len(mmapData)) {
+		meta, err := decodeSegment(mmapData, off)
+		if err != nil {
+			return segs, off, err
+		}
+		meta.Shared = true
+		if meta.Unsequenced {
+			meta.MaxSeq = uint64(len(segs) + 1)
+		}
+		segs = append(segs, meta)
+		off += meta.Length
+	}
+	return segs, off, nil
+}
+
+// LoadStoreSegments rebuilds the metadata of every segment file in the
+// store, in no particular order. Files are written whole, so unlike the
+// shared file a short or damaged one is an error rather than a torn tail.
+func (r *Reader) LoadStoreSegments() ([]*common.SegmentMeta, error) {
+	ids, err := r.store.List()
 	if err != nil {
 		return nil, err
 	}
+	segs := make([]*common.SegmentMeta, 0, len(ids))
+	for _, id := range ids {
+		size, err := r.store.Size(id)
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.store.ReadAt(id, 0, size)
+		if err != nil {
+			return nil, err
+		}
+		if !block.IsPreamble(data) {
+			return nil, fmt.Errorf("segment file %s: %w", id, ErrTornSegment)
+		}
+		meta, err := decodeBlockSegment(data, 0)
+		if err != nil {
+			return nil, fmt.Errorf("segment file %s: %w", id, err)
+		}
+		if meta.ID != id || meta.Length != size {
+			return nil, fmt.Errorf("segment file %s: %w", id, ErrTornSegment)
+		}
+		segs = append(segs, meta)
+	}
+	return segs, nil
+}
 
-	start := meta.Offset + meta.DataStartOffset
-	end := meta.Offset + meta.SparseIndexOffset
+// decodes one segment starting at off, mirroring the layout of WriteSegment:
+// header, records, sparse index, footer, optional Bloom filter. Segments
+// without common.SegmentFlagSeq have the first flat layout, version 0: no
+// MaxSeq in the header and records without a Seq
+func decodeSegment(data []byte, off int64) (*common.SegmentMeta, error) {
+	if block.IsPreamble(data[off:]) {
+		return decodeBlockSegment(data, off)
+	}
 
-	// Check bounds
-	if start < 0 || end > int64(len(mmapData)) || start > end {
-		return nil, nil
+	pos := off
+	end := int64(len(data))
+
+	readUint32 := func() (uint32, bool) {
+		if end-pos < 4 {
+			return 0, false
+		}
+		v := binary.BigEndian.Uint32(data[pos : pos+4])
+		pos += 4
+		return v, true
+	}
+	readUint64 := func() (uint64, bool) {
+		if end-pos < 8 {
+			return 0, false
+		}
+		v := binary.BigEndian.Uint64(data[pos : pos+8])
+		pos += 8
+		return v, true
+	}
+	readString := func() (string, bool) {
+		n, ok := readUint32()
+		if !ok || end-pos < int64(n) {
+			return "", false
+		}
+		s := string(data[pos : pos+int64(n)])
+		pos += int64(n)
+		return s, true
 	}
 
-	// Use direct slice from mmap - zero copy!
-	data := mmapData[start:end]
-	buf := bytes.NewReader(data)
+	// 1. Header: ID, MinKey, MaxKey, strategy|flags, count, MaxSeq. What
+	// is there has to make sense, only running out of bytes is a torn tail
+	badHeader := fmt.Errorf("segment at %d: %w", off, ErrBadSegmentHeader)
+	if end-pos < 4 {
+		return nil, ErrTornSegment
+	}
+	if binary.BigEndian.Uint32(data[pos:pos+4]) != segmentIDLen {
+		return nil, badHeader
+	}
+	id, ok := readString()
+	if !ok {
+		return nil, ErrTornSegment
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, badHeader
+	}
+	minKey, ok := readString()
+	if !ok {
+		return nil, ErrTornSegment
+	}
+	maxKey, ok := readString()
+	if !ok {
+		return nil, ErrTornSegment
+	}
+	if end-pos < 1 {
+		return nil, ErrTornSegment
+	}
+	const known = common.SegmentFlagFilter | common.SegmentFlagSeq
+	flags := data[pos] & known
+	strategy := common.CompactionType(data[pos] &^ known)
+	if minKey > maxKey || (strategy != common.TIERED && strategy != common.LEVELED) {
+		return nil, badHeader
+	}
+	pos++
+	count, ok := readUint64()
+	if !ok {
+		return nil, ErrTornSegment
+	}
+	version := uint32(0)
+	var maxSeq uint64
+	if flags&common.SegmentFlagSeq != 0 {
+		version = 1
+		if maxSeq, ok = readUint64(); !ok {
+			return nil, ErrTornSegment
+		}
+	}
+	dataStart := pos - off
 
-	for buf.Len() > 0 {
-		var kLen, vLen uint32
-		var tomb byte
+	// 2. Records, skipped over by their lengths
+	for i := uint64(0); i < count; i++ {
+		kLen, ok := readUint32()
+		if !ok {
+			return nil, ErrTornSegment
+		}
+		vLen, ok := readUint32()
+		if !ok {
+			return nil, ErrTornSegment
+		}
+		skip := int64(recordHeaderLen(version)-8) + int64(kLen) + int64(vLen)
+		if end-pos < skip {
+			return nil, ErrTornSegment
+		}
+		pos += skip
+	}
+	sparseOffset := pos - off
 
-		if err := binary.Read(buf, binary.BigEndian, &kLen); err != nil {
-			break
+	// 3. Sparse index entries until we hit the footer. The footer repeats
+	// sparseOffset; an index entry can't collide with it because its key
+	// length and the high half of its offset would both have to be zero.
+	idx := &sparseindex.SparseIndex{}
+	for {
+		if end-pos < 8 {
+			return nil, ErrTornSegment
 		}
-		if err := binary.Read(buf, binary.BigEndian, &vLen); err != nil {
+		if int64(binary.BigEndian.Uint64(data[pos:pos+8])) == sparseOffset {
+			pos += 8
 			break
 		}
-		if err := binary.Read(buf, binary.BigEndian, &tomb); err != nil {
-			break
+		k, ok := readString()
+		if !ok {
+			return nil, ErrTornSegment
+		}
+		o, ok := readUint64()
+		if !ok {
+			return nil, ErrTornSegment
 		}
+		idx.Keys = append(idx.Keys, k)
+		idx.Offsets = append(idx.Offsets, int64(o))
+	}
 
-		keyBytes := make([]byte, kLen)
-		if _, err := buf.Read(keyBytes); err != nil {
-			break
+	// 4. Bloom filter, only in segments flagged as having one
+	var filter *bloom.Filter
+	if flags&common.SegmentFlagFilter != 0 {
+		n, ok := readUint32()
+		if !ok || end-pos < int64(n) {
+			return nil, ErrTornSegment
+		}
+		f, err := bloom.Decode(data[pos : pos+int64(n)])
+		if err != nil {
+			return nil, ErrTornSegment
 		}
-		key := string(keyBytes)
+		filter = f
+		pos += int64(n)
+	}
 
-		var valBytes []byte
-		if vLen > 0 {
-			valBytes = make([]byte, vLen)
-			if _, err := buf.Read(valBytes); err != nil {
-				break
-			}
+	now := time.Now().Unix()
+	meta := &common.SegmentMeta{
+		ID:                id,
+		Offset:            off,
+		Length:            pos - off,
+		MinKey:            minKey,
+		MaxKey:            maxKey,
+		Strategy:          strategy,
+		MaxSeq:            maxSeq,
+		Unsequenced:       version == 0,
+		CreatedAt:         now,
+		LastRewriteAt:     now,
+		SparseIndex:       idx,
+		DataStartOffset:   dataStart,
+		SparseIndexOffset: sparseOffset,
+	}
+	if filter != nil {
+		meta.Filter = filter
+	}
+	return meta, nil
+}
+
+// decodes a block format segment starting at off: the preamble gives its
+// length, the footer at that distance the blocks describing it
+func decodeBlockSegment(data []byte, off int64) (*common.SegmentMeta, error) {
+	if int64(len(data))-off < block.PreambleSize {
+		return nil, ErrTornSegment
+	}
+	length := int64(binary.BigEndian.Uint64(data[off+4 : off+12]))
+	if length < block.PreambleSize+block.FooterSizeV2 || length > int64(len(data))-off {
+		return nil, ErrTornSegment
+	}
+	seg := data[off : off+length]
+
+	// a complete segment with a bad footer or checksum is damage, not a
+	// torn append, and must not be cut off by recovery
+	footer, err := block.DecodeFooter(seg[block.PreambleSize:])
+	if err != nil {
+		return nil, fmt.Errorf("segment at %d: %w", off, err)
+	}
+	readBlock := func(h block.Handle) ([]byte, error) {
+		if h.Offset < block.PreambleSize || h.Length < block.TrailerSize || h.Offset+h.Length > length-footer.Size() {
+			return nil, fmt.Errorf("segment at %d: %w", off, block.ErrMalformedBlock)
+		}
+		raw, err := block.Decode(seg[h.Offset : h.Offset+h.Length])
+		if err != nil {
+			return nil, fmt.Errorf("segment at %d: %w", off, err)
 		}
+		return raw, nil
+	}
 
-		if tomb == 1 {
-			result[key] = nil
-		} else {
-			result[key] = valBytes
+	raw, err := readBlock(footer.Properties)
+	if err != nil {
+		return nil, err
+	}
+	props, err := block.DecodeProperties(raw)
+	if err != nil {
+		return nil, fmt.Errorf("segment at %d: %w", off, err)
+	}
+	// index, filter and range tombstones are only checked here, the reader
+	// loads them through its cache when they are needed
+	raw, err = readBlock(footer.Index)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := block.DecodeIndex(raw); err != nil {
+		return nil, fmt.Errorf("segment at %d: %w", off, err)
+	}
+	dataEnd := footer.Index.Offset
+	if footer.Filter.Length > 0 {
+		raw, err := readBlock(footer.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := bloom.Decode(raw); err != nil {
+			return nil, fmt.Errorf("segment at %d: %w", off, err)
 		}
+		dataEnd = footer.Filter.Offset
+	}
+	if footer.RangeDel.Length > 0 {
+		raw, err := readBlock(footer.RangeDel)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := block.DecodeRangeTombstones(raw); err != nil {
+			return nil, fmt.Errorf("segment at %d: %w", off, err)
+		}
+		dataEnd = footer.RangeDel.Offset
+	}
+
+	now := time.Now().Unix()
+	meta := &common.SegmentMeta{
+		ID:                props.ID,
+		Offset:            off,
+		Length:            length,
+		MinKey:            props.MinKey,
+		MaxKey:            props.MaxKey,
+		Strategy:          props.Strategy,
+		MaxSeq:            props.MaxSeq,
+		Expiries:          props.Expiries,
+		CreatedAt:         now,
+		LastRewriteAt:     now,
+		RangeDeletes:      footer.RangeDel.Length > 0,
+		SparseIndex:       &footer,
+		DataStartOffset:   block.PreambleSize,
+		SparseIndexOffset: dataEnd,
 	}
-	return result, nil
+	return meta, nil
 }
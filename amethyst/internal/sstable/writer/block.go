@@ -0,0 +1,219 @@
+package writer
+
+import (
+	"amethyst/internal/bloom"
+	"amethyst/internal/common"
+	"amethyst/internal/segmentfile"
+	"amethyst/internal/sstable/block"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BlockOptions tunes the block format, see package block for the layout.
+type BlockOptions struct {
+	BlockSize       int         // raw bytes of records per data block
+	Compression     block.Codec // applied per block
+	BloomBitsPerKey int         // 0 writes segments without a filter
+}
+
+func DefaultBlockOptions() BlockOptions {
+	return BlockOptions{
+		BlockSize:       block.DefaultBlockSize,
+		Compression:     block.NoCompression,
+		BloomBitsPerKey: bloom.DefaultBitsPerKey,
+	}
+}
+
+// NewBlockWriter writes segments in the block format, appended to the
+// shared data file.
+func NewBlockWriter(fileMgr segmentfile.SegmentFileManager, opts BlockOptions) *writer {
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = block.DefaultBlockSize
+	}
+	return &writer{
+		fileMgr:    fileMgr,
+		bitsPerKey: opts.BloomBitsPerKey,
+		blocks:     &opts,
+	}
+}
+
+// NewStoreWriter writes segments in the block format, each to a file of its
+// own in store so it can be deleted once obsolete.
+func NewStoreWriter(store segmentfile.SegmentStore, opts BlockOptions) *writer {
+	w := NewBlockWriter(nil, opts)
+	w.store = store
+	return w
+}
+
+type blockBuilder struct {
+	w        *writer
+	strategy common.CompactionType
+
+	body    []byte // encoded data blocks, preceded by the preamble on Finish
+	current []byte // raw records of the block being filled
+	index   block.Index
+
+	count     int
+	minKey    string
+	maxKey    string
+	maxSeq    uint64
+	lastSeq   uint64   // of the last entry added
+	keyHashes []uint64 // for the Bloom filter
+	expiries  []int64  // of the entries that expire
+
+	ranges []common.RangeTombstone
+}
+
+func newBlockBuilder(w *writer, strategy common.CompactionType) *blockBuilder {
+	return &blockBuilder{
+		w:        w,
+		strategy: strategy,
+		current:  make([]byte, 0, w.blocks.BlockSize+256),
+	}
+}
+
+func (b *blockBuilder) Add(entry common.KVEntry) error {
+	if b.count > 0 && outOfOrder(entry, b.maxKey, b.lastSeq) {
+		return ErrUnsorted
+	}
+	newKey := b.count == 0 || entry.Key != b.maxKey
+	if b.count == 0 {
+		b.minKey = entry.Key
+	}
+	b.maxKey = entry.Key
+	b.lastSeq = entry.Seq
+	if entry.Seq > b.maxSeq {
+		b.maxSeq = entry.Seq
+	}
+	if b.w.bitsPerKey > 0 && newKey {
+		b.keyHashes = append(b.keyHashes, bloom.Hash(entry.Key))
+	}
+	if entry.ExpiresAt != 0 && !entry.Tombstone {
+		b.expiries = append(b.expiries, entry.ExpiresAt)
+	}
+
+	b.current = appendRecord(b.current, entry)
+	b.count++
+	if len(b.current) >= b.w.blocks.BlockSize {
+		b.flushBlock()
+	}
+	return nil
+}
+
+// seals the block being filled and indexes it by its last key
+func (b *blockBuilder) flushBlock() {
+	if len(b.current) == 0 {
+		return
+	}
+	h := b.appendBlock(b.current, b.w.blocks.Compression)
+	b.index.LastKeys = append(b.index.LastKeys, b.maxKey)
+	b.index.Handles = append(b.index.Handles, h)
+	b.current = b.current[:0]
+}
+
+func (b *blockBuilder) appendBlock(raw []byte, codec block.Codec) block.Handle {
+	enc := block.Encode(raw, codec)
+	h := block.Handle{Offset: int64(block.PreambleSize + len(b.body)), Length: int64(len(enc))}
+	b.body = append(b.body, enc...)
+	return h
+}
+
+func (b *blockBuilder) AddRangeTombstone(rt common.RangeTombstone) error {
+	b.ranges = append(b.ranges, rt)
+	return nil
+}
+
+func (b *blockBuilder) Count() int {
+	return b.count
+}
+
+func (b *blockBuilder) Size() int64 {
+	return int64(len(b.body) + len(b.current))
+}
+
+func (b *blockBuilder) Finish() (*common.SegmentMeta, error) {
+	if b.count == 0 && len(b.ranges) == 0 {
+		return nil, nil
+	}
+	b.flushBlock()
+	dataEnd := int64(block.PreambleSize + len(b.body))
+
+	segmentID := uuid.New().String()
+	now := time.Now().Unix()
+
+	// the key range takes in where the range tombstones start, so a segment
+	// holding nothing else still sits next to the keys it deletes
+	minKey, maxKey, maxSeq := b.minKey, b.maxKey, b.maxSeq
+	for i, rt := range b.ranges {
+		if (b.count == 0 && i == 0) || rt.Start < minKey {
+			minKey = rt.Start
+		}
+		if rt.Start > maxKey {
+			maxKey = rt.Start
+		}
+		if rt.Seq > maxSeq {
+			maxSeq = rt.Seq
+		}
+	}
+
+	expiries := common.ExpiryHistogram(b.expiries, b.count)
+
+	footer := block.Footer{Version: block.Version}
+	if len(b.ranges) > 0 {
+		footer.RangeDel = b.appendBlock(block.EncodeRangeTombstones(b.ranges), block.NoCompression)
+	}
+	if b.w.bitsPerKey > 0 {
+		filter := bloom.Build(b.keyHashes, b.w.bitsPerKey)
+		footer.Filter = b.appendBlock(filter.Encode(), block.NoCompression)
+	}
+	footer.Index = b.appendBlock(b.index.Encode(), block.NoCompression)
+	footer.Properties = b.appendBlock(block.Properties{
+		ID:       segmentID,
+		MinKey:   minKey,
+		MaxKey:   maxKey,
+		Strategy: b.strategy,
+		Count:    uint64(b.count),
+		MaxSeq:   maxSeq,
+		Expiries: expiries,
+	}.Encode(), block.NoCompression)
+
+	total := int64(block.PreambleSize + len(b.body) + block.FooterSize)
+	buf := make([]byte, 0, total)
+	buf = append(buf, block.Preamble(total)...)
+	buf = append(buf, b.body...)
+	buf = append(buf, footer.Encode()...)
+
+	var offset, length int64
+	shared := b.w.store == nil
+	if shared {
+		var err error
+		if offset, length, err = b.w.fileMgr.Append(buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := b.w.store.Write(segmentID, buf); err != nil {
+			return nil, err
+		}
+		length = int64(len(buf))
+	}
+
+	meta := &common.SegmentMeta{
+		ID:                segmentID,
+		Offset:            offset,
+		Length:            length,
+		MinKey:            minKey,
+		MaxKey:            maxKey,
+		Strategy:          b.strategy,
+		CreatedAt:         now,
+		LastRewriteAt:     now,
+		MaxSeq:            maxSeq,
+		Expiries:          expiries,
+		Shared:            shared,
+		RangeDeletes:      footer.RangeDel.Length > 0,
+		SparseIndex:       &footer,
+		DataStartOffset:   block.PreambleSize,
+		SparseIndexOffset: dataEnd,
+	}
+	return meta, nil
+}
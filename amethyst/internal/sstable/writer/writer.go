@@ -1,32 +1,80 @@
 package writer
 
 import (
+	"amethyst/internal/bloom"
 	"amethyst/internal/common"
 	"amethyst/internal/segmentfile"
 	"amethyst/internal/sparseindex"
 	"encoding/binary"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// returned when entries reach a SegmentBuilder out of key order
+var ErrUnsorted = errors.New("sstable: entries not in key order, versions newest first")
+
+// returned by the flat layout's builder, which has no room for range
+// tombstones
+var ErrNoRangeTombstones = errors.New("sstable: flat segments can't hold range tombstones")
+
+// returned by the flat layout's builder for an expiring entry: the layout
+// has no version to tell readers its records may carry an expiry
+var ErrNoExpiry = errors.New("sstable: flat segments can't hold expiring values")
+
+// returned by the flat layout's builder for a merge operand, for the same
+// reason as ErrNoExpiry
+var ErrNoMergeOperands = errors.New("sstable: flat segments can't hold merge operands")
+
 type SSTableWriter interface {
 	// Updated to accept the sorted slice from Memtable
 	WriteSegment(
 		sortedData []common.KVEntry,
 		strategy common.CompactionType,
 	) (*common.SegmentMeta, error)
+	// NewSegment is WriteSegment for callers that produce entries one by
+	// one, like a compaction merge, and shouldn't collect them first
+	NewSegment(strategy common.CompactionType) SegmentBuilder
+}
+
+// SegmentBuilder encodes entries as they arrive, in increasing key order,
+// several versions of a key in decreasing Seq order. Only the encoded segment is held until Finish writes it out in one
+// piece, so segments sharing the legacy data file never interleave.
+type SegmentBuilder interface {
+	Add(entry common.KVEntry) error
+	// AddRangeTombstone stores rt in the segment's range tombstone block,
+	// in any order relative to Add
+	AddRangeTombstone(rt common.RangeTombstone) error
+	Count() int
+	// Size is the encoded size of the entries added so far
+	Size() int64
+	// Finish writes the segment and returns its metadata, or nil if
+	// nothing was added
+	Finish() (*common.SegmentMeta, error)
 }
 
 type writer struct {
-	fileMgr      segmentfile.SegmentFileManager
+	fileMgr      segmentfile.SegmentFileManager // legacy shared data file
+	store        segmentfile.SegmentStore       // one file per segment, used instead of fileMgr when set
 	indexBuilder sparseindex.Builder
+	bitsPerKey   int           // Bloom filter size, 0 writes segments without one
+	blocks       *BlockOptions // nil writes the flat version 1 layout
 }
 
+// NewWriter writes the flat version 1 layout: one run of records with a
+// sparse index every few records. NewBlockWriter writes the block format.
 func NewWriter(fileMgr segmentfile.SegmentFileManager, indexBuilder sparseindex.Builder) *writer {
+	return NewWriterWithBloom(fileMgr, indexBuilder, bloom.DefaultBitsPerKey)
+}
+
+// NewWriterWithBloom is NewWriter with an explicit Bloom filter size in bits
+// per key; 0 turns filters off.
+func NewWriterWithBloom(fileMgr segmentfile.SegmentFileManager, indexBuilder sparseindex.Builder, bitsPerKey int) *writer {
 	return &writer{
 		fileMgr:      fileMgr,
 		indexBuilder: indexBuilder,
+		bitsPerKey:   bitsPerKey,
 	}
 }
 
@@ -34,10 +82,141 @@ func (w *writer) WriteSegment(
 	sortedData []common.KVEntry,
 	strategy common.CompactionType,
 ) (*common.SegmentMeta, error) {
+	b := w.NewSegment(strategy)
+	for _, entry := range sortedData {
+		if err := b.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// NewSegment starts a segment that is filled one entry at a time.
+func (w *writer) NewSegment(strategy common.CompactionType) SegmentBuilder {
+	if w.blocks != nil {
+		return newBlockBuilder(w, strategy)
+	}
+	return &segmentBuilder{
+		w:        w,
+		strategy: strategy,
+		records:  make([]byte, 0, 1024),
+	}
+}
+
+type segmentBuilder struct {
+	w        *writer
+	strategy common.CompactionType
+
+	records []byte // encoded data entries
+	count   int
+	minKey  string
+	maxKey  string
+	maxSeq  uint64
+	lastSeq uint64 // of the last entry added
+
+	// the sparse index points at the newest version of a key, a sample
+	// falling on an older one waits for the next key
+	samplePending bool
+
+	// sampled sparse index, offsets relative to the start of the records
+	indexKeys    []string
+	indexOffsets []int64
+
+	keyHashes []uint64 // for the Bloom filter
+}
+
+func (b *segmentBuilder) Add(entry common.KVEntry) error {
+	if b.count > 0 && outOfOrder(entry, b.maxKey, b.lastSeq) {
+		return ErrUnsorted
+	}
+	if entry.ExpiresAt != 0 && !entry.Tombstone {
+		return ErrNoExpiry
+	}
+	if entry.Merge {
+		return ErrNoMergeOperands
+	}
+	newKey := b.count == 0 || entry.Key != b.maxKey
+	if b.count == 0 {
+		b.minKey = entry.Key
+	}
+	b.maxKey = entry.Key
+	b.lastSeq = entry.Seq
+	if entry.Seq > b.maxSeq {
+		b.maxSeq = entry.Seq
+	}
+
+	// We track keys and offsets specifically for the Sparse Index
+	if b.w.indexBuilder.Sample(b.count) {
+		b.samplePending = true
+	}
+	if b.samplePending && newKey {
+		b.indexKeys = append(b.indexKeys, entry.Key)
+		b.indexOffsets = append(b.indexOffsets, int64(len(b.records)))
+		b.samplePending = false
+	}
+
+	if b.w.bitsPerKey > 0 && newKey {
+		b.keyHashes = append(b.keyHashes, bloom.Hash(entry.Key))
+	}
+
+	b.records = appendRecord(b.records, entry)
+	b.count++
+	return nil
+}
+
+// whether entry can't follow the last one added, lastKey at lastSeq
+func outOfOrder(entry common.KVEntry, lastKey string, lastSeq uint64) bool {
+	return entry.Key < lastKey || (entry.Key == lastKey && entry.Seq >= lastSeq)
+}
+
+// Format: KeyLen(4)| ValLen(4)| Tombstone(1)| Seq(8)| Key| Val
+func appendRecord(buf []byte, entry common.KVEntry) []byte {
+	tmp := make([]byte, 17)
+	binary.BigEndian.PutUint32(tmp[0:4], uint32(len(entry.Key)))
+	vLen := len(entry.Value)
+
+	if entry.Tombstone {
+		tmp[8] = common.RecordFlagTombstone
+	} else if entry.ExpiresAt != 0 {
+		tmp[8] = common.RecordFlagExpiring
+		vLen += 8
+	}
+	if entry.Merge {
+		tmp[8] |= common.RecordFlagMerge
+	}
+	binary.BigEndian.PutUint32(tmp[4:8], uint32(vLen))
+	binary.BigEndian.PutUint64(tmp[9:17], entry.Seq)
+
+	buf = append(buf, tmp...)
+	buf = append(buf, []byte(entry.Key)...)
+	if tmp[8]&common.RecordFlagExpiring != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(entry.ExpiresAt))
+	}
+	buf = append(buf, entry.Value...)
+	return buf
+}
+
+func (b *segmentBuilder) AddRangeTombstone(rt common.RangeTombstone) error {
+	return ErrNoRangeTombstones
+}
+
+func (b *segmentBuilder) Count() int {
+	return b.count
+}
+
+func (b *segmentBuilder) Size() int64 {
+	return int64(len(b.records))
+}
+
+func (b *segmentBuilder) Finish() (*common.SegmentMeta, error) {
+	if b.count == 0 {
+		return nil, nil // Or handle empty flush appropriately
+	}
+
 	segmentID := uuid.New().String()
 	now := time.Now().Unix()
 
-	buf := make([]byte, 0, 1024)
+	buf := make([]byte, 0, len(b.records)+1024)
 
 	// Helper to write length-prefixed strings
 	writeString := func(s string) {
@@ -49,51 +228,30 @@ func (w *writer) WriteSegment(
 
 	// 1. Header: ID, MinKey, MaxKey
 	writeString(segmentID)
+	writeString(b.minKey)
+	writeString(b.maxKey)
 
-	if len(sortedData) == 0 {
-		return nil, nil // Or handle empty flush appropriately
+	// 2. Metadata: Strategy (high bits flag a filter and sequence numbers),
+	// Record Count and highest Seq
+	var filter *bloom.Filter
+	flags := common.SegmentFlagSeq
+	if b.w.bitsPerKey > 0 {
+		filter = bloom.Build(b.keyHashes, b.w.bitsPerKey)
+		flags |= common.SegmentFlagFilter
 	}
-
-	minKey := sortedData[0].Key
-	maxKey := sortedData[len(sortedData)-1].Key
-
-	writeString(minKey)
-	writeString(maxKey)
-
-	// 2. Metadata: Strategy and Record Count
-	buf = append(buf, byte(strategy))
+	buf = append(buf, byte(b.strategy)|flags)
 	tmp8 := make([]byte, 8)
-	binary.BigEndian.PutUint64(tmp8, uint64(len(sortedData)))
+	binary.BigEndian.PutUint64(tmp8, uint64(b.count))
+	buf = append(buf, tmp8...)
+	binary.BigEndian.PutUint64(tmp8, b.maxSeq)
 	buf = append(buf, tmp8...)
 
 	// 3. Actual Data Entries
-	// We track keys and offsets specifically for the Sparse Index
-	keysForIndex := make([]string, 0, len(sortedData))
-	offsetsForIndex := make([]int64, 0, len(sortedData))
 	dataStartOffset := int64(len(buf))
+	buf = append(buf, b.records...)
 
-	for _, entry := range sortedData {
-		// Calculate offset relative to data start for the index
-		offsetsForIndex = append(offsetsForIndex, int64(len(buf))-dataStartOffset)
-		keysForIndex = append(keysForIndex, entry.Key)
-
-		tmp := make([]byte, 9)
-		binary.BigEndian.PutUint32(tmp[0:4], uint32(len(entry.Key)))
-		binary.BigEndian.PutUint32(tmp[4:8], uint32(len(entry.Value)))
-
-		if entry.Tombstone {
-			tmp[8] = 1
-		} else {
-			tmp[8] = 0
-		}
-
-		buf = append(buf, tmp...)
-		buf = append(buf, []byte(entry.Key)...)
-		buf = append(buf, entry.Value...)
-	}
-
-	// 4. Build and Serialize Sparse Index
-	sparse := w.indexBuilder.Build(keysForIndex, offsetsForIndex)
+	// 4. Serialize the Sparse Index sampled while adding
+	sparse := &sparseindex.SparseIndex{Keys: b.indexKeys, Offsets: b.indexOffsets}
 	sparseOffset := int64(len(buf))
 
 	for i, k := range sparse.Keys {
@@ -112,8 +270,17 @@ func (w *writer) WriteSegment(
 	binary.BigEndian.PutUint64(tmp8_footer, uint64(sparseOffset))
 	buf = append(buf, tmp8_footer...)
 
-	// 6. Final Disk Write
-	offset, length, err := w.fileMgr.Append(buf)
+	// 6. Bloom filter after the footer: Len(4)| Filter
+	if filter != nil {
+		enc := filter.Encode()
+		tmp4 := make([]byte, 4)
+		binary.BigEndian.PutUint32(tmp4, uint32(len(enc)))
+		buf = append(buf, tmp4...)
+		buf = append(buf, enc...)
+	}
+
+	// 7. Final Disk Write
+	offset, length, err := b.w.fileMgr.Append(buf)
 	if err != nil {
 		return nil, err
 	}
@@ -122,19 +289,24 @@ func (w *writer) WriteSegment(
 		ID:                segmentID,
 		Offset:            offset,
 		Length:            length,
-		MinKey:            minKey,
-		MaxKey:            maxKey,
-		Strategy:          strategy,
+		MinKey:            b.minKey,
+		MaxKey:            b.maxKey,
+		Strategy:          b.strategy,
 		ReadCount:         0,
 		WriteCount:        0,
 		OverlapCount:      0, // Will be updated by Tracker
 		CreatedAt:         now,
 		LastRewriteAt:     now,
+		MaxSeq:            b.maxSeq,
 		Obsolete:          false,
+		Shared:            true,
 		SparseIndex:       sparse,
 		DataStartOffset:   dataStartOffset,
 		SparseIndexOffset: sparseOffset,
 	}
+	if filter != nil {
+		meta.Filter = filter
+	}
 
 	return meta, nil
 }
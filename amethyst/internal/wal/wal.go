@@ -5,126 +5,763 @@ package wal
 import (
 	"amethyst/internal/common"
 	"encoding/binary"
-	"io"   //ReadFull
-	"os"   //FileHandling
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io" //ReadFull
+	"log"
+	"os" //FileHandling
+	"path/filepath"
+	"sort"
 	"sync" //Mutex
+	"time"
 )
 
+// log files live in one directory as wal-000001.log, wal-000002.log, ...
+// only the highest numbered one is written to, the rest are sealed
+const fileNameFormat = "wal-%06d.log"
+
+// the single log file of the first versions, in the engine directory too:
+// headerless KeyLen(4)| ValLen(4)| Tombstone(1)| Key| Val records without
+// checksum or sequence number, see ReadLegacy
+const LegacyFileName = "wal.log"
+
+// file header: Magic(4)| Version(4)
+// version 1 records carry no sequence number, they are still readable and
+// come back with Seq 0. version 3 added batch records, version 4 range
+// deletes, version 5 puts with an expiry, version 6 merge operands.
+const (
+	walMagic   = uint32(0x414d5741) // "AMWA"
+	walVersion = uint32(6)
+	headerSize = 8
+)
+
+// record header: CRC32C(4)| KeyLen(4)| ValLen(4)| Kind(1)| Seq(8), the
+// legacy log's is KeyLen(4)| ValLen(4)| Tombstone(1)
+const (
+	recordHeaderSize   = 21
+	recordHeaderSizeV1 = 13
+	recordHeaderSizeV0 = 9
+)
+
+// record kinds, put and delete keep the values the old tombstone flag had
+const (
+	recordPut byte = iota
+	recordDelete
+	recordBatch
+	recordRangeDelete // key is the start of the range, value its end
+	recordPutExpiring // value is ExpiresAt(8)| Value
+	recordMerge       // value is the operand
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrBadHeader     = errors.New("wal: missing or unknown file header")
+	ErrCorruptRecord = errors.New("wal: corrupt or truncated record")
+	ErrEmptyBatch    = errors.New("wal: empty batch")
+	ErrClosed        = errors.New("wal: closed")
+)
+
+// RecoveryMode decides what ReadAll does with a record that fails its
+// checksum or is cut short.
+type RecoveryMode int
+
+const (
+	// TolerateTail treats the first bad record of the newest file holding
+	// records as the end of the log and cuts the file there; this is what a
+	// crash in the middle of a write leaves. Older files were fsynced when
+	// they were sealed, a bad record in one of them fails ReadAll.
+	TolerateTail RecoveryMode = iota
+	// Strict fails on any corruption, even at the tail.
+	Strict
+	// SkipCorrupt drops records whose checksum fails but whose lengths still
+	// fit in the file and keeps reading; anything else ends the file like
+	// TolerateTail's tail, in sealed files too, and reading goes on with the
+	// next file.
+	SkipCorrupt
+)
+
+// SyncPolicy decides when committed records are fsynced.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs every commit; concurrent writers still share one
+	// fsync through group commit.
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodic fsyncs once SyncInterval has passed or SyncBytes have been
+	// written since the last fsync, whichever comes first.
+	SyncPeriodic
+	// SyncNever leaves flushing to the OS; only Sync and Close fsync.
+	SyncNever
+)
+
+type Options struct {
+	Recovery     RecoveryMode
+	Sync         SyncPolicy
+	SyncInterval time.Duration //SyncPeriodic only
+	SyncBytes    int64         //SyncPeriodic only, 0 disables the byte trigger
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Recovery:     TolerateTail,
+		Sync:         SyncAlways,
+		SyncInterval: 10 * time.Millisecond,
+		SyncBytes:    1 << 20,
+	}
+}
+
 // interface for wal
 type WAL interface {
-	LogPut(key string, value []byte) error
-	LogDelete(key string) error
+	LogPut(seq uint64, key string, value []byte) error
+	// LogPutExpiring is LogPut for a value that expires at expiresAt, in
+	// unix nanoseconds
+	LogPutExpiring(seq uint64, key string, value []byte, expiresAt int64) error
+	LogDelete(seq uint64, key string) error
+	// LogMerge logs a merge operand for key, see common.KVEntry.Merge
+	LogMerge(seq uint64, key string, operand []byte) error
+	// LogDeleteRange logs the deletion of every key with start <= key < end,
+	// an empty end meaning no upper bound
+	LogDeleteRange(seq uint64, start, end string) error
+	// LogBatch writes entries as one checksummed record, so replay sees
+	// either all of them or none. Entry i gets sequence number seq+i.
+	LogBatch(seq uint64, entries []common.WALEntry) error
 	ReadAll() ([]common.WALEntry, error)
+
+	// Rotate seals the active file and starts a new one, returning the
+	// number of the sealed file. Everything logged before the call is in
+	// files numbered <= that number.
+	Rotate() (uint64, error)
+	// Release deletes sealed files numbered <= upTo, once the data they
+	// cover is durable elsewhere.
+	Release(upTo uint64) error
+	// Truncate drops everything logged so far (Rotate + Release).
 	Truncate() error
+
+	Sync() error
+	Close() error
+}
+
+// one writer waiting for its record to be committed
+type commitRequest struct {
+	data []byte
+	done chan error
 }
 
 type diskWAL struct {
-	file *os.File //file obj on hard drive
-	path string
-	mu   sync.Mutex //mutex lock, only one at a time
+	dir     string
+	file    *os.File //active file obj on hard drive
+	fileNum uint64   //number of the active file
+	sealed  []uint64 //sealed files still on disk, ascending
+	opts    Options
+
+	mu         sync.Mutex //guards the commit queue
+	queue      []*commitRequest
+	committing bool //a leader is writing a batch
+
+	fileMu   sync.Mutex //guards the file and sync state
+	unsynced int64
+	lastSync time.Time
+
+	stop      chan struct{} //stops the periodic syncer
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
-// creates new or uses existing
-func NewDiskWAL(path string) (WAL, error) {
-	//O_Append means append only, O_Create - make if missing and O_RDWR- read write
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+// opens the log in dir, creating it if needed. Files left by an earlier run
+// are kept sealed for ReadAll; new records go to a fresh file.
+func NewDiskWAL(dir string) (WAL, error) {
+	return NewDiskWALWithOptions(dir, DefaultOptions())
+}
+
+func NewDiskWALWithOptions(dir string, opts Options) (WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	sealed, err := listFiles(dir)
 	if err != nil {
 		return nil, err
 	}
-	return &diskWAL{file: f, path: path}, nil
-}
 
-func (w *diskWAL) LogPut(key string, value []byte) error {
-	//create walentry struc and adds to write func
-	return w.write(common.WALEntry{Key: key, Value: value, Tombstone: false})
+	w := &diskWAL{dir: dir, sealed: sealed, opts: opts, lastSync: time.Now(), stop: make(chan struct{})}
+	next := uint64(1)
+	if len(sealed) > 0 {
+		next = sealed[len(sealed)-1] + 1
+	}
+	if err := w.openFile(next); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncPeriodic && opts.SyncInterval > 0 {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return w, nil
 }
 
-func (w *diskWAL) LogDelete(key string) error {
-	//adds a tombstone=true
-	return w.write(common.WALEntry{Key: key, Tombstone: true})
+// numbers of the log files in dir, ascending
+func listFiles(dir string) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var nums []uint64
+	for _, name := range names {
+		var n uint64
+		if _, err := fmt.Sscanf(filepath.Base(name), fileNameFormat, &n); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
 }
 
-// write func
-func (w *diskWAL) write(entry common.WALEntry) error {
-	w.mu.Lock()         //locked mutex
-	defer w.mu.Unlock() //unlock mutex when over
+func (w *diskWAL) filePath(num uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf(fileNameFormat, num))
+}
 
-	// Format: KeyLen(4)| ValLen(4)| Tombstone(1)| KeyBytes| ValBytes
-	header := make([]byte, 9)
-	binary.BigEndian.PutUint32(header[0:4], uint32(len(entry.Key)))
-	binary.BigEndian.PutUint32(header[4:8], uint32(len(entry.Value)))
-	if entry.Tombstone {
-		header[8] = 1
-	} else {
-		header[8] = 0
+// creates file num with its header and makes it the active file.
+// caller holds fileMu (or owns w exclusively)
+func (w *diskWAL) openFile(num uint64) error {
+	//O_Append means append only, O_Create - make if missing and O_RDWR- read write
+	f, err := os.OpenFile(w.filePath(num), os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return err
 	}
 
-	//writing header then key then value
-	if _, err := w.file.Write(header); err != nil {
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(header[0:4], walMagic)
+	binary.BigEndian.PutUint32(header[4:8], walVersion)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
 		return err
 	}
-	if _, err := w.file.WriteString(entry.Key); err != nil {
+	if err := f.Sync(); err != nil {
+		f.Close()
 		return err
 	}
-	if _, err := w.file.Write(entry.Value); err != nil {
+	syncDir(w.dir)
+
+	w.file = f
+	w.fileNum = num
+	return nil
+}
+
+// fsyncs a directory so files created or removed in it survive a crash
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func (w *diskWAL) LogPut(seq uint64, key string, value []byte) error {
+	return w.write(encodeRecord(recordPut, seq, key, value))
+}
+
+func (w *diskWAL) LogPutExpiring(seq uint64, key string, value []byte, expiresAt int64) error {
+	return w.write(encodeRecord(recordPutExpiring, seq, key, expiringValue(value, expiresAt)))
+}
+
+func expiringValue(value []byte, expiresAt int64) []byte {
+	buf := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(value)), uint64(expiresAt))
+	return append(buf, value...)
+}
+
+func (w *diskWAL) LogDelete(seq uint64, key string) error {
+	return w.write(encodeRecord(recordDelete, seq, key, nil))
+}
+
+func (w *diskWAL) LogMerge(seq uint64, key string, operand []byte) error {
+	return w.write(encodeRecord(recordMerge, seq, key, operand))
+}
+
+func (w *diskWAL) LogDeleteRange(seq uint64, start, end string) error {
+	return w.write(encodeRecord(recordRangeDelete, seq, start, []byte(end)))
+}
+
+func (w *diskWAL) LogBatch(seq uint64, entries []common.WALEntry) error {
+	if len(entries) == 0 {
+		return ErrEmptyBatch
+	}
+	return w.write(encodeRecord(recordBatch, seq, "", encodeBatch(entries)))
+}
+
+// write func, group commit: the first writer to find no commit in progress
+// becomes the leader and writes everything queued behind it in one write and
+// one fsync, the rest just wait for their result
+func (w *diskWAL) write(record []byte) error {
+	req := &commitRequest{data: record, done: make(chan error, 1)}
+
+	w.mu.Lock() //locked mutex
+	w.queue = append(w.queue, req)
+	if w.committing {
+		w.mu.Unlock()
+		return <-req.done
+	}
+
+	w.committing = true
+	for len(w.queue) > 0 {
+		batch := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+
+		err := w.commit(batch)
+		for _, r := range batch {
+			r.done <- err
+		}
+
+		w.mu.Lock()
+	}
+	w.committing = false
+	w.mu.Unlock()
+
+	return <-req.done
+}
+
+// writes a batch of records and fsyncs according to the sync policy
+func (w *diskWAL) commit(batch []*commitRequest) error {
+	buf := batch[0].data
+	if len(batch) > 1 {
+		size := 0
+		for _, r := range batch {
+			size += len(r.data)
+		}
+		buf = make([]byte, 0, size)
+		for _, r := range batch {
+			buf = append(buf, r.data...)
+		}
+	}
+
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+	if w.file == nil {
+		return ErrClosed
+	}
+
+	//whole batch in one write so a crash leaves at most one torn record
+	if _, err := w.file.Write(buf); err != nil {
 		return err
 	}
+	w.unsynced += int64(len(buf))
 
-	//write to phy disk
-	return w.file.Sync()
+	switch w.opts.Sync {
+	case SyncAlways:
+		return w.syncLocked()
+	case SyncPeriodic:
+		if (w.opts.SyncBytes > 0 && w.unsynced >= w.opts.SyncBytes) ||
+			time.Since(w.lastSync) >= w.opts.SyncInterval {
+			return w.syncLocked()
+		}
+	}
+	return nil
 }
 
-// on start to reconstruct db
+// write to phy disk, caller holds fileMu
+func (w *diskWAL) syncLocked() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.unsynced = 0
+	w.lastSync = time.Now()
+	return nil
+}
+
+// catches writes that went quiet before the byte or time trigger fired
+func (w *diskWAL) syncLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.fileMu.Lock()
+			if w.file != nil && w.unsynced > 0 {
+				if err := w.syncLocked(); err != nil {
+					log.Printf("wal: periodic sync failed: %v", err)
+				}
+			}
+			w.fileMu.Unlock()
+		}
+	}
+}
+
+// forces everything written so far onto disk
+func (w *diskWAL) Sync() error {
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+	if w.file == nil {
+		return ErrClosed
+	}
+	return w.syncLocked()
+}
+
+// stops the syncer and closes the file after a final fsync
+func (w *diskWAL) Close() error {
+	w.closeOnce.Do(func() { close(w.stop) })
+	w.wg.Wait()
+
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.syncLocked()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	return err
+}
+
+// Format: CRC32C(4)| KeyLen(4)| ValLen(4)| Kind(1)| Seq(8)| KeyBytes| ValBytes
+// the checksum covers everything after itself
+func encodeRecord(kind byte, seq uint64, key string, value []byte) []byte {
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(key)+len(value))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(value)))
+	buf[12] = kind
+	binary.BigEndian.PutUint64(buf[13:21], seq)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+
+	binary.BigEndian.PutUint32(buf[0:4], crc32.Checksum(buf[4:], crcTable))
+	return buf
+}
+
+// batch record value: Count(4) then per entry Kind(1)| KeyLen(4)| ValLen(4)| Key| Val
+func encodeBatch(entries []common.WALEntry) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(entries)))
+	for _, entry := range entries {
+		kind, value := recordPut, entry.Value
+		switch {
+		case entry.RangeDelete:
+			kind, value = recordRangeDelete, []byte(entry.End)
+		case entry.Tombstone:
+			kind = recordDelete
+		case entry.Merge:
+			kind = recordMerge
+		case entry.ExpiresAt != 0:
+			kind, value = recordPutExpiring, expiringValue(entry.Value, entry.ExpiresAt)
+		}
+		buf = append(buf, kind)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(entry.Key)))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+		buf = append(buf, entry.Key...)
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+func decodeBatch(body []byte, seq uint64) ([]common.WALEntry, bool) {
+	if len(body) < 4 {
+		return nil, false
+	}
+	count := binary.BigEndian.Uint32(body[0:4])
+	body = body[4:]
+	if int64(count)*9 > int64(len(body)) {
+		return nil, false
+	}
+
+	entries := make([]common.WALEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(body) < 9 {
+			return nil, false
+		}
+		kind := body[0]
+		kLen := int(binary.BigEndian.Uint32(body[1:5]))
+		vLen := int(binary.BigEndian.Uint32(body[5:9]))
+		body = body[9:]
+		if kLen < 0 || vLen < 0 || len(body) < kLen+vLen {
+			return nil, false
+		}
+		entry, ok := decodeEntry(kind, seq+uint64(i), body[:kLen], body[kLen:kLen+vLen])
+		if !ok {
+			return nil, false
+		}
+		entries = append(entries, entry)
+		body = body[kLen+vLen:]
+	}
+	return entries, len(body) == 0
+}
+
+// entry of a put, delete, merge or range delete record; false if an expiring
+// put is too short to hold its expiry
+func decodeEntry(kind byte, seq uint64, key, value []byte) (common.WALEntry, bool) {
+	switch kind {
+	case recordRangeDelete:
+		return common.WALEntry{Key: string(key), RangeDelete: true, End: string(value), Seq: seq}, true
+	case recordPutExpiring:
+		if len(value) < 8 {
+			return common.WALEntry{}, false
+		}
+		return common.WALEntry{
+			Key:       string(key),
+			Value:     value[8:],
+			Seq:       seq,
+			ExpiresAt: int64(binary.BigEndian.Uint64(value)),
+		}, true
+	}
+	return common.WALEntry{
+		Key:       string(key),
+		Value:     value,
+		Tombstone: kind == recordDelete,
+		Merge:     kind == recordMerge,
+		Seq:       seq,
+	}, true
+}
+
+// on start to reconstruct db, every file still on disk in order
 func (w *diskWAL) ReadAll() ([]common.WALEntry, error) {
 	//mutex lock and unlock
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+	if w.file == nil {
+		return nil, ErrClosed
+	}
+
+	nums := append(append([]uint64{}, w.sealed...), w.fileNum)
+	//only the newest file with records in it can have been torn by a crash,
+	//the ones after it hold no more than a header
+	tail := 0
+	for i, num := range nums {
+		info, err := os.Stat(w.filePath(num))
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() > headerSize {
+			tail = i
+		}
+	}
+
+	var entries []common.WALEntry
+	for i, num := range nums {
+		f, err := os.OpenFile(w.filePath(num), os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		fileEntries, err := w.readFile(f, i >= tail)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", w.filePath(num), err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return entries, nil //return full list
+}
+
+// ReadLegacy reads the log a version from before numbered files left in
+// dir, entries in write order and with Seq 0; nil if there is none. A
+// record cut short is where a crash stopped a write and ends the log.
+func ReadLegacy(dir string) ([]common.WALEntry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, LegacyFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []common.WALEntry
+	pos := 0
+	for pos < len(data) {
+		if len(data)-pos < recordHeaderSizeV0 {
+			break
+		}
+		kLen := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		vLen := int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		tomb := data[pos+8]
+		if tomb > 1 {
+			return nil, fmt.Errorf("%s at offset %d: %w", LegacyFileName, pos, ErrCorruptRecord)
+		}
+		body := pos + recordHeaderSizeV0
+		if kLen < 0 || vLen < 0 || len(data)-body < kLen+vLen {
+			break
+		}
+		entry := common.WALEntry{Key: string(data[body : body+kLen]), Tombstone: tomb == 1}
+		if !entry.Tombstone {
+			entry.Value = data[body+kLen : body+kLen+vLen]
+		}
+		entries = append(entries, entry)
+		pos = body + kLen + vLen
+	}
+	if pos < len(data) {
+		log.Printf("wal: dropping %d bytes of torn tail at offset %d of %s", len(data)-pos, pos, LegacyFileName)
+	}
+	return entries, nil
+}
 
-	//move marker to thr front
-	if _, err := w.file.Seek(0, 0); err != nil {
+// RemoveLegacy deletes the log ReadLegacy reads, once what it held is
+// durable elsewhere.
+func RemoveLegacy(dir string) error {
+	if err := os.Remove(filepath.Join(dir, LegacyFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// reads the records of one file, applying the recovery mode; tail tells
+// whether a crash can have left a torn record at its end
+func (w *diskWAL) readFile(f *os.File, tail bool) ([]common.WALEntry, error) {
+	stat, err := f.Stat()
+	if err != nil {
 		return nil, err
 	}
+	size := stat.Size()
+
+	//a header cut short by a crash means nothing was ever logged
+	if size < headerSize {
+		return nil, nil
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	version := binary.BigEndian.Uint32(header[4:8])
+	if binary.BigEndian.Uint32(header[0:4]) != walMagic || version < 1 || version > walVersion {
+		return nil, ErrBadHeader
+	}
+	hdrSize := recordHeaderSize
+	if version == 1 {
+		hdrSize = recordHeaderSizeV1
+	}
+
 	var entries []common.WALEntry
+	pos := int64(headerSize) //end of the last good record
 
 	//till EOF
-	for {
-		header := make([]byte, 9)
-		//checks for 9 bytes, if lesser err
-		if _, err := io.ReadFull(w.file, header); err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
+	for pos < size {
+		header := make([]byte, hdrSize)
+		//a short header can only be a torn tail
+		if _, err := io.ReadFull(f, header); err != nil {
+			return w.corruptTail(f, entries, pos, size, tail)
 		}
 
 		//get each parts length
-		kLen := binary.BigEndian.Uint32(header[0:4])
-		vLen := binary.BigEndian.Uint32(header[4:8])
-		isTomb := header[8] == 1
-
-		//buffers to hold the key value
-		keyBuf := make([]byte, kLen)
-		valBuf := make([]byte, vLen)
-		//read them
-		if _, err := io.ReadFull(w.file, keyBuf); err != nil {
-			return nil, err
+		sum := binary.BigEndian.Uint32(header[0:4])
+		kLen := binary.BigEndian.Uint32(header[4:8])
+		vLen := binary.BigEndian.Uint32(header[8:12])
+		kind := header[12]
+		var seq uint64
+		if version > 1 {
+			seq = binary.BigEndian.Uint64(header[13:21])
 		}
-		if _, err := io.ReadFull(w.file, valBuf); err != nil {
-			return nil, err
+
+		//lengths pointing past the end can't be trusted to find the next record
+		recLen := int64(hdrSize) + int64(kLen) + int64(vLen)
+		if pos+recLen > size {
+			return w.corruptTail(f, entries, pos, size, tail)
+		}
+
+		body := make([]byte, int64(kLen)+int64(vLen))
+		if _, err := io.ReadFull(f, body); err != nil {
+			return w.corruptTail(f, entries, pos, size, tail)
+		}
+
+		crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, body)
+		if crc != sum {
+			if w.opts.Recovery == SkipCorrupt {
+				log.Printf("wal: skipping corrupt record at offset %d", pos)
+				pos += recLen
+				continue
+			}
+			return w.corruptTail(f, entries, pos, size, tail)
+		}
+
+		//a batch comes back whole or, if it doesn't parse, not at all
+		if kind == recordBatch {
+			batch, ok := decodeBatch(body[kLen:], seq)
+			if !ok {
+				return w.corruptTail(f, entries, pos, size, tail)
+			}
+			entries = append(entries, batch...)
+			pos += recLen
+			continue
 		}
 
 		//add completed entry to list
-		entries = append(entries, common.WALEntry{Key: string(keyBuf), Value: valBuf, Tombstone: isTomb})
+		entry, ok := decodeEntry(kind, seq, body[:kLen], body[kLen:])
+		if !ok {
+			return w.corruptTail(f, entries, pos, size, tail)
+		}
+		entries = append(entries, entry)
+		pos += recLen
 	}
-	return entries, nil //return full list
+	return entries, nil
+}
+
+// handles a bad record at pos: strict mode fails, and so does TolerateTail
+// in a sealed file, where it is corruption in the middle of the log rather
+// than a torn write; otherwise what was read so far is kept and the file cut
+// there
+func (w *diskWAL) corruptTail(f *os.File, entries []common.WALEntry, pos, size int64, tail bool) ([]common.WALEntry, error) {
+	if w.opts.Recovery == Strict || (!tail && w.opts.Recovery != SkipCorrupt) {
+		return nil, ErrCorruptRecord
+	}
+	what := "torn tail"
+	if !tail {
+		what = "corrupt sealed log"
+	}
+	log.Printf("wal: dropping %d bytes of %s at offset %d of %s", size-pos, what, pos, f.Name())
+	if err := f.Truncate(pos); err != nil {
+		return nil, err
+	}
+	return entries, f.Sync()
+}
+
+func (w *diskWAL) Rotate() (uint64, error) {
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+	if w.file == nil {
+		return 0, ErrClosed
+	}
+
+	//seal: everything in the old file is on disk before it is handed off
+	if err := w.syncLocked(); err != nil {
+		return 0, err
+	}
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+	sealed := w.fileNum
+	w.sealed = append(w.sealed, sealed)
+	w.file = nil
+
+	if err := w.openFile(sealed + 1); err != nil {
+		return 0, err
+	}
+	return sealed, nil
+}
+
+func (w *diskWAL) Release(upTo uint64) error {
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+
+	kept := w.sealed[:0]
+	for _, num := range w.sealed {
+		if num > upTo {
+			kept = append(kept, num)
+			continue
+		}
+		if err := os.Remove(w.filePath(num)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.sealed = kept
+	syncDir(w.dir)
+	return nil
 }
 
 // clear
 func (w *diskWAL) Truncate() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	if w.file != nil {
-		w.file.Close()
+	sealed, err := w.Rotate()
+	if err != nil {
+		return err
 	}
-
-	return os.Remove(w.path)
+	return w.Release(sealed)
 }
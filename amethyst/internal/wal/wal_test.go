@@ -0,0 +1,262 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadAll_TornTail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal-000001.log")
+
+	w, err := NewDiskWAL(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	w.LogPut(1, "a", []byte("1"))
+	w.LogDelete(2, "b")
+	w.LogPut(3, "c", []byte("3"))
+
+	// simulate a crash halfway through the last record
+	stat, _ := os.Stat(path)
+	if err := os.Truncate(path, stat.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	strict, err := NewDiskWALWithOptions(dir, Options{Recovery: Strict})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if _, err := strict.ReadAll(); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("strict mode should fail on a torn tail, got %v", err)
+	}
+
+	w, _ = NewDiskWAL(dir)
+	entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatalf("tolerant read failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Key != "a" || !entries[1].Tombstone || entries[1].Seq != 2 {
+		t.Fatalf("expected the two intact records, got %+v", entries)
+	}
+
+	// the torn bytes are gone, so a new record is readable after the old ones
+	w.LogPut(4, "d", []byte("4"))
+	w, _ = NewDiskWAL(dir)
+	if entries, _ = w.ReadAll(); len(entries) != 3 || entries[2].Key != "d" {
+		t.Errorf("record after recovered tail lost: %+v", entries)
+	}
+}
+
+func TestReadAll_SkipCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal-000001.log")
+
+	w, _ := NewDiskWAL(dir)
+	w.LogPut(1, "a", []byte("1"))
+	w.LogPut(2, "b", []byte("2"))
+	w.LogPut(3, "c", []byte("3"))
+
+	// flip a value byte inside the middle record
+	data, _ := os.ReadFile(path)
+	recLen := recordHeaderSize + 2
+	data[headerSize+recLen+recLen-1] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	w, _ = NewDiskWALWithOptions(dir, Options{Recovery: SkipCorrupt})
+	entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Key != "a" || entries[1].Key != "c" {
+		t.Errorf("expected a and c around the corrupt record, got %+v", entries)
+	}
+}
+
+func TestReadAll_CorruptSealedFile(t *testing.T) {
+	dir := t.TempDir()
+	sealedPath := filepath.Join(dir, "wal-000001.log")
+
+	w, _ := NewDiskWAL(dir)
+	w.LogPut(1, "a", []byte("1"))
+	w.LogPut(2, "b", []byte("2"))
+	w.LogPut(3, "c", []byte("3"))
+	if _, err := w.Rotate(); err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	w.LogPut(4, "d", []byte("4"))
+	w.Close()
+
+	// the sealed file was fsynced, a bad record in it is not a torn write
+	data, _ := os.ReadFile(sealedPath)
+	recLen := recordHeaderSize + 2
+	data[headerSize+recLen+recLen-1] ^= 0xff
+	os.WriteFile(sealedPath, data, 0644)
+
+	w, _ = NewDiskWAL(dir)
+	if entries, err := w.ReadAll(); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("corrupt sealed file should fail replay, got %+v %v", entries, err)
+	}
+	w.Close()
+	if after, _ := os.ReadFile(sealedPath); len(after) != len(data) {
+		t.Errorf("sealed file cut from %d to %d bytes", len(data), len(after))
+	}
+
+	w, _ = NewDiskWALWithOptions(dir, Options{Recovery: SkipCorrupt})
+	entries, err := w.ReadAll()
+	if err != nil {
+		t.Fatalf("skip corrupt read failed: %v", err)
+	}
+	if len(entries) != 3 || entries[1].Key != "c" || entries[2].Key != "d" {
+		t.Errorf("expected a, c and d, got %+v", entries)
+	}
+	w.Close()
+
+	// a sealed file cut short is no torn tail either, newer files hold records
+	os.Truncate(sealedPath, int64(len(data)-1))
+	w, _ = NewDiskWAL(dir)
+	if _, err := w.ReadAll(); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("truncated sealed file should fail replay, got %v", err)
+	}
+	w.Close()
+}
+
+// records as the first versions wrote them to wal.log
+func legacyRecord(key, val string, tombstone bool) []byte {
+	rec := make([]byte, recordHeaderSizeV0, recordHeaderSizeV0+len(key)+len(val))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(key)))
+	binary.BigEndian.PutUint32(rec[4:8], uint32(len(val)))
+	if tombstone {
+		rec[8] = 1
+	}
+	return append(append(rec, key...), val...)
+}
+
+func TestReadLegacy(t *testing.T) {
+	dir := t.TempDir()
+	if entries, err := ReadLegacy(dir); entries != nil || err != nil {
+		t.Fatalf("no legacy log: %+v %v", entries, err)
+	}
+
+	var data []byte
+	data = append(data, legacyRecord("a", "1", false)...)
+	data = append(data, legacyRecord("b", "", true)...)
+	data = append(data, legacyRecord("c", "3", false)...)
+	path := filepath.Join(dir, LegacyFileName)
+	// cut halfway through the last record, as a crash would
+	if err := os.WriteFile(path, data[:len(data)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	// numbered files don't pick it up
+	w, err := NewDiskWAL(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if entries, err := w.ReadAll(); len(entries) != 0 || err != nil {
+		t.Errorf("legacy records read as numbered ones: %+v %v", entries, err)
+	}
+	w.Close()
+
+	entries, err := ReadLegacy(dir)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Key != "a" || string(entries[0].Value) != "1" ||
+		entries[1].Key != "b" || !entries[1].Tombstone || entries[0].Seq != 0 {
+		t.Fatalf("expected the two intact records, got %+v", entries)
+	}
+
+	bad := legacyRecord("d", "4", false)
+	bad[8] = 7
+	if err := os.WriteFile(path, append(data, bad...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadLegacy(dir); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("unknown tombstone byte: got %v", err)
+	}
+
+	if err := RemoveLegacy(dir); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("legacy log still there: %v", err)
+	}
+	if err := RemoveLegacy(dir); err != nil {
+		t.Errorf("removing a missing log: %v", err)
+	}
+}
+
+func TestGroupCommit_ConcurrentWriters(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncPeriodic, SyncNever} {
+		dir := t.TempDir()
+		opts := DefaultOptions()
+		opts.Sync = policy
+		opts.SyncInterval = time.Millisecond
+
+		w, err := NewDiskWALWithOptions(dir, opts)
+		if err != nil {
+			t.Fatalf("open failed: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					if err := w.LogPut(uint64(g*50+i+1), fmt.Sprintf("k-%d-%d", g, i), []byte("v")); err != nil {
+						t.Errorf("put failed: %v", err)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		if err := w.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+
+		w, _ = NewDiskWAL(dir)
+		entries, err := w.ReadAll()
+		if err != nil || len(entries) != 400 {
+			t.Errorf("policy %d: expected 400 records, got %d (%v)", policy, len(entries), err)
+		}
+		w.Close()
+	}
+}
+
+func TestRotateAndRelease(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _ := NewDiskWAL(dir)
+	w.LogPut(1, "a", []byte("1"))
+	sealed, err := w.Rotate()
+	if err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	if err := w.LogPut(2, "b", []byte("2")); err != nil {
+		t.Fatalf("put after rotate failed: %v", err)
+	}
+
+	// both files are still replayed until the sealed one is released
+	if entries, _ := w.ReadAll(); len(entries) != 2 {
+		t.Fatalf("expected 2 records across files, got %+v", entries)
+	}
+	if err := w.Release(sealed); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "wal-000001.log")); !os.IsNotExist(err) {
+		t.Errorf("sealed file not deleted: %v", err)
+	}
+	w.Close()
+
+	w, _ = NewDiskWAL(dir)
+	if entries, _ := w.ReadAll(); len(entries) != 1 || entries[0].Key != "b" {
+		t.Errorf("expected only b after release, got %+v", entries)
+	}
+}